@@ -5,9 +5,11 @@ fn="${1:-$result}"
 filename=$(basename "$fn")
 extension="${filename##*.}"
 filename="${filename%.*}"
+version=$(git describe --tags --always 2>/dev/null)
+ldflags="-X github.com/borevitzlab/go-timestreamtools/utils.Version=${version:-unknown}"
 env GOOS=windows go test "$1"
 env GOOS=linux go test "$1"
 env GOOS=darwin go test "$1"
-env GOOS=windows go build -a -o "$filename"_win-"$GOARCH".exe "$1"
-env GOOS=linux go build -a -o "$filename"_linux-"$GOARCH" "$1"
-env GOOS=darwin go build -a -o "$filename"_darwin-"$GOARCH" "$1"
+env GOOS=windows go build -a -ldflags "$ldflags" -o "$filename"_win-"$GOARCH".exe "$1"
+env GOOS=linux go build -a -ldflags "$ldflags" -o "$filename"_linux-"$GOARCH" "$1"
+env GOOS=darwin go build -a -ldflags "$ldflags" -o "$filename"_darwin-"$GOARCH" "$1"
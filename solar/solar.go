@@ -0,0 +1,162 @@
+// Package solar computes the position of the sun and the times of sunrise, sunset and twilight,
+// using the NOAA solar calculator equations (accurate to about a minute between +/-72 degrees latitude).
+package solar
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	// Sunrise is the elevation of the centre of the sun at sunrise and sunset, allowing for refraction and its radius
+	Sunrise = -0.833
+	// CivilTwilight is the elevation of the sun at civil dawn and dusk
+	CivilTwilight = -6.0
+	// NauticalTwilight is the elevation of the sun at nautical dawn and dusk
+	NauticalTwilight = -12.0
+	// AstronomicalTwilight is the elevation of the sun at astronomical dawn and dusk
+	AstronomicalTwilight = -18.0
+)
+
+var (
+	// ErrAlwaysAbove is returned when the sun stays above an elevation all day (ie midnight sun)
+	ErrAlwaysAbove = errors.New("[solar] sun is above the elevation all day")
+	// ErrAlwaysBelow is returned when the sun stays below an elevation all day (ie polar night)
+	ErrAlwaysBelow = errors.New("[solar] sun is below the elevation all day")
+)
+
+func rad(deg float64) float64 { return deg * math.Pi / 180 }
+func deg(rad float64) float64 { return rad * 180 / math.Pi }
+
+// julianCentury returns the julian centuries since J2000.0 of an instant.
+func julianCentury(t time.Time) float64 {
+	jd := float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5
+	return (jd - 2451545) / 36525
+}
+
+// declinationEqTime returns the declination of the sun in degrees and the equation of time in minutes.
+func declinationEqTime(t time.Time) (declination, eqTime float64) {
+	jc := julianCentury(t)
+	meanLong := math.Mod(280.46646+jc*(36000.76983+jc*0.0003032), 360)
+	meanAnomaly := 357.52911 + jc*(35999.05029-0.0001537*jc)
+	eccentricity := 0.016708634 - jc*(0.000042037+0.0000001267*jc)
+	center := math.Sin(rad(meanAnomaly))*(1.914602-jc*(0.004817+0.000014*jc)) +
+		math.Sin(rad(2*meanAnomaly))*(0.019993-0.000101*jc) +
+		math.Sin(rad(3*meanAnomaly))*0.000289
+	omega := 125.04 - 1934.136*jc
+	apparentLong := meanLong + center - 0.00569 - 0.00478*math.Sin(rad(omega))
+	meanObliquity := 23 + (26+(21.448-jc*(46.815+jc*(0.00059-jc*0.001813)))/60)/60
+	obliquity := meanObliquity + 0.00256*math.Cos(rad(omega))
+
+	declination = deg(math.Asin(math.Sin(rad(obliquity)) * math.Sin(rad(apparentLong))))
+
+	y := math.Pow(math.Tan(rad(obliquity/2)), 2)
+	l0, m := rad(meanLong), rad(meanAnomaly)
+	eqTime = 4 * deg(y*math.Sin(2*l0)-
+		2*eccentricity*math.Sin(m)+
+		4*eccentricity*y*math.Sin(m)*math.Cos(2*l0)-
+		0.5*y*y*math.Sin(4*l0)-
+		1.25*eccentricity*eccentricity*math.Sin(2*m))
+	return
+}
+
+// refraction returns the atmospheric refraction in degrees for a geometric elevation.
+func refraction(elevation float64) float64 {
+	tanEl := math.Tan(rad(elevation))
+	var arcsec float64
+	switch {
+	case elevation > 85:
+		return 0
+	case elevation > 5:
+		arcsec = 58.1/tanEl - 0.07/math.Pow(tanEl, 3) + 0.000086/math.Pow(tanEl, 5)
+	case elevation > -0.575:
+		arcsec = 1735 + elevation*(-518.2+elevation*(103.4+elevation*(-12.79+elevation*0.711)))
+	default:
+		arcsec = -20.772 / tanEl
+	}
+	return arcsec / 3600
+}
+
+// Position returns the apparent elevation (corrected for refraction) and the azimuth (clockwise from north)
+// of the sun in degrees, at an instant seen from lat, lon (degrees, north and east positive).
+func Position(t time.Time, lat, lon float64) (elevation, azimuth float64) {
+	declination, eqTime := declinationEqTime(t)
+	utc := t.UTC()
+	minutes := float64(utc.Hour()*60+utc.Minute()) + (float64(utc.Second())+float64(utc.Nanosecond())/1e9)/60
+	trueSolarTime := math.Mod(minutes+eqTime+4*lon, 1440)
+	if trueSolarTime < 0 {
+		trueSolarTime += 1440
+	}
+	hourAngle := trueSolarTime/4 - 180
+
+	latR, declR := rad(lat), rad(declination)
+	cosZenith := math.Sin(latR)*math.Sin(declR) + math.Cos(latR)*math.Cos(declR)*math.Cos(rad(hourAngle))
+	zenith := math.Acos(math.Max(-1, math.Min(1, cosZenith)))
+	elevation = 90 - deg(zenith)
+
+	denominator := math.Cos(latR) * math.Sin(zenith)
+	if math.Abs(denominator) > 1e-9 {
+		cosAz := (math.Sin(latR)*math.Cos(zenith) - math.Sin(declR)) / denominator
+		azimuth = deg(math.Acos(math.Max(-1, math.Min(1, cosAz))))
+		if hourAngle > 0 {
+			azimuth = math.Mod(azimuth+180, 360)
+		} else {
+			azimuth = math.Mod(540-azimuth, 360)
+		}
+	} else if lat > 0 {
+		azimuth = 180
+	}
+	return elevation + refraction(elevation), azimuth
+}
+
+// utcDay returns midnight UTC at the start of the calendar date of t in its own location.
+func utcDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func addMinutes(t time.Time, minutes float64) time.Time {
+	return t.Add(time.Duration(minutes * float64(time.Minute)))
+}
+
+// Noon returns the instant of solar noon on the calendar date of date at longitude lon.
+// the date is taken in the location of date, which should be close to local solar time for the longitude.
+func Noon(date time.Time, lon float64) time.Time {
+	day := utcDay(date)
+	noon := addMinutes(day, 720-4*lon)
+	for i := 0; i < 2; i++ {
+		_, eqTime := declinationEqTime(noon)
+		noon = addMinutes(day, 720-4*lon-eqTime)
+	}
+	return noon
+}
+
+// Crossing returns the instants the sun rises above and sets below an elevation (ie Sunrise or CivilTwilight)
+// on the calendar date of date, seen from lat, lon.
+// returns ErrAlwaysAbove or ErrAlwaysBelow if the sun doesnt cross the elevation that day.
+func Crossing(date time.Time, lat, lon, elevation float64) (rise, set time.Time, err error) {
+	noon := Noon(date, lon)
+	crossing := func(direction float64) (time.Time, error) {
+		t := noon
+		// iterate, evaluating the declination at the previous estimate of the crossing
+		for i := 0; i < 3; i++ {
+			declination, eqTime := declinationEqTime(t)
+			latR, declR := rad(lat), rad(declination)
+			cosHourAngle := math.Cos(rad(90-elevation))/(math.Cos(latR)*math.Cos(declR)) - math.Tan(latR)*math.Tan(declR)
+			if cosHourAngle > 1 {
+				return time.Time{}, ErrAlwaysBelow
+			}
+			if cosHourAngle < -1 {
+				return time.Time{}, ErrAlwaysAbove
+			}
+			hourAngle := deg(math.Acos(cosHourAngle))
+			t = addMinutes(utcDay(date), 720-4*(lon+direction*hourAngle)-eqTime)
+		}
+		return t, nil
+	}
+	if rise, err = crossing(1); err != nil {
+		return
+	}
+	set, err = crossing(-1)
+	return
+}
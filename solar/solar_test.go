@@ -0,0 +1,76 @@
+package solar
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func assertNear(t *testing.T, expected, actual time.Time, msg string) {
+	diff := expected.Sub(actual)
+	if diff < 0 {
+		diff = -diff
+	}
+	assert.True(t, diff < 2*time.Minute, "%s: expected %s got %s", msg, expected, actual.In(expected.Location()))
+}
+
+func TestCrossing(t *testing.T) {
+	london, _ := time.LoadLocation("Europe/London")
+	canberra, _ := time.LoadLocation("Australia/Canberra")
+	for _, c := range []struct {
+		name      string
+		lat, lon  float64
+		date      time.Time
+		rise, set time.Time
+	}{
+		{"greenwich summer solstice", 51.4769, 0, time.Date(2018, 6, 21, 0, 0, 0, 0, london),
+			time.Date(2018, 6, 21, 4, 43, 0, 0, london), time.Date(2018, 6, 21, 21, 21, 0, 0, london)},
+		{"greenwich winter solstice", 51.4769, 0, time.Date(2018, 12, 21, 0, 0, 0, 0, london),
+			time.Date(2018, 12, 21, 8, 4, 0, 0, london), time.Date(2018, 12, 21, 15, 54, 0, 0, london)},
+		{"canberra summer solstice", -35.2809, 149.13, time.Date(2018, 12, 21, 0, 0, 0, 0, canberra),
+			time.Date(2018, 12, 21, 5, 44, 0, 0, canberra), time.Date(2018, 12, 21, 20, 19, 0, 0, canberra)},
+	} {
+		rise, set, err := Crossing(c.date, c.lat, c.lon, Sunrise)
+		if !assert.NoError(t, err, c.name) {
+			continue
+		}
+		assertNear(t, c.rise, rise, c.name+" sunrise")
+		assertNear(t, c.set, set, c.name+" sunset")
+
+		// the sun is at the sunrise elevation at sunrise, allowing for refraction
+		elevation, azimuth := Position(rise, c.lat, c.lon)
+		assert.InDelta(t, -0.27, elevation, 0.2, c.name)
+		assert.True(t, azimuth > 0 && azimuth < 180, "%s: sun rises in the east, azimuth %f", c.name, azimuth)
+		civilDawn, civilDusk, err := Crossing(c.date, c.lat, c.lon, CivilTwilight)
+		assert.NoError(t, err)
+		assert.True(t, civilDawn.Before(rise) && civilDusk.After(set), c.name)
+	}
+}
+
+func TestPolar(t *testing.T) {
+	// tromsø
+	_, _, err := Crossing(time.Date(2018, 6, 21, 0, 0, 0, 0, time.UTC), 69.65, 18.96, Sunrise)
+	assert.Equal(t, ErrAlwaysAbove, err)
+	_, _, err = Crossing(time.Date(2018, 12, 21, 0, 0, 0, 0, time.UTC), 69.65, 18.96, Sunrise)
+	assert.Equal(t, ErrAlwaysBelow, err)
+}
+
+func TestPosition(t *testing.T) {
+	// at noon on the equinox the sun is almost overhead at the equator
+	noon := Noon(time.Date(2018, 3, 20, 0, 0, 0, 0, time.UTC), 0)
+	assert.Equal(t, 12, noon.Hour())
+	elevation, _ := Position(noon, 0, 0)
+	assert.InDelta(t, 90, elevation, 0.5)
+
+	// and due north at noon in the southern hemisphere
+	canberra, _ := time.LoadLocation("Australia/Canberra")
+	noon = Noon(time.Date(2018, 12, 21, 0, 0, 0, 0, canberra), 149.13)
+	assert.Equal(t, 21, noon.In(canberra).Day())
+	elevation, azimuth := Position(noon, -35.2809, 149.13)
+	assert.InDelta(t, 90-35.28+23.44, elevation, 0.5)
+	assert.True(t, azimuth < 1 || azimuth > 359, "azimuth %f", azimuth)
+
+	// and below the horizon at midnight
+	elevation, _ = Position(noon.Add(12*time.Hour), -35.2809, 149.13)
+	assert.True(t, elevation < -30)
+}
@@ -16,32 +16,70 @@ import (
 
 var (
 	errLog                            *log.Logger
+	baseDir                           string
+	preserve, inPlace                 bool
 	interval                          time.Duration
 	rootDir, outputDir, infmt, outfmt string
+	setExif, keepOriginal, writeProv  bool
+	deduper                           *utils.Deduper
+	alignment                         utils.Alignment
+	samplers                          map[string]*utils.Sampler
+	newSampler                        func() *utils.Sampler
+	scoreQuality                      bool
+	cleanupPaths                      []string
+	fillMode                          string
 )
 
-func alignedFilename(img utils.Image) (string, error) {
+func alignTime(t time.Time) time.Time {
+	slot, _ := alignment.Slot(t)
+	return slot
+}
 
-	aligned := img.Timestamp.Truncate(interval)
+// alignedFilename returns the path of an image relative to the output directory with its timestamp in the filename,
+// and in the timestream directories if it is in them, changed to the aligned time.
+// with -preserve the path is kept relative to the base directory, otherwise the image goes at the top of the output.
+func alignedFilename(img utils.Image, aligned time.Time) (string, error) {
+	targetFilename := filepath.Base(img.Path)
+	if preserve {
+		absPath, _ := filepath.Abs(img.Path)
+		rel, err := filepath.Rel(baseDir, absPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("%s isnt under the base directory %s", img.Path, baseDir)
+		}
+		targetFilename = rel
+	}
 
-	targetFilename := strings.Replace(img.Path, img.Timestamp.Format(utils.TsForm), aligned.Format(utils.TsForm), 1)
+	dir, base := filepath.Split(targetFilename)
+	base = strings.Replace(base, img.Timestamp.Format(utils.TsForm), aligned.Format(utils.TsForm), 1)
 	// make sure that if its already formatted as a timestream that we reformat the timestream structure.
-	targetFilename = strings.Replace(targetFilename, img.Timestamp.Format(utils.DefaultTsDirectoryStructure), aligned.Format(utils.DefaultTsDirectoryStructure), 1)
+	dir = strings.Replace(filepath.ToSlash(dir), img.Timestamp.Format(utils.DefaultTsDirectoryStructure), aligned.Format(utils.DefaultTsDirectoryStructure), 1)
 
-	return path.Join(outputDir, targetFilename), nil
+	return filepath.Join(filepath.FromSlash(dir), base), nil
 }
 
-func moveOrRename(img utils.Image, dest string) error {
-	// rename/copy+del if del is true otherwise moveFilebyCopy to not del.
+func moveOrRename(img *utils.Image, dest string) error {
+	// rename in place, or copy to the output
 	var err error
 
+	if setExif {
+		aligned := alignTime(img.Timestamp)
+		if err = utils.CopyWithExif(*img, dest, utils.TimestampEdit(*img, aligned, keepOriginal)); err == nil {
+			img.ExifTimestamp = aligned
+			if inPlace && len(img.Data) == 0 {
+				err = os.Remove(img.Path)
+			}
+			return err
+		}
+		// formats RewriteExif cant handle are still copied
+		errLog.Printf("[setexif] %s, copying %s without rewriting its exif", err, img.Path)
+	}
+
 	if len(img.Data) != 0 {
-		err = utils.WriteImageToFile(img, dest)
+		err = utils.WriteImageToFile(*img, dest)
+	} else if inPlace {
+		err = utils.MoveImage(img, dest)
 	} else {
-		if err = utils.MoveFilebyCopy(img.Path, dest); err != nil {
-			errLog.Printf("[move] %s", err)
-			return nil
-		}
+		err = utils.CopyImage(img, dest)
 	}
 
 	return err
@@ -52,6 +90,10 @@ func visitWalk(filePath string, info os.FileInfo, _ error) error {
 	if info.IsDir() {
 		return nil
 	}
+	// sidecars are moved along with their image
+	if utils.IsSidecar(filePath) {
+		return nil
+	}
 	img, err := utils.LoadImage(filePath)
 	img.OriginalPath = filePath
 	if err != nil {
@@ -61,48 +103,180 @@ func visitWalk(filePath string, info os.FileInfo, _ error) error {
 	return visit(img)
 }
 
+// deferCleanup holds on to temporary directories from upstream tools until buffered images have been written.
+func deferCleanup(tempDir string) error {
+	cleanupPaths = append(cleanupPaths, tempDir)
+	return nil
+}
 
 func visit(image utils.Image) error {
-	// parse the new filepath
+	if image.Timestamp.IsZero() {
+		errLog.Printf("[timestamp] no timestamp for %s", image.Path)
+		return nil
+	}
+	if deduper.Drop(&image) {
+		return nil
+	}
+	if _, ok := alignment.Slot(image.Timestamp); !ok {
+		errLog.Printf("[tolerance] %s is more than %s from its slot", image.Path, alignment.Tolerance)
+		return nil
+	}
+	if scoreQuality && image.Quality == nil {
+		scores, err := utils.ScoreImage(image)
+		if err != nil {
+			errLog.Printf("[quality] %s", err)
+		} else {
+			image.Quality = &scores
+		}
+	}
+	// the best image for each slot is written once the slot is complete
+	streamSampler(image).Add(image)
+	return nil
+}
 
-	newPath, err := alignedFilename(image)
+// streamSampler returns the sampler for the stream of an image, each stream has its own so that streams dont compete
+// for the same slots and one stream arriving after another isnt dropped as late.
+func streamSampler(image utils.Image) *utils.Sampler {
+	if image.Stream == "" {
+		image.ParseName()
+	}
+	stream := image.StreamName()
+	if stream == "" {
+		stream = filepath.Dir(image.Path)
+	}
+	sampler, ok := samplers[stream]
+	if !ok {
+		sampler = newSampler()
+		samplers[stream] = sampler
+	}
+	return sampler
+}
+
+// outputPath returns where the image for a slot is written.
+func outputPath(image utils.Image, slot time.Time) (string, error) {
+	newPath, err := alignedFilename(image, slot)
 	if err != nil {
-		errLog.Printf("[parse] %s", err)
-		return nil
+		return "", err
 	}
+	return filepath.Join(outputDir, newPath), nil
+}
 
-	newPath = filepath.Join(outputDir, filepath.Base(newPath))
+// write copies the chosen image for a slot to its aligned path.
+func write(image utils.Image) {
+	// parse the new filepath
+	newPath, err := outputPath(image, alignTime(image.Timestamp))
+	if err != nil {
+		errLog.Printf("[parse] %s", err)
+		return
+	}
 
 	if _, err := os.Stat(newPath); err == nil {
 		// skip existing.
 		errLog.Printf("[skipped] %s", image.Path)
-		return nil
+		return
 	}
 
 	// make directories
 	err = os.MkdirAll(path.Dir(newPath), 0755)
 	if err != nil {
 		errLog.Printf("[mkdir] %s", err)
-		return nil
+		return
 	}
 
 	absSrc, _ := filepath.Abs(image.Path)
 	absDest, _ := filepath.Abs(newPath)
 	if absSrc == absDest {
 		errLog.Printf("[dupe] %s", absDest)
+		deduper.Keep(image)
 		image.Path = absDest
 		utils.Emit(image, outfmt)
-		return nil
+		return
 	}
 
-	if err := moveOrRename(image, absDest); err != nil {
+	if err := moveOrRename(&image, absDest); err != nil {
 		errLog.Printf("[move] %s", err)
-		return nil
+		return
+	}
+	kept := image
+	if inPlace {
+		// the source is gone, a later run will see the image at its new path
+		kept.Path = absDest
 	}
+	deduper.Keep(kept)
+	var sidecarErr error
+	if inPlace {
+		image.Sidecars, sidecarErr = utils.MoveSidecars(image, absDest)
+	} else {
+		image.Sidecars, sidecarErr = utils.CopySidecars(image, absDest)
+	}
+	if sidecarErr != nil {
+		errLog.Printf("[sidecar] %s", sidecarErr)
+	}
+	utils.TrackProvenance(&image, absSrc, image.Data, absDest, nil, writeProv, outfmt)
 
 	image.Path = absDest
+	image.Timestamp = alignTime(image.Timestamp)
+	utils.Emit(image, outfmt)
+}
+
+// fill writes a frame for a slot without an image, made from the nearest image that was kept.
+func fill(slot time.Time, nearest utils.Image) {
+	newPath, err := outputPath(nearest, slot)
+	if err != nil {
+		errLog.Printf("[parse] %s", err)
+		return
+	}
+	absDest, _ := filepath.Abs(newPath)
+	if _, err := os.Lstat(absDest); err == nil {
+		errLog.Printf("[skipped] %s", absDest)
+		return
+	}
+	absSrc, _ := filepath.Abs(nearest.Path)
+	if written, err := outputPath(nearest, alignTime(nearest.Timestamp)); err == nil {
+		if _, err := os.Stat(written); err == nil {
+			// the nearest image has been written (and with -inplace, moved) already
+			absSrc, _ = filepath.Abs(written)
+		}
+	}
+
+	image := nearest
+	image.Path = absSrc
+	switch fillMode {
+	case utils.FillNearest:
+		if len(image.Data) != 0 {
+			err = utils.WriteImageToFile(image, absDest)
+		} else {
+			err = utils.CopyImage(&image, absDest)
+		}
+	case utils.FillSymlink:
+		// link to where the nearest image is written so the output can be moved as a whole
+		var target string
+		if target, err = outputPath(nearest, alignTime(nearest.Timestamp)); err == nil {
+			target, _ = filepath.Abs(target)
+			if target, err = filepath.Rel(filepath.Dir(absDest), target); err == nil {
+				err = os.Symlink(target, absDest)
+			}
+		}
+	case utils.FillPlaceholder:
+		err = utils.WritePlaceholder(nearest, absDest)
+		image.Data, image.Hash, image.Quality = nil, "", nil
+	}
+	if err != nil {
+		errLog.Printf("[fill] %s", err)
+		return
+	}
+
+	outputData := image.Data
+	if fillMode == utils.FillSymlink && len(outputData) == 0 && (writeProv || outfmt != "path") {
+		// the link can be to an image that hasnt been written yet, it has the same content as the source
+		outputData, _ = ioutil.ReadFile(absSrc)
+	}
+	utils.TrackProvenance(&image, absSrc, nearest.Data, absDest, outputData, writeProv, outfmt)
+	image.Path = absDest
+	image.Timestamp = slot
+	image.Sidecars = nil
+	image.Synthetic = fillMode
 	utils.Emit(image, outfmt)
-	return err
 }
 
 var usage = func() {
@@ -111,23 +285,59 @@ usage of %s:
 flags:
 	-name: renames the prefix fo the target files
 	-output: set the <destination> directory (set to "tmp" to use and output a temporary dir)
+	-preserve: keep the directories of the images under the base directory, rewriting timestream directories (2018/2018_04/...)
+	-base: the directory paths are kept relative to with -preserve (default=<source>)
+	-inplace: rename the images within the base directory instead of copying them to an output (implies -preserve)
+	-prov: write the provenance chain of each output image to <output>.prov.json
 	-outfmt: output format (choices: json,msgpack,path default=path)
 	-infmt: input format (choices: json,msgpack,path default=path)
+	-hash: compute a content hash for each image (choices: sha256,xxhash)
+	-dedupe: drop images byte identical to one already seen (hashes with -hash, default=sha256)
+	-hashindex: file of hashes kept between runs for -dedupe
 	-source: set the <source> directory (optional, default=stdin)
 	-interval: set the interval to align to (optional, default=5m)
+	-mode: which slot to align an image to (choices: floor,nearest,ceil default=floor)
+	  floor is the slot at or before the image, nearest the closest slot and ceil the slot at or after the image
+	-offset: how far after each interval the slots are, ie 2m for a camera that fires at :02, :07... (default=0)
+	-anchor: what the slots are counted from (choices: day,epoch default=day)
+	  day starts the slots again at midnight every day, epoch carries them on across days from the zero time
+	-times: align to these times of day instead of an interval, ie 06:00,12:00,18:00
+	-tolerance: drop images further than this from their slot, ie 1m (default=no limit)
+	-prefer: which image to keep when several align to the same slot (choices: centre,quality,first default=centre)
+	  centre is the closest to the slot time, quality the sharpest with the least clipping, first the earliest
+	-sample-window: how far out of order images can arrive, ie 10m (default=1h)
+	  an image arriving after a slot later than it was written is dropped with a [sample] line, sort the input or raise it
+	-fill: what to write for slots without an image (choices: none,nearest,symlink,placeholder default=none)
+	  nearest is a copy of the nearest image, symlink a link to it and placeholder a black frame saying "missing"
+	-fill-max-gap: leave gaps longer than this unfilled, ie when the camera was off (default=24h, 0 for no limit)
+	-setexif: rewrite the exif DateTime/DateTimeOriginal of the output images to the aligned time
+		(jpeg, tiff and png, other formats are copied as they are)
+	-keeporiginal: keep the original exif datetime in UserComment (with -setexif)
 
 examples:
 	align images in place:
-		%s -source <source> -output <source>
+		%s -source <source> -inplace
 	copy aligned to <destination>
 		%s -source <source> -output=<destination>
-
-will only align down, if an image is at 10:03 (5m interval) it will align to 10:00
-chronologically earlier images will be kept
-ie. at 5m interval, an image at 10:03 will overwrite an image at 10:02
+	copy aligned to <destination>, keeping the timestream directories:
+		%s -source <source> -output=<destination> -preserve
+	exactly one frame every 5 minutes for a timelapse, repeating the nearest image where there isnt one:
+		%s -source <source> -output=<destination> -mode nearest -tolerance 1m -fill nearest
+	keep the image nearest to 6am, midday and 6pm each day, if it is within 30 minutes:
+		%s -source <source> -output=<destination> -times 06:00,12:00,18:00 -mode nearest -tolerance 30m
+
+with the default -mode floor an image at 10:09:59 (5m interval) aligns to 10:05, with -mode nearest to 10:10
+candidates are buffered per slot and only the best one is written, so the input order doesnt decide which image wins
+ie. at 5m interval with -mode nearest, an image at 10:09:59 is kept over one at 10:11:00
+each stream (from the filename, or the directory) is sampled and filled on its own, so streams dont compete for slots
+slots are on the camera wall clock, so an interval that doesnt divide a day (ie 7m) starts again at 00:00 each day
+unless -anchor epoch, and intervals of a day or more are always counted from the zero time
+with -fill the slots between the first and last image without one are filled, marked in json/msgpack by "synthetic"
+without -preserve every image is written to the top of <destination>. with -inplace images that arent chosen for a slot
+are left where they are
 
 `
-	fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0])
+	fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
 func init() {
@@ -140,10 +350,109 @@ func init() {
 	flag.StringVar(&outputDir, "output", "", "output directory")
 	flag.StringVar(&outfmt, "outfmt", "path", "output format")
 	flag.StringVar(&infmt, "infmt", "path", "input format")
+	utils.HashFlags()
+	flag.BoolVar(&setExif, "setexif", false, "rewrite exif datetime to the aligned time")
+	flag.BoolVar(&keepOriginal, "keeporiginal", false, "keep the original exif datetime in UserComment")
+	flag.BoolVar(&writeProv, "prov", false, "write provenance to <output>.prov.json")
+	mode := flag.String("mode", utils.AlignFloor, "slot to align to (floor, nearest, ceil)")
+	tolerance := flag.Duration("tolerance", 0, "furthest an image can be from its slot")
+	prefer := flag.String("prefer", utils.PreferCentre, "which image to keep for a slot")
+	sampleWindow := flag.Duration("sample-window", time.Hour, "how far out of order images can arrive")
+	offset := flag.Duration("offset", 0, "how far after each interval the slots are")
+	anchor := flag.String("anchor", utils.AnchorDay, "what the slots are counted from (day, epoch)")
+	timesString := flag.String("times", "", "comma separated times of day to align to instead of an interval")
+	flag.StringVar(&baseDir, "base", "", "directory paths are kept relative to with -preserve")
+	flag.BoolVar(&preserve, "preserve", false, "keep the directories under the base directory")
+	flag.BoolVar(&inPlace, "inplace", false, "rename the images in place")
+	flag.StringVar(&fillMode, "fill", utils.FillNone, "what to write for slots without an image")
+	fillMaxGap := flag.Duration("fill-max-gap", 24*time.Hour, "longest gap to fill")
 
 	// parse the leading argument with normal flag.Parse
 	flag.Parse()
 
+	var err error
+	if deduper, err = utils.FlagDeduper(); err != nil {
+		errLog.Printf("[dedupe] %s", err)
+		os.Exit(2)
+	}
+
+	if *timesString != "" {
+		times, err := utils.ParseTimesOfDay(*timesString)
+		if err != nil {
+			errLog.Printf("[align] -times %s", err)
+			os.Exit(1)
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "interval" || f.Name == "offset" {
+				errLog.Printf("[align] -%s cant be used with -times", f.Name)
+				os.Exit(1)
+			}
+		})
+		alignment, err = utils.NewTimesAlignment(times, *mode, *tolerance)
+	} else {
+		alignment, err = utils.NewAlignment(interval, *mode, *tolerance)
+	}
+	if err != nil {
+		errLog.Printf("%s", err)
+		os.Exit(1)
+	}
+	switch *anchor {
+	case utils.AnchorDay, utils.AnchorEpoch:
+	default:
+		errLog.Printf("[align] unknown -anchor %q (choices: day,epoch)", *anchor)
+		os.Exit(1)
+	}
+	alignment.Offset = *offset
+	alignment.Anchor = *anchor
+	switch fillMode {
+	case utils.FillNone, utils.FillNearest, utils.FillSymlink, utils.FillPlaceholder:
+	default:
+		errLog.Printf("[fill] unknown -fill %q (choices: none,nearest,symlink,placeholder)", fillMode)
+		os.Exit(1)
+	}
+	samplers = map[string]*utils.Sampler{}
+	newSampler = func() *utils.Sampler {
+		// duplicates are checked again as slots are written, a duplicate can arrive before its original is written
+		sampler := utils.NewAlignedSampler(alignment, deduper.Filter(write))
+		if fillMode != utils.FillNone {
+			filler := &utils.GapFiller{Alignment: alignment, MaxGap: *fillMaxGap, Emit: write, Fill: fill}
+			sampler.Emit = deduper.Filter(filler.Add)
+		}
+		sampler.Prefer = *prefer
+		sampler.Window = *sampleWindow
+		return sampler
+	}
+	switch *prefer {
+	case utils.PreferQuality:
+		scoreQuality = true
+	case utils.PreferCentre, utils.PreferFirst:
+	default:
+		errLog.Printf("[align] unknown -prefer %q", *prefer)
+		os.Exit(1)
+	}
+
+	if baseDir == "" {
+		baseDir = rootDir
+	}
+	if inPlace {
+		preserve = true
+	}
+	if preserve {
+		if baseDir == "" {
+			errLog.Printf("[path] -preserve and -inplace need -base or -source")
+			os.Exit(1)
+		}
+		baseDir, _ = filepath.Abs(baseDir)
+	}
+	if inPlace {
+		absOutput, _ := filepath.Abs(outputDir)
+		if outputDir != "" && absOutput != baseDir {
+			errLog.Printf("[path] -inplace renames within %s, it cant be used with another -output", baseDir)
+			os.Exit(1)
+		}
+		outputDir = baseDir
+	}
+
 	if rootDir != "" {
 		if _, err := os.Stat(rootDir); err != nil {
 			if os.IsNotExist(err) {
@@ -166,7 +475,24 @@ func main() {
 	}
 
 	os.MkdirAll(outputDir, 0755)
-	if rootDir != "" {
+	if rootDir != "" && inPlace {
+		// list the files first, so images renamed further along the walk arent visited again
+		var files []string
+		err := filepath.Walk(rootDir, func(filePath string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files = append(files, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			errLog.Printf("[walk] %s", err)
+		}
+		for _, filePath := range files {
+			if info, err := os.Stat(filePath); err == nil {
+				visitWalk(filePath, info, nil)
+			}
+		}
+	} else if rootDir != "" {
 		if err := filepath.Walk(rootDir, visitWalk); err != nil {
 			errLog.Printf("[walk] %s", err)
 		}
@@ -181,7 +507,7 @@ func main() {
 					continue
 				} else if strings.HasPrefix(text, "#-") {
 					// was signalled deletion of previous tmpdir, wait until finished
-					defer os.RemoveAll(strings.TrimPrefix(text, "#-"))
+					deferCleanup(strings.TrimPrefix(text, "#-"))
 				} else {
 					img, err := utils.LoadImage(text)
 					if err != nil {
@@ -189,17 +515,6 @@ func main() {
 					}
 					visit(img)
 				}
-				data := strings.Replace(scanner.Text(), "\n", "", -1)
-				if strings.HasPrefix(data, "[") {
-					errLog.Printf("[stdin] %s", data)
-					continue
-				} else {
-					img, err := utils.LoadImage(data)
-					if err != nil {
-						errLog.Printf("[load] %s", err)
-					}
-					visit(img)
-				}
 			}
 
 		} else {
@@ -220,7 +535,15 @@ func main() {
 			//}
 			//continue
 
-			utils.Handle(visit, os.RemoveAll, infmt)
+			utils.Handle(visit, deferCleanup, infmt)
 		}
 	}
+
+	// write the slots still buffered before temporary files are cleaned up
+	for _, sampler := range samplers {
+		sampler.Flush()
+	}
+	for _, tempDir := range cleanupPaths {
+		os.RemoveAll(tempDir)
+	}
 }
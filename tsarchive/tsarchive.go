@@ -21,8 +21,8 @@ import (
 var (
 	errLog                          *log.Logger
 	rootDir, outputDir, archiveName string
-	weeklyFileWriters               map[time.Time]*os.File
-	weeklyTarWriters                map[time.Time]*tar.Writer
+	weeklyFileWriters               map[string]*os.File
+	weeklyTarWriters                map[string]*tar.Writer
 	thisSunday, lastSunday          time.Time
 	del                             bool
 	mutex                           *sync.Mutex
@@ -59,23 +59,14 @@ func addFile(tw *tar.Writer, thePath string) error {
 }
 
 func getPartNameFromFilepath(thisFile string, sunday time.Time) string {
-	name := archiveName
-	if archiveName != "" {
-		timestamp := utils.TsRegex.FindString(thisFile)
-		baseFile := path.Base(thisFile)
-		ext := path.Ext(baseFile)
-		filename := strings.TrimSuffix(baseFile, ext)
-		name = strings.Replace(filename,"_"+timestamp, "", 1)
-	}
-	datedArchive := sunday.Format(utils.ArchiveForm)
-	return fmt.Sprintf(datedArchive, name)+".part"
+	return utils.ArchiveName(thisFile, archiveName, sunday) + ".part"
 }
 
 func truncateTimeToSunday(t time.Time) (sunday time.Time) {
 	return t.Truncate(time.Hour * 24 * 7)
 }
 
-func createNewTar(tarPath string, sunday time.Time){
+func createNewTar(tarPath, partName string) {
 	var file *os.File
 	if _, err := os.Stat(tarPath); os.IsNotExist(err) {
 		file, err = os.Create(tarPath)
@@ -95,29 +86,29 @@ func createNewTar(tarPath string, sunday time.Time){
 			panic(err)
 		}
 	}
-	weeklyFileWriters[sunday] = file
-	weeklyTarWriters[sunday] = tar.NewWriter(file)
-	errLog.Printf("[tar] opened %s tar writer", sunday.Format("2006-01-02"))
+	weeklyFileWriters[partName] = file
+	weeklyTarWriters[partName] = tar.NewWriter(file)
+	errLog.Printf("[tar] opened %s tar writer", partName)
 }
 
-func checkInTar(basePath, tarFileName string, sunday time.Time) bool {
+func checkInTar(basePath, tarFileName string) bool {
 	mutex.Lock()
 	defer mutex.Unlock()
-	seekpos,_ := weeklyFileWriters[sunday].Seek(0, io.SeekCurrent)
+	seekpos, _ := weeklyFileWriters[tarFileName].Seek(0, io.SeekCurrent)
 
-	if _, err := weeklyFileWriters[sunday].Seek(0, io.SeekStart); err != nil {
+	if _, err := weeklyFileWriters[tarFileName].Seek(0, io.SeekStart); err != nil {
 		errLog.Println(err)
 		panic(err)
 	}
 
 	defer func() {
-		if _, err := weeklyFileWriters[sunday].Seek(seekpos, io.SeekStart); err != nil {
+		if _, err := weeklyFileWriters[tarFileName].Seek(seekpos, io.SeekStart); err != nil {
 			errLog.Println(err)
 			panic(err)
 		}
 	}()
 
-	reader := tar.NewReader(weeklyFileWriters[sunday])
+	reader := tar.NewReader(weeklyFileWriters[tarFileName])
 	for {
 		header, err := reader.Next()
 		if err == io.EOF {
@@ -142,7 +133,7 @@ func checkInTar(basePath, tarFileName string, sunday time.Time) bool {
 			errLog.Println(fmt.Errorf("couldn't determine header Typeflag %s for %s in tar file %s",
 				string(header.Typeflag),
 				header.Name,
-					tarFileName))
+				tarFileName))
 		}
 	}
 
@@ -156,7 +147,6 @@ func visit(filePath string, info os.FileInfo, _ error) error {
 		return nil
 	}
 
-
 	ext := path.Ext(filePath)
 	switch extlower := strings.ToLower(ext); extlower {
 	case ".jpeg", ".jpg", ".tif", ".tiff", ".cr2":
@@ -179,21 +169,37 @@ func visit(filePath string, info os.FileInfo, _ error) error {
 	tarbaseName := getPartNameFromFilepath(filePath, sunday.Add(time.Hour*24*6))
 	tarPath := path.Join(outputDir, tarbaseName)
 
-
-	if _, ok := weeklyTarWriters[sunday]; !ok {
-		createNewTar(tarPath, sunday)
+	// each stream and variant has its own tar for the week
+	if _, ok := weeklyTarWriters[tarbaseName]; !ok {
+		createNewTar(tarPath, tarbaseName)
 	} else {
-		inTar := checkInTar(basePath, tarbaseName, sunday)
-		if inTar{
+		inTar := checkInTar(basePath, tarbaseName)
+		if inTar {
 			return nil
 		}
 	}
 
-	if err := addFile(weeklyTarWriters[sunday], filePath); err != nil {
+	if err := addFile(weeklyTarWriters[tarbaseName], filePath); err != nil {
 		errLog.Println(err)
 		return nil
 	}
 
+	// sidecars go into the same tar as their image so they dont get orphaned
+	for _, sidecar := range utils.FindSidecars(filePath) {
+		if checkInTar(filepath.Base(sidecar), tarbaseName) {
+			continue
+		}
+		if err := addFile(weeklyTarWriters[tarbaseName], sidecar); err != nil {
+			errLog.Println(err)
+			continue
+		}
+		if del {
+			if err := os.Remove(sidecar); err != nil {
+				errLog.Println(err)
+			}
+		}
+	}
+
 	if del {
 		err := os.Remove(filePath)
 		if err != nil {
@@ -220,9 +226,10 @@ var usage = func() {
 	fmt.Println()
 	fmt.Println("\t-output: set the <destination> directory (default=.)")
 	fmt.Println("\t-source: set the <source> directory (optional, default=stdin)")
-	fmt.Println("\t-del: delete the source files as they are archived.")
-	fmt.Println("\t-name: set the name prefix of the output tarfile <name>~2006-01-02.tar (default=guess)")
+	fmt.Println("\t-del: delete the source files (and their sidecars) as they are archived.")
+	fmt.Println("\t-name: set the name prefix of the output tarfile <name>~2006-01-02.tar (default=the stream and variant in the filename)")
 	fmt.Println()
+	fmt.Println("sidecars (.thm, .xmp, .json) are archived alongside their image")
 	fmt.Println("reads filepaths from stdin")
 	fmt.Println("writes paths to resulting files to stdout")
 	fmt.Println("will ignore any line from stdin that isnt a filepath (and only a filepath)")
@@ -261,20 +268,20 @@ func init() {
 
 func main() {
 	mutex = &sync.Mutex{}
-	weeklyTarWriters = make(map[time.Time]*tar.Writer)
-	weeklyFileWriters = make(map[time.Time]*os.File)
+	weeklyTarWriters = make(map[string]*tar.Writer)
+	weeklyFileWriters = make(map[string]*os.File)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigs
 		mutex.Lock()
-		for sunday, writer := range weeklyTarWriters {
-			errLog.Printf("[tar] closing %s tar writer", sunday.Format("2006-01-02"))
+		for name, writer := range weeklyTarWriters {
+			errLog.Printf("[tar] closing %s tar writer", name)
 			writer.Close()
 		}
-		for sunday, writer := range weeklyFileWriters {
-			errLog.Printf("[tar] closing %s file writer", sunday.Format("2006-01-02"))
+		for name, writer := range weeklyFileWriters {
+			errLog.Printf("[tar] closing %s file writer", name)
 			partName := writer.Name()
 			writer.Close()
 			os.Rename(partName, strings.TrimSuffix(partName, ".part"))
@@ -299,7 +306,7 @@ func main() {
 			} else if strings.HasPrefix(text, "#-") {
 				// was signalled deletion of previous tmpdir, wait until finished
 				defer os.RemoveAll(strings.TrimPrefix(text, "#-"))
-			}  else {
+			} else {
 				finfo, err := os.Stat(text)
 				if err != nil {
 					errLog.Printf("[stat] %s", text)
@@ -310,12 +317,12 @@ func main() {
 		}
 	}
 	mutex.Lock()
-	for sunday, writer := range weeklyTarWriters {
-		errLog.Printf("[tar] closing %s tar writer", sunday.Format("2006-01-02"))
+	for name, writer := range weeklyTarWriters {
+		errLog.Printf("[tar] closing %s tar writer", name)
 		writer.Close()
 	}
-	for sunday, writer := range weeklyFileWriters {
-		errLog.Printf("[tar] closing %s file writer", sunday.Format("2006-01-02"))
+	for name, writer := range weeklyFileWriters {
+		errLog.Printf("[tar] closing %s file writer", name)
 		partName := writer.Name()
 		writer.Close()
 		os.Rename(partName, strings.TrimSuffix(partName, ".part"))
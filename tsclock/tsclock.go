@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/borevitzlab/go-timestreamtools/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	errLog                 *log.Logger
+	rootDir, outfmt, infmt string
+	modelPath, eventsPath  string
+	fitModel               bool
+	fitter                 utils.ClockFitter
+	model                  *utils.ClockModel
+	location               *time.Location
+	latency                time.Duration
+	buffered               []utils.Image
+	cleanupPaths           []string
+)
+
+// reference returns the time the reference clock gave an image, or the zero time if there isnt one.
+func reference(img utils.Image) time.Time {
+	switch fitter.Reference {
+	case utils.ReferenceExif:
+		return img.ExifTimestamp
+	case utils.ReferenceMtime:
+		if len(img.Data) != 0 {
+			// the file was written by a tool upstream, so its mtime isnt the upload
+			return time.Time{}
+		}
+		finfo, err := os.Stat(img.Path)
+		if err != nil {
+			return time.Time{}
+		}
+		// the upload time as wall clock time at the camera, like the timestamps
+		t := finfo.ModTime().Add(-latency).In(location)
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	}
+	return time.Time{}
+}
+
+// correct applies the model to an image and emits it, keeping the camera time in the metadata.
+func correct(img utils.Image) {
+	corrected := model.Correct(img.Timestamp, reference(img))
+	if !corrected.Equal(img.Timestamp) {
+		metadata := map[string]string{}
+		for k, v := range img.Metadata {
+			metadata[k] = v
+		}
+		metadata["CameraTimestamp"] = img.Timestamp.Format(time.RFC3339)
+		img.Metadata = metadata
+		img.Timestamp = corrected
+	}
+	utils.TrackProvenance(&img, img.Path, img.Data, "", nil, false, outfmt)
+	utils.Emit(img, outfmt)
+}
+
+func visitWalk(filePath string, info os.FileInfo, _ error) error {
+	// skip directories
+	if info.IsDir() {
+		return nil
+	}
+	// sidecars follow their image through the pipeline
+	if utils.IsSidecar(filePath) {
+		return nil
+	}
+	image, err := utils.LoadImage(filePath)
+	image.OriginalPath = filePath
+	if err != nil {
+		errLog.Printf("[load] %s", err)
+	}
+	return visit(image)
+}
+
+func visit(img utils.Image) error {
+	if img.Timestamp.IsZero() {
+		errLog.Printf("[timestamp] no timestamp for %s", img.Path)
+		return nil
+	}
+	if !fitModel {
+		correct(img)
+		return nil
+	}
+	// the model needs every sample before anything can be corrected
+	if fitter.Reference != utils.ReferenceEvents {
+		if ref := reference(img); !ref.IsZero() {
+			fitter.Add(utils.ClockSample{Camera: img.Timestamp, Reference: ref})
+		}
+	}
+	buffered = append(buffered, img)
+	return nil
+}
+
+// deferCleanup holds on to temporary directories from upstream tools until buffered images have been emitted.
+func deferCleanup(tempDir string) error {
+	cleanupPaths = append(cleanupPaths, tempDir)
+	return nil
+}
+
+var usage = func() {
+	use := `
+usage of %s:
+
+	fit a model of the camera clock against the upload times, save it and correct the images:
+		%s -source <source> -fit -model clock.json
+	correct the images in a pipeline with a model that was reviewed:
+		tsselect -source <source> -start 2018-04-01 | %s -model clock.json | tsrename -infmt json -name <name> -output <destination>
+	fit to known events, ie the images the chamber lights came on in:
+		%s -source <source> -fit -reference events -events lights.txt -model clock.json
+
+flags:
+	-model: the clock model file, written with -fit and read otherwise (required)
+	-fit: fit the model to this stream (or -events) and write it before correcting
+	-reference: the clock to correct the timestamps to (choices: mtime,exif,events default=mtime)
+	  mtime is when the file was uploaded, exif the DateTime the camera wrote, events a file of known events
+	-events: file of known events, one "<camera time> <reference time>" per line with # comments
+	-latency: the usual delay between taking and uploading an image, taken off the mtime reference (default=0)
+	-tz: time zone of the camera wall clock, to compare with file modification times (default=Local)
+	-step: how far the offset has to move to be a clock step rather than noise (default=5m)
+	-drift: fit a linear drift as well as an offset to each segment (default=true)
+	-min-drift-span: the shortest segment to fit a drift to (default=24h)
+	-source: set the <source> directory (optional, default=stdin)
+	-outfmt: output format (choices: json,msgpack,path default=json)
+	-infmt: input format (choices: json,msgpack,path default=path)
+
+the model is json with one segment per run of images between clock steps, each with its camera time range,
+offset, drift and number of samples, so corrections can be reviewed and rerun the same way.
+images whose camera time falls in more than one segment (the clock was stepped back) use the one closest to the reference.
+the corrected timestamp is only carried by json and msgpack output, the camera time is kept in meta.CameraTimestamp.
+`
+	fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+}
+
+func init() {
+	errLog = log.New(os.Stderr, "[tsclock] ", log.Ldate|log.Ltime|log.Lshortfile)
+	flag.Usage = usage
+	// set flags for flagset
+	flag.StringVar(&rootDir, "source", "", "source directory")
+	flag.StringVar(&outfmt, "outfmt", "json", "output format")
+	flag.StringVar(&infmt, "infmt", "path", "input format")
+	flag.StringVar(&modelPath, "model", "", "clock model file")
+	flag.BoolVar(&fitModel, "fit", false, "fit the model and write it")
+	flag.StringVar(&fitter.Reference, "reference", utils.ReferenceMtime, "reference clock")
+	flag.StringVar(&eventsPath, "events", "", "file of known events")
+	flag.DurationVar(&latency, "latency", 0, "upload delay")
+	tzString := flag.String("tz", "Local", "time zone of the camera")
+	flag.DurationVar(&fitter.Step, "step", 5*time.Minute, "smallest clock step")
+	flag.BoolVar(&fitter.Drift, "drift", true, "fit a drift")
+	flag.DurationVar(&fitter.MinDriftSpan, "min-drift-span", 24*time.Hour, "shortest segment to fit a drift to")
+	// parse the leading argument with normal flag.Parse
+	flag.Parse()
+
+	if modelPath == "" {
+		errLog.Printf("[model] -model is required")
+		os.Exit(1)
+	}
+	switch fitter.Reference {
+	case utils.ReferenceMtime, utils.ReferenceExif, utils.ReferenceEvents:
+	default:
+		errLog.Printf("[reference] unknown -reference %q (choices: mtime,exif,events)", fitter.Reference)
+		os.Exit(1)
+	}
+	var err error
+	if location, err = time.LoadLocation(*tzString); err != nil {
+		errLog.Printf("[time] -tz %s", err)
+		os.Exit(1)
+	}
+
+	if fitModel && fitter.Reference == utils.ReferenceEvents {
+		if eventsPath == "" {
+			errLog.Printf("[events] -reference events needs -events")
+			os.Exit(1)
+		}
+		samples, err := utils.LoadClockEvents(eventsPath)
+		if err != nil {
+			errLog.Printf("[events] %s", err)
+			os.Exit(1)
+		}
+		for _, s := range samples {
+			fitter.Add(s)
+		}
+	}
+	if !fitModel {
+		if model, err = utils.LoadClockModel(modelPath); err != nil {
+			errLog.Printf("[model] %s", err)
+			os.Exit(1)
+		}
+	}
+	if outfmt == "path" {
+		errLog.Printf("[outfmt] corrected timestamps are only carried by json and msgpack, paths will be emitted unchanged")
+	}
+
+	// verify that root exists
+	if rootDir != "" {
+		if _, err := os.Stat(rootDir); err != nil {
+			if os.IsNotExist(err) {
+				errLog.Printf("[path] <source> %s does not exist.", rootDir)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+func main() {
+	if rootDir != "" {
+		if err := filepath.Walk(rootDir, visitWalk); err != nil {
+			errLog.Printf("[walk] %s", err)
+		}
+	} else if infmt == "path" {
+		// start scanner and wait for stdin
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			text := strings.Replace(scanner.Text(), "\n", "", -1)
+			if strings.HasPrefix(text, "[") {
+				errLog.Printf("[stdin] %s", text)
+				continue
+			} else if strings.HasPrefix(text, "#-") {
+				// was signalled deletion of previous tmpdir, wait until finished
+				deferCleanup(strings.TrimPrefix(text, "#-"))
+			} else {
+				img, err := utils.LoadImage(text)
+				if err != nil {
+					errLog.Printf("[load] %s", err)
+				}
+				visit(img)
+			}
+		}
+	} else {
+		utils.Handle(visit, deferCleanup, infmt)
+	}
+
+	if fitModel {
+		var err error
+		if model, err = fitter.Fit(); err != nil {
+			errLog.Printf("%s", err)
+			os.Exit(1)
+		}
+		if err := utils.SaveClockModel(model, modelPath); err != nil {
+			errLog.Printf("[model] %s", err)
+			os.Exit(1)
+		}
+		for _, seg := range model.Segments {
+			errLog.Printf("[model] %s to %s: offset %.0fs, drift %.2fs/day from %d samples", seg.Start.Format(time.RFC3339),
+				seg.End.Format(time.RFC3339), seg.OffsetSeconds, seg.DriftSecondsPerDay, seg.Samples)
+		}
+		for _, img := range buffered {
+			correct(img)
+		}
+	}
+	for _, tempDir := range cleanupPaths {
+		os.RemoveAll(tempDir)
+	}
+}
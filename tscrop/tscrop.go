@@ -27,7 +27,7 @@ var (
 	rootDir, outputDir, outfmt, infmt, targetExtension string
 	corner1, corner2, gridxy, chunkSize                image.Point
 	imageEncoder                                       imgio.Encoder
-	center                                             bool
+	center, strip, writeProv                           bool
 )
 
 // TIFFEncoder returns an encoder to the Tagged Image Format
@@ -51,19 +51,10 @@ func minMax(a, b int) (min, max int) {
 func cropImage(sourceImg utils.Image, destPath string) (err error) {
 
 	if len(sourceImg.Data) == 0 {
-		file, err := os.Open(sourceImg.Path)
-		if err != nil {
-			return
-		}
 		// read the image bytes into the img.Data
-		buf1 := new(bytes.Buffer)
-		_, err = buf1.ReadFrom(file)
-		if err != nil {
+		if sourceImg.Data, err = ioutil.ReadFile(sourceImg.Path); err != nil {
 			return
 		}
-
-		sourceImg.Data = buf1.Bytes()
-		buf1.Reset()
 	}
 
 	imgReader := bytes.NewReader(sourceImg.Data)
@@ -116,17 +107,40 @@ func cropImage(sourceImg utils.Image, destPath string) (err error) {
 				}
 
 				imgWriter.Flush()
+				encoded := buf2.Bytes()
+
+				if !strip {
+					// carry over the exif and xmp from the source image, image.Decode drops it.
+					edit := utils.ExifEdit{
+						Width:   cropped.Bounds().Dx(),
+						Height:  cropped.Bounds().Dy(),
+						History: strings.Join(os.Args, " "),
+					}
+					var metaErr error
+					if encoded, metaErr = utils.CopyMetadata(sourceImg, encoded, edit); metaErr != nil {
+						errLog.Printf("[exif] %s", metaErr)
+					}
+				}
 
 				// read the image bytes into the img.Data
 
 				destPos := fmt.Sprintf("%d,%d", xPos, yPos)
 				destPath := fmt.Sprintf(destPath, destPos)
+				// the grid position goes with the crop, for tsrename -template {{.Grid}}
+				metadata := map[string]string{}
+				for k, v := range sourceImg.Metadata {
+					metadata[k] = v
+				}
+				metadata["GridPosition"] = destPos
 				cImg := utils.Image{
+					Path:          destPath,
 					OriginalPath:  sourceImg.OriginalPath,
-					Data:          buf2.Bytes(),
+					Data:          encoded,
 					Timestamp:     sourceImg.Timestamp,
 					ExifTimestamp: sourceImg.ExifTimestamp,
 					CmdList:       append(sourceImg.CmdList, strings.Join(os.Args, " ")),
+					Provenance:    sourceImg.Provenance,
+					Metadata:      metadata,
 				}
 				buf2.Reset()
 
@@ -136,6 +150,8 @@ func cropImage(sourceImg utils.Image, destPath string) (err error) {
 					return
 				}
 
+				utils.TrackProvenance(&cImg, sourceImg.Path, sourceImg.Data, destPath, encoded, writeProv, outfmt)
+
 				// output the relative image path
 				utils.Emit(cImg, outfmt)
 
@@ -147,8 +163,6 @@ func cropImage(sourceImg utils.Image, destPath string) (err error) {
 	return
 }
 
-
-
 func visitWalk(filePath string, info os.FileInfo, _ error) error {
 	// skip directories
 	if info.IsDir() {
@@ -197,6 +211,8 @@ flags:
 	-c2: corner 2 (in pixels, comma separated, ignored if center is specified)
 	-grid: split the area into this many equal crops (default=1,1)
 	-type: set the output image type (default=jpeg)
+	-strip: dont copy exif and xmp metadata into the output images
+	-prov: write the provenance chain of each output image to <output>.prov.json
 	-output: set the <destination> directory (default=<cwd>/<crop>)
 
 available image types:
@@ -243,6 +259,8 @@ func init() {
 	flag.StringVar(&outfmt, "outfmt", "path", "output format")
 	flag.StringVar(&infmt, "infmt", "path", "input format")
 	flag.BoolVar(&center, "center", false, "center crop")
+	flag.BoolVar(&strip, "strip", false, "strip metadata")
+	flag.BoolVar(&writeProv, "prov", false, "write provenance to <output>.prov.json")
 	outputType := flag.String("type", "jpeg", "output image type")
 	c1 := flag.String("c1", "0,0", "corner 1")
 	c2 := flag.String("c2", "0,0", "corner 2, (ignored when center")
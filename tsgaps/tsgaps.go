@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/borevitzlab/go-timestreamtools/utils"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	errLog                 *log.Logger
+	rootDir, outfmt, infmt string
+	outputPath, csvPath    string
+	windows                utils.TimeOfDayWindows
+	analyzer               utils.GapAnalyzer
+)
+
+func visitWalk(filePath string, info os.FileInfo, _ error) error {
+	// skip directories
+	if info.IsDir() {
+		return nil
+	}
+	if utils.IsSidecar(filePath) {
+		return nil
+	}
+	image, err := utils.LoadImage(filePath)
+	if err != nil {
+		errLog.Printf("[load] %s", err)
+	}
+	return visit(image)
+}
+
+func visit(img utils.Image) error {
+	if img.Timestamp.IsZero() {
+		errLog.Printf("[timestamp] no timestamp for %s", img.Path)
+		return nil
+	}
+	analyzer.Add(img.Timestamp)
+	return nil
+}
+
+// writeReport writes the report to w in the output format.
+func writeReport(report *utils.GapReport, w io.Writer) error {
+	switch outfmt {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "csv":
+		return report.WriteCSV(w)
+	}
+	return report.WriteTable(w)
+}
+
+var usage = func() {
+	use := `
+usage of %s:
+
+	report the gaps in a stream, inferring the interval:
+		%s -source <source>
+	report the cadence of the last week of a camera taking a photo every 5 minutes from 6am to 6pm as csv:
+		%s -source <source> -interval 5m -window 06:00-18:00 -start -7d -outfmt csv -output gaps.csv
+	after other tools in a pipeline:
+		tsselect -source <source> -start 2018-04-01 -end 2018-05-01 | %s -csv april.csv
+
+flags:
+	-source: set the <source> directory (optional, default=stdin)
+	-infmt: input format (choices: json,msgpack,path default=path)
+	-outfmt: report format (choices: table,json,csv default=table)
+	-output: file to write the report to (default=stdout)
+	-csv: also write the per day csv to this file
+	-interval: the interval images are expected at, ie 5m (default=the median step between images)
+	-tolerance: how far an image can be from the cadence and still be on it (default=a tenth of the interval)
+	-max-gap: gaps longer than this are reported as clock jumps instead of missing images, ie 720h (default=168h, 0 for no limit)
+	-window: a time of day images are expected, ie 06:00-18:00, can be given more than once (default=all day)
+	-start: count the slots missing from this datetime to the first image (same forms as tsselect, ie -7d or 2018-04-01)
+	-end: count the slots missing from the last image up to this datetime (ie now)
+	-now: the time relative datetimes are relative to (default=the current wall clock time)
+
+images are analysed in the order they arrive (filename order for -source) so a clock that steps backwards shows as a jump.
+an image off the cadence that the following images keep to is a clock jump, one they dont is irregular.
+an image within the tolerance of the previous one is a duplicate.
+
+per day the report has the images, the expected slots, the missing slots, duplicates, irregular images, clock jumps,
+the coverage (the fraction of expected slots with an image) and the first and last image.
+`
+	fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+}
+
+func init() {
+	errLog = log.New(os.Stderr, "[tsgaps] ", log.Ldate|log.Ltime|log.Lshortfile)
+	flag.Usage = usage
+	// set flags for flagset
+	flag.StringVar(&rootDir, "source", "", "source directory")
+	flag.StringVar(&infmt, "infmt", "path", "input format")
+	flag.StringVar(&outfmt, "outfmt", "table", "report format")
+	flag.StringVar(&outputPath, "output", "", "file to write the report to")
+	flag.StringVar(&csvPath, "csv", "", "file to also write the per day csv to")
+	flag.DurationVar(&analyzer.Interval, "interval", 0, "expected interval")
+	flag.DurationVar(&analyzer.Tolerance, "tolerance", 0, "tolerance of the cadence")
+	flag.DurationVar(&analyzer.MaxGap, "max-gap", 7*24*time.Hour, "longest gap before it is a clock jump")
+	flag.Var(&windows, "window", "time of day window images are expected in")
+	startString := flag.String("start", "", "start datetime")
+	endString := flag.String("end", "", "end datetime")
+	nowString := flag.String("now", "", "the time relative start and end times are relative to")
+	// parse the leading argument with normal flag.Parse
+	flag.Parse()
+
+	switch outfmt {
+	case "table", "json", "csv":
+	default:
+		errLog.Printf("[format] unknown -outfmt %q (choices: table,json,csv)", outfmt)
+		os.Exit(1)
+	}
+
+	now := utils.WallClockNow()
+	var err error
+	if *nowString != "" {
+		if now, err = utils.ParseAbsoluteTime(*nowString); err != nil {
+			errLog.Printf("[time] -now %s", err)
+			os.Exit(1)
+		}
+	}
+	if *startString != "" {
+		if analyzer.Start, err = utils.ParseTimeExpression(*startString, now); err != nil {
+			errLog.Printf("[time] -start %s", err)
+			os.Exit(1)
+		}
+	}
+	if *endString != "" {
+		if analyzer.End, err = utils.ParseTimeExpression(*endString, now); err != nil {
+			errLog.Printf("[time] -end %s", err)
+			os.Exit(1)
+		}
+	}
+	analyzer.Windows = windows
+
+	// verify that root exists
+	if rootDir != "" {
+		if _, err := os.Stat(rootDir); err != nil {
+			if os.IsNotExist(err) {
+				errLog.Printf("[path] <source> %s does not exist.", rootDir)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+func main() {
+	if rootDir != "" {
+		if err := filepath.Walk(rootDir, visitWalk); err != nil {
+			errLog.Printf("[walk] %s", err)
+		}
+	} else if infmt == "path" {
+		// start scanner and wait for stdin
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			} else if strings.HasPrefix(text, "#-") {
+				// only the timestamps are kept, so temporary directories can go straight away
+				os.RemoveAll(strings.TrimPrefix(text, "#-"))
+				continue
+			} else if strings.HasPrefix(text, "[") {
+				errLog.Printf("[stdin] %s", text)
+				continue
+			}
+			img, err := utils.LoadImage(text)
+			if err != nil {
+				errLog.Printf("[load] %s", err)
+			}
+			visit(img)
+		}
+	} else {
+		utils.Handle(visit, os.RemoveAll, infmt)
+	}
+
+	report, err := analyzer.Report()
+	if err != nil {
+		errLog.Printf("%s", err)
+		os.Exit(1)
+	}
+
+	var out io.Writer = os.Stdout
+	if outputPath != "" {
+		file, err := os.Create(outputPath)
+		if err != nil {
+			errLog.Printf("[output] %s", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		out = file
+	}
+	if err := writeReport(report, out); err != nil {
+		errLog.Printf("[output] %s", err)
+	}
+	if csvPath != "" {
+		file, err := os.Create(csvPath)
+		if err != nil {
+			errLog.Printf("[csv] %s", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		if err := report.WriteCSV(file); err != nil {
+			errLog.Printf("[csv] %s", err)
+		}
+	}
+}
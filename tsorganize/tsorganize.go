@@ -14,32 +14,141 @@ import (
 )
 
 var (
-	errLog                          *log.Logger
+	errLog                                         *log.Logger
 	rootDir, outputDir, infmt, outfmt, tsDirStruct string
+	writeProv                                      bool
+	deduper                                        *utils.Deduper
+	layoutName, fromLayoutName                     string
+	layout, fromLayout                             utils.Layout
+	migrate, preview                               bool
+	indexFormat                                    string
+	indexer, srcIndexer                            *utils.Indexer
 )
 
-
 func parseFilename(image utils.Image) (string, error) {
+	return layout.Path(outputDir, image), nil
+}
 
-	formattedSubdirs := image.Timestamp.Format(tsDirStruct)
-	targetFilename := path.Base(image.Path)
+// migrateTree moves every image under rootDir from where fromLayout puts it to where layout puts it under outputDir,
+// verifying each move, and returns how many failed.
+func migrateTree() (failed int) {
+	// list the files first, so images moved further along the walk arent visited again
+	var files []string
+	err := filepath.Walk(rootDir, func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !utils.IsSidecar(filePath) && !strings.HasPrefix(info.Name(), ".") {
+			files = append(files, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		errLog.Printf("[walk] %s", err)
+	}
 
-	newT := path.Join(outputDir, formattedSubdirs, targetFilename)
+	var moved, there, skipped int
+	for _, filePath := range files {
+		image, err := utils.LoadImage(filePath)
+		if err != nil {
+			errLog.Printf("[load] %s", err)
+		}
+		if image.Timestamp.IsZero() {
+			errLog.Printf("[migrate] %s has no timestamp, skipping", filePath)
+			skipped++
+			continue
+		}
+		expected := fromLayout.Path(rootDir, image)
+		if image.Path != expected {
+			errLog.Printf("[migrate] %s isnt where the %s layout puts it (%s), skipping", filePath, fromLayout, expected)
+			skipped++
+			continue
+		}
+		dest := layout.Path(outputDir, image)
+		if dest == expected {
+			if err := indexer.Add(image); err != nil {
+				errLog.Printf("[index] %s", err)
+			}
+			there++
+			continue
+		}
+		if preview {
+			fmt.Printf("%s -> %s\n", filePath, dest)
+			moved++
+			continue
+		}
+		if err := utils.MoveVerified(filePath, dest, utils.HashAlgorithm); err != nil {
+			errLog.Printf("[migrate] %s", err)
+			failed++
+			continue
+		}
+		if image.Sidecars, err = utils.MoveSidecars(image, dest); err != nil {
+			errLog.Printf("[sidecar] %s", err)
+		}
+		moved++
+		if err := srcIndexer.Remove(filePath); err != nil {
+			errLog.Printf("[index] %s", err)
+		}
+		image.Path = dest
+		if err := indexer.Add(image); err != nil {
+			errLog.Printf("[index] %s", err)
+		}
+		utils.Emit(image, outfmt)
+	}
+	// the indices of emptied directories are written before they are removed
+	flushIndices()
+	if !preview {
+		removeEmptyDirs(rootDir)
+	}
+	errLog.Printf("[migrate] %d moved, %d already there, %d skipped, %d failed", moved, there, skipped, failed)
+	return
+}
 
-	return newT, nil
+// flushIndices writes the changes to the indices still held in memory.
+func flushIndices() {
+	for _, ix := range []*utils.Indexer{indexer, srcIndexer} {
+		if err := ix.Flush(); err != nil {
+			errLog.Printf("[index] %s", err)
+		}
+	}
+}
+
+// removeEmptyDirs removes the directories under root left empty by a migration, deepest first.
+// directories with nothing but an index in them are empty.
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && filePath != root {
+			dirs = append(dirs, filePath)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := ioutil.ReadDir(dirs[i])
+		if err != nil {
+			continue
+		}
+		empty := true
+		for _, entry := range entries {
+			if entry.IsDir() || !utils.IsIndex(entry.Name()) {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			for _, entry := range entries {
+				os.Remove(filepath.Join(dirs[i], entry.Name()))
+			}
+			os.Remove(dirs[i])
+		}
+	}
 }
 
-func moveOrRename(img utils.Image, dest string) error {
+func moveOrRename(img *utils.Image, dest string) error {
 	// rename/copy+del if del is true otherwise moveFilebyCopy to not del.
 	var err error
 
 	if len(img.Data) != 0 {
-		err = utils.WriteImageToFile(img, dest)
-	}else{
-		if err = utils.MoveFilebyCopy(img.Path, dest); err != nil {
-			errLog.Printf("[move] %s", err)
-			return nil
-		}
+		err = utils.WriteImageToFile(*img, dest)
+	} else {
+		err = utils.CopyImage(img, dest)
 	}
 
 	return err
@@ -50,6 +159,10 @@ func visitWalk(filePath string, info os.FileInfo, _ error) error {
 	if info.IsDir() {
 		return nil
 	}
+	// sidecars are moved along with their image
+	if utils.IsSidecar(filePath) || utils.IsIndex(filePath) {
+		return nil
+	}
 	image, err := utils.LoadImage(filePath)
 	image.OriginalPath = filePath
 	if err != nil {
@@ -60,12 +173,14 @@ func visitWalk(filePath string, info os.FileInfo, _ error) error {
 }
 
 func visit(image utils.Image) error {
-
-
 	if strings.HasPrefix(filepath.Base(image.Path), ".") {
 		return nil
 	}
 
+	if deduper.Drop(&image) {
+		return nil
+	}
+
 	// parse the new filepath
 	newPath, err := parseFilename(image)
 	if err != nil {
@@ -77,7 +192,11 @@ func visit(image utils.Image) error {
 	absDest, _ := filepath.Abs(newPath)
 	if absSrc == absDest {
 		errLog.Printf("[dupe] %s", absDest)
+		deduper.Keep(image)
 		image.Path = absDest
+		if err := indexer.Add(image); err != nil {
+			errLog.Printf("[index] %s", err)
+		}
 		utils.Emit(image, outfmt)
 		return nil
 	}
@@ -89,15 +208,23 @@ func visit(image utils.Image) error {
 		return nil
 	}
 
-	if err := moveOrRename(image, absDest); err != nil{
+	if err := moveOrRename(&image, absDest); err != nil {
 		errLog.Printf("[move] %s", err)
 		return nil
 	}
+	deduper.Keep(image)
+	var sidecarErr error
+	if image.Sidecars, sidecarErr = utils.CopySidecars(image, absDest); sidecarErr != nil {
+		errLog.Printf("[sidecar] %s", sidecarErr)
+	}
+	utils.TrackProvenance(&image, absSrc, image.Data, absDest, nil, writeProv, outfmt)
 
 	image.Path = absDest
+	if err := indexer.Add(image); err != nil {
+		errLog.Printf("[index] %s", err)
+	}
 	utils.Emit(image, outfmt)
 
-
 	return err
 }
 
@@ -110,17 +237,29 @@ usage of %s:
 		%s -source <source>
 	copy into structure at destination:
 		%s -source <source> -output=<destination>
-
-
+	move an organised tree from one layout to another:
+		%s -source <source> -migrate -from timestream -layout hive
 
 flags:
-	-dirstruct: directory structure to pass to golangs time.Format
-	-output: set the <destination> directory (set to "tmp" to use and output a temporary dir)
+	-layout: directory layout (choices: timestream,daily,hive,isoweek,flat default=timestream)
+		prefix with stream/ for a directory per stream (ie stream/hive), or give a golang time.Format layout
+	-dirstruct: directory structure to pass to golangs time.Format (overrides -layout)
+	-migrate: move the images under <source> from the -from layout to -layout, checking each by hash
+	-from: the layout <source> is in for -migrate (default=timestream)
+	-preview: with -migrate, print the moves without making them (it is an error without -migrate)
+	-index: keep an index of the images in each directory and a summary of each stream in <destination>
+		(choices: jsonl,csv)
+		written at least every 10s, a killed run leaves them up to 10s of images behind
+	-output: set the <destination> directory (set to "tmp" to use and output a temporary dir, default=<source> for -migrate)
 	-source: set the <source> directory (optional, default=stdin)
+	-prov: write the provenance chain of each output image to <output>.prov.json
 	-outfmt: output format (choices: json,msgpack,path default=path)
 	-infmt: input format (choices: json,msgpack,path default=path)
+	-hash: compute a content hash for each image (choices: sha256,xxhash)
+	-dedupe: drop images byte identical to one already seen (hashes with -hash, default=sha256)
+	-hashindex: file of hashes kept between runs for -dedupe
 `
-	fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0])
+	fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
 func init() {
@@ -131,11 +270,50 @@ func init() {
 	flag.StringVar(&outputDir, "output", "", "output directory")
 	flag.StringVar(&outfmt, "outfmt", "path", "output format")
 	flag.StringVar(&infmt, "infmt", "path", "input format")
-	flag.StringVar(&tsDirStruct, "dirstruct", utils.DefaultTsDirectoryStructure, "output directory structure")
+	utils.HashFlags()
+	flag.StringVar(&tsDirStruct, "dirstruct", "", "output directory structure (time.Format)")
+	flag.StringVar(&layoutName, "layout", utils.LayoutTimestream, "output directory layout")
+	flag.BoolVar(&migrate, "migrate", false, "move <source> from the -from layout to -layout")
+	flag.StringVar(&fromLayoutName, "from", utils.LayoutTimestream, "layout of <source> for -migrate")
+	flag.BoolVar(&preview, "preview", false, "print the moves -migrate would make")
+	flag.StringVar(&indexFormat, "index", "", "index format (jsonl, csv)")
+	flag.BoolVar(&writeProv, "prov", false, "write provenance to <output>.prov.json")
 
 	// parse the leading argument with normal flag.Parse
 	flag.Parse()
 
+	var err error
+	if deduper, err = utils.FlagDeduper(); err != nil {
+		errLog.Printf("[dedupe] %s", err)
+		os.Exit(2)
+	}
+
+	if tsDirStruct != "" {
+		layout = utils.Layout{Format: tsDirStruct}
+	} else if layout, err = utils.ParseLayout(layoutName); err != nil {
+		errLog.Printf("[layout] %s", err)
+		os.Exit(2)
+	}
+	if fromLayout, err = utils.ParseLayout(fromLayoutName); err != nil {
+		errLog.Printf("[layout] %s", err)
+		os.Exit(2)
+	}
+	if preview && !migrate {
+		errLog.Printf("[preview] -preview only previews -migrate")
+		os.Exit(2)
+	}
+	if migrate {
+		if rootDir == "" {
+			errLog.Printf("[path] -migrate needs -source")
+			os.Exit(2)
+		}
+		if outputDir == "" {
+			outputDir = rootDir
+		}
+		// LoadImage gives absolute paths
+		rootDir, _ = filepath.Abs(rootDir)
+		outputDir, _ = filepath.Abs(outputDir)
+	}
 
 	if rootDir != "" {
 		if _, err := os.Stat(rootDir); err != nil {
@@ -157,6 +335,28 @@ func main() {
 		outputDir = tmpDir
 	}
 
+	if indexFormat != "" && !preview {
+		var err error
+		if indexer, err = utils.NewIndexer(outputDir, indexFormat); err != nil {
+			errLog.Printf("[index] %s", err)
+			os.Exit(2)
+		}
+		srcIndexer = indexer
+		if migrate && rootDir != outputDir {
+			if srcIndexer, err = utils.NewIndexer(rootDir, indexFormat); err != nil {
+				errLog.Printf("[index] %s", err)
+				os.Exit(2)
+			}
+		}
+	}
+
+	if migrate {
+		if migrateTree() > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	os.MkdirAll(outputDir, 0755)
 	if rootDir != "" {
 		if err := filepath.Walk(rootDir, visitWalk); err != nil {
@@ -181,17 +381,6 @@ func main() {
 					}
 					visit(img)
 				}
-				data := strings.Replace(scanner.Text(), "\n", "", -1)
-				if strings.HasPrefix(data, "[") {
-					errLog.Printf("[stdin] %s", data)
-					continue
-				} else {
-					img, err := utils.LoadImage(data)
-					if err != nil {
-						errLog.Printf("[load] %s", err)
-					}
-					visit(img)
-				}
 			}
 
 		} else {
@@ -212,8 +401,8 @@ func main() {
 			//}
 			//continue
 
-			utils.Handle(visit, os.RemoveAll, outfmt)
+			utils.Handle(visit, os.RemoveAll, infmt)
 		}
 	}
+	flushIndices()
 }
-
@@ -1,4 +1,4 @@
-package maingf
+package main
 
 import (
 	"bufio"
@@ -11,53 +11,85 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
 var (
-	errLog                          *log.Logger
+	errLog                                         *log.Logger
 	rootDir, outputDir, namedOutput, outfmt, infmt string
+	setExif, keepOriginal, writeProv               bool
+	deduper                                        *utils.Deduper
+	nameTemplate                                   *utils.NameTemplate
+	preview                                        bool
+	nameErrors                                     int
+	variant                                        string
 )
 
+func parseFilename(img utils.Image) (string, error) {
+	// the extension comes from the content, so tiff data written into a .jpg gets .tif
+	ext, matches, err := utils.CanonicalExtension(img)
+	if err != nil {
+		return "", err
+	}
+	if !matches {
+		errLog.Printf("[format] the content of %s doesnt match its extension, it will get %s", img.Path, ext)
+	}
 
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
+	if img.Stream == "" {
+		img.ParseName()
+	}
+	stream := streamName(img)
+	if namedOutput != "" {
+		// a -name with a variant (ie GC03L~fullres) replaces the variant in the filename
+		var nameVariant string
+		if stream, nameVariant = utils.SplitStreamName(namedOutput); nameVariant != "" {
+			img.Variant = nameVariant
 		}
 	}
-	return false
-}
-
-func parseFilename(img utils.Image) (string, error) {
-	ext := path.Ext(img.Path)
-
-	if contains([]string{".jpeg", ".JPG", ".JPEG"}, ext) {
-		ext = ".jpg"
+	switch variant {
+	case "":
+	case "none":
+		img.Variant = ""
+	default:
+		img.Variant = variant
 	}
-	if contains([]string{".tif", ".TIF", ".TIFF"}, ext) {
-		ext = ".tif"
+	targetFilename, err := nameTemplate.Name(img, stream, ext)
+	if err != nil {
+		return "", err
 	}
 
-	// this could at some point use ms at the end, but rn is just zero
-	targetFilename := namedOutput + "_" + img.Timestamp.Format(utils.TsForm) + "_00" + ext
-
 	newT := path.Join(outputDir, targetFilename)
 
 	return newT, nil
 }
 
-func moveOrRename(img utils.Image, dest string) error {
+// streamName returns -name, or the stream in the filename.
+func streamName(img utils.Image) string {
+	if namedOutput != "" {
+		return namedOutput
+	}
+	if img.Stream == "" {
+		img.ParseName()
+	}
+	return img.Stream
+}
+
+func moveOrRename(img *utils.Image, dest string) error {
 	// rename/copy+del if del is true otherwise moveFilebyCopy to not del.
 	var err error
 
-	if len(img.Data) != 0 {
-		err = utils.WriteImageToFile(img, dest)
-	}else{
-		if err = utils.MoveFilebyCopy(img.Path, dest); err != nil {
-			errLog.Printf("[move] %s", err)
+	if setExif {
+		if err = utils.CopyWithExif(*img, dest, utils.TimestampEdit(*img, img.Timestamp, keepOriginal)); err == nil {
+			img.ExifTimestamp = img.Timestamp
 			return nil
 		}
+		// formats RewriteExif cant handle are still copied
+		errLog.Printf("[setexif] %s, copying %s without rewriting its exif", err, img.Path)
+	}
+
+	if len(img.Data) != 0 {
+		err = utils.WriteImageToFile(*img, dest)
+	} else {
+		err = utils.CopyImage(img, dest)
 	}
 
 	return err
@@ -68,6 +100,10 @@ func visitWalk(filePath string, info os.FileInfo, _ error) error {
 	if info.IsDir() {
 		return nil
 	}
+	// sidecars are moved along with their image
+	if utils.IsSidecar(filePath) {
+		return nil
+	}
 	image, err := utils.LoadImage(filePath)
 	image.OriginalPath = filePath
 	if err != nil {
@@ -78,11 +114,19 @@ func visitWalk(filePath string, info os.FileInfo, _ error) error {
 }
 
 func visit(image utils.Image) error {
+	if deduper.Drop(&image) {
+		return nil
+	}
 
 	// parse the new filepath
 	newPath, err := parseFilename(image)
 	if err != nil {
 		errLog.Printf("[parse] %s", err)
+		nameErrors++
+		return nil
+	}
+	if preview {
+		fmt.Printf("%s -> %s\n", image.Path, newPath)
 		return nil
 	}
 
@@ -97,39 +141,79 @@ func visit(image utils.Image) error {
 	absDest, _ := filepath.Abs(newPath)
 	if absSrc == absDest {
 		errLog.Printf("[dupe] %s", absDest)
+		deduper.Keep(image)
 		image.Path = absDest
 		utils.Emit(image, outfmt) // still emit image if it exists in destination
 		return nil
 	}
 
-	if err := moveOrRename(image, absDest); err != nil{
+	if err := moveOrRename(&image, absDest); err != nil {
 		errLog.Printf("[move] %s", err)
 		return nil
 	}
+	deduper.Keep(image)
+	var sidecarErr error
+	if image.Sidecars, sidecarErr = utils.CopySidecars(image, absDest); sidecarErr != nil {
+		errLog.Printf("[sidecar] %s", sidecarErr)
+	}
+	utils.TrackProvenance(&image, absSrc, image.Data, absDest, nil, writeProv, outfmt)
 	image.Path = absDest
+	image.ParseName()
 
 	utils.Emit(image, outfmt)
 	return err
 }
 
 var usage = func() {
-	use:= `
+	use := `
 usage of %s:
 
 	copy with <name> prefix:
 		%s -source <source> -name=<name>
-	copy with <name> prefix:
-		%s -source <source> -name=<name>
+	copy into a directory per day, numbering the images of each stream and keeping the camera model:
+		%s -source <source> -template '{{.Stream}}/{{.Time "2006_01_02"}}/{{.Stream}}_{{printf "%%05d" .Sequence}}_{{.Camera}}{{.Ext}}'
+	check what a template would name the images without copying anything:
+		%s -source <source> -template '{{.Stream}}_{{.Ts}}_{{.HashPrefix 8}}{{.Ext}}' -preview
 
 flags:
-	-name: renames the prefix fo the target files
+	-name: renames the prefix fo the target files (the stream name, default=the stream in the filename)
+	  a name with a variant (ie <name>~fullres) replaces the variant in the filename too
+	-variant: replace the variant in the filename, ie 1920 for <stream>~1920_..., none to remove it (default=keep it)
+	-template: go text/template for the name of each output file, which can include directories
+	  (default={{.Stream}}{{if .Variant}}~{{.Variant}}{{end}}_{{.Ts}}_{{.Subsecond}}{{.Ext}})
+	-preview: print "<source> -> <destination>" for each image instead of copying it, nothing is written (no -output tmp dir or -hashindex)
 	-output: set the <destination> directory (set to "tmp" to use and output a temporary dir)
 	-source: set the <source> directory (optional, default=stdin)
+	-setexif: rewrite the exif DateTime/DateTimeOriginal of the output images to the timestamp in the new name
+		(jpeg, tiff and png, other formats are copied as they are)
+	-keeporiginal: keep the original exif datetime in UserComment (with -setexif)
+	-prov: write the provenance chain of each output image to <output>.prov.json
 	-outfmt: output format (choices: json,msgpack,path default=path)
 	-infmt: input format (choices: json,msgpack,path default=path)
-
+	-hash: compute a content hash for each image (choices: sha256,xxhash)
+	-dedupe: drop images byte identical to one already seen (hashes with -hash, default=sha256)
+	-hashindex: file of hashes kept between runs for -dedupe
+
+template fields:
+	{{.Stream}}: the stream name
+	{{.Variant}}: the variant, ie fullres from <stream>~fullres_2018_04_01_10_00_00_00.jpg
+	{{.Ts}}: the timestamp as 2006_01_02_15_04_05
+	{{.Subsecond}}: what was after the timestamp in the filename (default=00)
+	{{.Time "<layout>"}}: the timestamp in a go time layout, ie {{.Time "2006/01/02"}}
+	{{.Sequence}}: the position of the image in its stream from 0, in input order, ie {{printf "%%05d" .Sequence}}
+	{{.Camera}}: the camera model from the exif or sidecars, with spaces replaced by -
+	{{.Grid}}: the grid position of a crop from tscrop, ie 0,1
+	{{.Original}}: the original filename without its extension
+	{{.Width}}, {{.Height}}, {{.Resolution}}: the size of the image, ie 1920x1080
+	{{.HashPrefix <n>}}: the first n hex digits of the content hash (with -hash, default=sha256)
+	{{.Ext}}: the extension, with its dot
+
+two different images that would get the same name are an error, the second isnt copied.
+with -preview the exit status is 1 if any names collide.
+the extension of each output file comes from its content (jpeg .jpg, png .png, tiff .tif, canon raw .cr2), files whose
+content doesnt match their extension are logged with [format].
 `
-fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0])
+	fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
 func init() {
@@ -142,9 +226,27 @@ func init() {
 
 	flag.StringVar(&outfmt, "outfmt", "path", "output format")
 	flag.StringVar(&infmt, "infmt", "path", "input format")
+	utils.HashFlags()
+	flag.BoolVar(&setExif, "setexif", false, "rewrite exif datetime to the file timestamp")
+	flag.BoolVar(&keepOriginal, "keeporiginal", false, "keep the original exif datetime in UserComment")
+	flag.BoolVar(&writeProv, "prov", false, "write provenance to <output>.prov.json")
+	templateString := flag.String("template", utils.DefaultNameTemplate, "template for the output names")
+	flag.BoolVar(&preview, "preview", false, "print the names instead of copying")
+	flag.StringVar(&variant, "variant", "", "variant to give the files")
 	// parse the leading argument with normal flag.Parse
 	flag.Parse()
 
+	var err error
+	if deduper, err = utils.FlagDeduper(); err != nil {
+		errLog.Printf("[dedupe] %s", err)
+		os.Exit(2)
+	}
+
+	if nameTemplate, err = utils.NewNameTemplate(*templateString); err != nil {
+		errLog.Printf("%s", err)
+		os.Exit(1)
+	}
+
 	// create dirs
 	if rootDir != "" {
 		if _, err := os.Stat(rootDir); err != nil {
@@ -157,7 +259,8 @@ func init() {
 }
 
 func main() {
-	if outputDir == "tmp" {
+	// a preview doesnt write anything, so it has no temporary directory to create or clean up
+	if outputDir == "tmp" && !preview {
 		tmpDir, err := ioutil.TempDir("", "tsrename-")
 		if err != nil {
 			panic(err)
@@ -167,7 +270,9 @@ func main() {
 		outputDir = tmpDir
 	}
 
-	os.MkdirAll(outputDir, 0755)
+	if !preview {
+		os.MkdirAll(outputDir, 0755)
+	}
 	if rootDir != "" {
 		if err := filepath.Walk(rootDir, visitWalk); err != nil {
 			errLog.Printf("[walk] %s", err)
@@ -191,17 +296,6 @@ func main() {
 					}
 					visit(img)
 				}
-				data := strings.Replace(scanner.Text(), "\n", "", -1)
-				if strings.HasPrefix(data, "[") {
-					errLog.Printf("[stdin] %s", data)
-					continue
-				} else {
-					img, err := utils.LoadImage(data)
-					if err != nil {
-						errLog.Printf("[load] %s", err)
-					}
-					visit(img)
-				}
 			}
 
 		} else {
@@ -225,4 +319,8 @@ func main() {
 			utils.Handle(visit, os.RemoveAll, infmt)
 		}
 	}
+	if preview && nameErrors > 0 {
+		errLog.Printf("[preview] %d images couldn't be named", nameErrors)
+		os.Exit(1)
+	}
 }
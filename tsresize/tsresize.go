@@ -29,6 +29,7 @@ var (
 	resolution                                         image.Point
 	res                                                string
 	imageEncoder                                       imgio.Encoder
+	strip, writeProv                                   bool
 )
 
 // TIFFEncoder returns an encoder to the Tagged Image Format
@@ -55,19 +56,10 @@ func convertImage2(sourcePath, destPath string) (err error) {
 
 func convertImage(sourceImg *utils.Image) (err error) {
 	if len(sourceImg.Data) == 0 {
-		file, err := os.Open(sourceImg.Path)
-		if err != nil {
-			return
-		}
 		// read the image bytes into the img.Data
-		buf1 := new(bytes.Buffer)
-		_, err = buf1.ReadFrom(file)
-		if err != nil {
+		if sourceImg.Data, err = ioutil.ReadFile(sourceImg.Path); err != nil {
 			return
 		}
-
-		sourceImg.Data = buf1.Bytes()
-		buf1.Reset()
 	}
 
 	imgReader := bytes.NewReader(sourceImg.Data)
@@ -90,8 +82,24 @@ func convertImage(sourceImg *utils.Image) (err error) {
 	}
 
 	imgWriter.Flush()
+	encoded := buf2.Bytes()
+
+	if !strip {
+		// carry over the exif and xmp from the source image, image.Decode drops it.
+		edit := utils.ExifEdit{
+			Width:   resized.Bounds().Dx(),
+			Height:  resized.Bounds().Dy(),
+			History: strings.Join(os.Args, " "),
+		}
+		if encoded, err = utils.CopyMetadata(*sourceImg, encoded, edit); err != nil {
+			errLog.Printf("[exif] %s", err)
+			err = nil
+		}
+		sourceImg.ExifBytes = utils.ExtractExif(encoded)
+	}
+
 	// read the image bytes into the img.Data
-	sourceImg.Data = buf2.Bytes()
+	sourceImg.Data = encoded
 	buf2.Reset()
 	return
 }
@@ -126,6 +134,9 @@ func visit(img utils.Image) error {
 	newBase := fmt.Sprintf("%s.%s", noExtension, targetExtension)
 	newPath := path.Join(outputDir, newBase)
 
+	// keep the input for provenance, if there is no data it is hashed from inputPath
+	inputPath, inputData := img.Path, img.Data
+
 	// convert the img
 	if err := convertImage(&img); err != nil {
 		errLog.Printf("[convert] %s", err)
@@ -134,6 +145,8 @@ func visit(img utils.Image) error {
 	img.Path = newPath
 	utils.WriteImageToFile(img, newPath)
 
+	utils.TrackProvenance(&img, inputPath, inputData, newPath, img.Data, writeProv, outfmt)
+
 	// output the relative img path
 	utils.Emit(img, outfmt)
 
@@ -148,6 +161,8 @@ flags:
 	-write: output image resolution
 	-output: set the <destination> directory (set to "tmp" to use and output a temporary dir
 	-type: output image type (default=jpg)
+	-strip: dont copy exif and xmp metadata into the output images
+	-prov: write the provenance chain of each output image to <output>.prov.json
 	-outfmt: output format (choices: json,msgpack,path default=path)
 	-infmt: input format (choices: json,msgpack,path default=path)
 
@@ -184,6 +199,8 @@ func init() {
 	flag.StringVar(&outfmt, "outfmt", "path", "output format")
 	flag.StringVar(&infmt, "infmt", "path", "input format")
 	flag.StringVar(&res, "res", "", "resolution")
+	flag.BoolVar(&strip, "strip", false, "strip metadata")
+	flag.BoolVar(&writeProv, "prov", false, "write provenance to <output>.prov.json")
 	flag.Parse()
 
 	switch *outputType {
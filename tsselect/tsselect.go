@@ -4,8 +4,9 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
-	"github.com/bcampbell/fuzzytime"
+	"github.com/borevitzlab/go-timestreamtools/solar"
 	"github.com/borevitzlab/go-timestreamtools/utils"
+	"image"
 	"log"
 	"os"
 	"path/filepath"
@@ -17,22 +18,225 @@ var (
 	errLog                 *log.Logger
 	rootDir, outfmt, infmt string
 	start, end             time.Time
-	startTod, endTod       time.Time
+	timeRange              utils.TimeRange
+	windows                utils.TimeOfDayWindows
+	calendar               *utils.Calendar
+	deduper                *utils.Deduper
+	lat, lon               float64
+	sunLocation            *time.Location
+	sunElevationMin        float64
+	useSunElevation        bool
+	fromEvent, toEvent     sunEvent
+	lumMin, lumMax         float64
+	clippedMax             float64
+	sharpnessMin           float64
+	contrastMin            float64
+	scoreQuality           bool
+	filterQuality          bool
+	validate               bool
+	quarantineDir          string
+	where                  *utils.Predicate
+	includes, excludes     globList
+	extensions             map[string]bool
+	sampler                *utils.Sampler
+	cleanupPaths           []string
 )
 
+// globList is a flag that can be given more than once
+type globList []string
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globList) Set(value string) error {
+	if _, err := filepath.Match(value, ""); err != nil {
+		return fmt.Errorf("bad glob %q: %s", value, err)
+	}
+	*g = append(*g, value)
+	return nil
+}
+
+// match returns true if any of the globs match the path, globs with a / are matched against the whole path.
+func (g globList) match(thisPath string) bool {
+	for _, glob := range g {
+		target := filepath.Base(thisPath)
+		if strings.Contains(glob, "/") {
+			target = filepath.ToSlash(thisPath)
+		}
+		if ok, _ := filepath.Match(glob, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkName checks the path of an image against -ext, -include and -exclude
+func checkName(thisPath string) bool {
+	if len(extensions) != 0 && !extensions[strings.ToLower(strings.TrimPrefix(filepath.Ext(thisPath), "."))] {
+		return false
+	}
+	if len(includes) != 0 && !includes.match(thisPath) {
+		return false
+	}
+	return !excludes.match(thisPath)
+}
+
+// sunEvent is a time of day relative to the sun, ie sunrise+30m
+type sunEvent struct {
+	name   string
+	offset time.Duration
+}
+
+// parseSunEvent parses <event>[+-<duration>] where event is one of dawn, sunrise, noon, sunset or dusk.
+func parseSunEvent(value string) (sunEvent, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	name, offset := value, ""
+	if i := strings.IndexAny(value, "+-"); i >= 0 {
+		name, offset = value[:i], value[i:]
+	}
+	switch name {
+	case "dawn", "sunrise", "noon", "sunset", "dusk":
+	default:
+		return sunEvent{}, fmt.Errorf("unknown sun event %q (choices: dawn,sunrise,noon,sunset,dusk)", name)
+	}
+	ev := sunEvent{name: name}
+	if offset != "" {
+		var err error
+		if ev.offset, err = time.ParseDuration(offset); err != nil {
+			return sunEvent{}, fmt.Errorf("bad offset in sun event %q: %s", value, err)
+		}
+	}
+	return ev, nil
+}
+
+// eventTime returns the instant of a sun event on the date of day.
+// returns solar.ErrAlwaysAbove or solar.ErrAlwaysBelow if the sun doesnt rise or set that day.
+func eventTime(ev sunEvent, day time.Time) (time.Time, error) {
+	if ev.name == "noon" {
+		return solar.Noon(day, lon).Add(ev.offset), nil
+	}
+	elevation := solar.Sunrise
+	if ev.name == "dawn" || ev.name == "dusk" {
+		elevation = solar.CivilTwilight
+	}
+	rise, set, err := solar.Crossing(day, lat, lon, elevation)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ev.name == "sunrise" || ev.name == "dawn" {
+		return rise.Add(ev.offset), nil
+	}
+	return set.Add(ev.offset), nil
+}
+
+// inSunWindow checks the position of the sun when an image was taken against -sun-elevation-min, -from and -to.
+// on days the sun never rises (polar night) nothing is selected, on days it never sets the whole day is.
+func inSunWindow(t time.Time) bool {
+	if sunLocation == nil {
+		return true
+	}
+	// timestamps are wall clock time at the camera
+	instant := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), sunLocation)
+	if useSunElevation {
+		if elevation, _ := solar.Position(instant, lat, lon); elevation < sunElevationMin {
+			return false
+		}
+	}
+	if fromEvent.name != "" {
+		from, err := eventTime(fromEvent, instant)
+		if err == solar.ErrAlwaysBelow || err == nil && instant.Before(from) {
+			return false
+		}
+	}
+	if toEvent.name != "" {
+		to, err := eventTime(toEvent, instant)
+		if err == solar.ErrAlwaysBelow || err == nil && instant.After(to) {
+			return false
+		}
+	}
+	return true
+}
+
+// inTimeSpan checks t is between -start and -end, including the ends according to -range-mode
 func inTimeSpan(check time.Time) bool {
-	// from: https://stackoverflow.com/questions/20924303/date-time-comparison-in-golang
-	return check.After(start) && check.Before(end)
+	return timeRange.Contains(check)
 }
 
+// inTimeOfDay checks t is in any of the time of day windows
 func inTimeOfDay(t time.Time) bool {
-	st := time.Date(t.Year(), t.Month(), t.Day(), startTod.Hour(), startTod.Minute(), startTod.Second(), startTod.Nanosecond(), t.Location())
-	en := time.Date(t.Year(), t.Month(), t.Day(), endTod.Hour(), endTod.Minute(), endTod.Second(), endTod.Nanosecond(), t.Location())
-	return t.After(st) && t.Before(en) || t == en || t == st
+	if len(windows) == 0 {
+		return true
+	}
+	for _, window := range windows {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
 }
 
-func checkFilePath(img utils.Image) (bool, error) {
-	return inTimeSpan(img.Timestamp) && inTimeOfDay(img.Timestamp), nil
+// checkValid validates an image, quarantining it if it is invalid and -quarantine is set.
+// returns the decoded image so that it can be scored without decoding it again.
+func checkValid(img utils.Image) (image.Image, error) {
+	m, reason := utils.ValidateImage(img)
+	if reason == nil {
+		return m, nil
+	}
+	if quarantineDir != "" {
+		if dest, err := utils.Quarantine(img, quarantineDir, rootDir, reason); err != nil {
+			errLog.Printf("[quarantine] %s", err)
+		} else {
+			return nil, fmt.Errorf("invalid image %s quarantined to %s: %s", img.Path, dest, reason)
+		}
+	}
+	return nil, fmt.Errorf("invalid image %s: %s", img.Path, reason)
+}
+
+// checkQuality scores the content of an image if any quality filter is set, and checks the scores against them.
+// the scores are kept on the image so they are emitted in json/msgpack output.
+// images that cant be scored are only dropped when they are filtered on, otherwise they are kept without scores.
+func checkQuality(img *utils.Image, m image.Image) (bool, error) {
+	if !scoreQuality {
+		return true, nil
+	}
+	var scores utils.QualityScores
+	if m != nil {
+		scores = utils.Score(m)
+	} else {
+		var err error
+		if scores, err = utils.ScoreImage(*img); err != nil {
+			err = fmt.Errorf("couldn't score %s: %s", img.Path, err)
+			if filterQuality {
+				return false, err
+			}
+			errLog.Printf("[quality] %s", err)
+			return true, nil
+		}
+	}
+	img.Quality = &scores
+	return scores.Luminance >= lumMin && scores.Luminance <= lumMax &&
+		scores.ClippedHigh <= clippedMax &&
+		scores.Sharpness >= sharpnessMin &&
+		scores.Contrast >= contrastMin, nil
+}
+
+func checkFilePath(img *utils.Image) (bool, error) {
+	if !checkName(img.Path) || !inTimeSpan(img.Timestamp) || !inTimeOfDay(img.Timestamp) || !calendar.Contains(img.Timestamp) || !inSunWindow(img.Timestamp) {
+		return false, nil
+	}
+	if where != nil && !where.Match(img) {
+		return false, nil
+	}
+	// decoding is slow, so check the content last
+	var m image.Image
+	if validate {
+		var err error
+		if m, err = checkValid(*img); err != nil {
+			return false, err
+		}
+	}
+	return checkQuality(img, m)
 }
 
 func visitWalk(filePath string, info os.FileInfo, _ error) error {
@@ -40,6 +244,10 @@ func visitWalk(filePath string, info os.FileInfo, _ error) error {
 	if info.IsDir() {
 		return nil
 	}
+	// sidecars follow their image through the pipeline
+	if utils.IsSidecar(filePath) {
+		return nil
+	}
 
 	image, err := utils.LoadImage(filePath)
 	image.OriginalPath = filePath
@@ -50,11 +258,31 @@ func visitWalk(filePath string, info os.FileInfo, _ error) error {
 	return visit(image)
 }
 
+// emit outputs a selected image
+func emit(img utils.Image) {
+	// record the selection and the hash of the raw file at the head of the chain
+	utils.TrackProvenance(&img, img.Path, img.Data, "", nil, false, outfmt)
+	deduper.Keep(img)
+	utils.Emit(img, outfmt)
+}
+
+// deferCleanup holds on to temporary directories from upstream tools until buffered images have been emitted.
+func deferCleanup(tempDir string) error {
+	cleanupPaths = append(cleanupPaths, tempDir)
+	return nil
+}
 
 func visit(img utils.Image) error {
 
-	if ok, err := checkFilePath(img); ok {
-		utils.Emit(img, outfmt)
+	if ok, err := checkFilePath(&img); ok {
+		if deduper.Drop(&img) {
+			return nil
+		}
+		if sampler != nil {
+			sampler.Add(img)
+			return nil
+		}
+		emit(img)
 	} else if err != nil {
 		errLog.Printf("[check] %s", err)
 	}
@@ -68,11 +296,63 @@ usage of %s:
 flags:
 	-start: the start datetime (default=1970-01-01 00:00)
 	-end: the end datetime (default=now)
-	-starttod: the start time of day, default 00:00:00
-	-endtod: the end time of day, default 23:59:59
+	  datetimes are RFC3339, YYYY-MM-DD[THH:MM[:SS]] (wall clock, like the timestamps), a duration relative to now (ie -24h, -7d),
+	  or an anchor with an optional offset (now, today, yesterday, tomorrow, this-week, last-week, next-week,
+	  this-month, last-month, next-month, ie today+6h), anything else is an error
+	-now: the time relative datetimes are relative to, for reproducible reruns (default=the current wall clock time)
+	-range-mode: which ends of -start and -end are included (choices: half-open,closed,open,open-closed default=half-open)
+	  half-open is [start,end), so consecutive runs with back to back -start/-end select every image exactly once
+	-starttod: the start time of day as HH:MM[:SS], default 00:00:00
+	-endtod: the end time of day as HH:MM[:SS], default 23:59:59
+	  if -endtod is before -starttod the window wraps midnight, ie -starttod 20:00 -endtod 04:00
+	-window: a time of day window, ie 06:00-10:00, can be given more than once to select images in any of them
+	  -starttod/-endtod is another window if they are given
+	-calendar: file of include/exclude rules, one per line:
+	  include|exclude <date> [<date>]       a date range, dates include the whole day (ie exclude 2018-04-10T08:00 2018-04-10T11:00)
+	  include|exclude weekday <days>        ie exclude weekday sat,sun
+	  include|exclude daily <HH:MM-HH:MM>   ie exclude daily 12:00-12:30
 	-source: set the <source> directory (optional, default=stdin)
 	-outfmt: output format (choices: json,msgpack,path default=path)
 	-infmt: input format (choices: json,msgpack,path default=path)
+	-hash: compute a content hash for each image (choices: sha256,xxhash)
+	-dedupe: drop images byte identical to one already seen (hashes with -hash, default=sha256)
+	-hashindex: file of hashes kept between runs for -dedupe
+	-lat: latitude of the camera in degrees, north positive (required for sun selection)
+	-lon: longitude of the camera in degrees, east positive (required for sun selection)
+	-tz: time zone the image timestamps are in (default=UTC, ie Australia/Canberra)
+	  -start/-end with an offset (ie 2018-04-01T10:00:00+11:00) are compared on the wall clock in this zone
+	-daylight: only select images taken between sunrise and sunset
+	-sun-elevation-min: only select images taken with the sun at least this many degrees above the horizon
+	-from: only select images taken after a sun event (choices: dawn,sunrise,noon,sunset,dusk with an optional offset, ie sunrise+30m)
+	-to: only select images taken before a sun event (ie sunset-30m)
+	-lum-min: minimum mean luminance (0-255), drops night frames
+	-lum-max: maximum mean luminance (0-255)
+	-clipped-max: maximum fraction of pixels blown out to white (0-1), drops overexposed frames
+	-sharpness-min: minimum laplacian variance, drops blurry or fogged frames
+	-contrast-min: minimum luminance standard deviation (0-255), drops near uniform frames
+	-score: compute the quality scores without filtering on them
+	-validate: only select images that are complete (jpeg EOI marker, tiff ifds and strips in range) and fully decode
+	  formats that cant be decoded (cr2, unknown formats) are only checked for their structure and kept
+	-quarantine: move invalid images and their sidecars into this directory with a <name>.reason.txt (implies -validate)
+	  the path relative to -source is kept, an existing file in the quarantine is never overwritten
+	-ext: only select images with these extensions, comma separated, case insensitive (ie jpg,tif)
+	-include: only select images with names matching this glob, can be given more than once (ie -include "*NIR*")
+	-exclude: drop images with names matching this glob, can be given more than once
+	  globs containing a / are matched against the whole path
+	-every: only emit the first of every N selected images
+	-per: only emit one image per period, ie 1h (slots start on multiples of the period)
+	-closest: only emit the one image each day closest to a time of day, ie 12:00
+	-count: only emit N images evenly spaced from -start to -end (or across all the images if they arent given)
+	-prefer: how to choose an image for a slot (choices: centre,quality,first default=centre)
+	  centre is the closest to the middle of the slot or its target time, quality the sharpest with the least clipping
+	-sample-window: how far out of order images can arrive when sampling, ie 30m (default=0)
+	-where: only select images matching an expression on their fields and metadata, ie
+	  -where 'exif.Model == "Canon EOS 600D" && exif.ISO <= 400 && name ~ "NIR"'
+	  operators: == != < <= > >= ~ (regex) !~ && || ! ( )
+	  fields: path name dir ext stem timestamp year month day hour minute second weekday yday size hash
+	    exif.<tag> (exif and sidecar metadata, exif.ISO for exif.ISOSpeedRatings)
+	quality scores are computed on a downscaled decode (of the embedded preview where there is one) and emitted as
+	"quality" with -outfmt json/msgpack. images that cant be scored are dropped by the filters but kept by -score
 
 
 examples:
@@ -80,61 +360,90 @@ examples:
 		%s -source <source> -start 1996-06-11
 	filter from 11 June 1996 to 10 December 1996 from stdin:
 		%s -start 1996-06-11 -end 1996-12-10
-
-dates are assumed to be DMY or YMD not MDY
-tsselect is NON DESTRUCTIVE, and doesnt copy/move files, it only filters
+	filter the last day, as it was at 10am on the 1st of April:
+		%s -source <source> -start -24h -now 2018-04-01T10:00
+	filter to half an hour after sunrise until half an hour before sunset in Canberra:
+		%s -lat -35.28 -lon 149.13 -tz Australia/Canberra -from sunrise+30m -to sunset-30m
+	select the tiffs and raws from the NIR camera in a mixed folder:
+		%s -source <source> -ext tif,cr2 -where 'exif.Model == "Canon EOS 600D" && name ~ "NIR"'
+	one frame a day for an overview movie, the sharpest near midday:
+		%s -source <source> -closest 12:00 -prefer quality
+	drop dark, blown out and blurry frames:
+		%s -source <source> -lum-min 40 -clipped-max 0.2 -sharpness-min 50 -outfmt json
+
+tsselect is NON DESTRUCTIVE, and doesnt copy/move files, it only filters (except for -quarantine)
 `
-	fmt.Printf(use, os.Args[0])
+	fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
-func parseDateTime(tString string, t *time.Time, defaultValue time.Time) error {
-	ctx := fuzzytime.Context{
-		DateResolver: fuzzytime.DMYResolver,
-		TZResolver:   fuzzytime.DefaultTZResolver("UTC"),
+// parseSunFlags sets up sun position based selection, if any of the sun flags were given.
+func parseSunFlags(loc *time.Location, fromString, toString string, daylight bool) (err error) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	useSunElevation = set["sun-elevation-min"]
+	if !useSunElevation && !daylight && fromString == "" && toString == "" {
+		return nil
 	}
-	datetimeValue, _, err := ctx.Extract(tString)
-	if err != nil {
-		errLog.Printf("[time] couldn't extract datetime: %s", err)
+	if !set["lat"] || !set["lon"] {
+		return fmt.Errorf("-lat and -lon are required to select by the position of the sun")
 	}
-
-	if datetimeValue.Empty() {
-		*t = defaultValue
-	} else {
-		datetimeValue.Time.SetHour(datetimeValue.Time.Hour())
-		datetimeValue.Time.SetMinute(datetimeValue.Time.Minute())
-		datetimeValue.Time.SetSecond(datetimeValue.Time.Second())
-		datetimeValue.Time.SetTZOffset(datetimeValue.Time.TZOffset())
-		*t, err = time.Parse(time.RFC3339, datetimeValue.ISOFormat())
-		if err != nil {
-			return err
+	if daylight {
+		if fromString == "" {
+			fromString = "sunrise"
+		}
+		if toString == "" {
+			toString = "sunset"
 		}
 	}
-	return nil
+	if fromString != "" {
+		if fromEvent, err = parseSunEvent(fromString); err != nil {
+			return
+		}
+	}
+	if toString != "" {
+		if toEvent, err = parseSunEvent(toString); err != nil {
+			return
+		}
+	}
+	sunLocation = loc
+	return
 }
 
-func parseTime(tString string, t *time.Time, defaultValue time.Time) error {
-	ctx := fuzzytime.Context{
-		DateResolver: fuzzytime.DMYResolver,
-		TZResolver:   fuzzytime.DefaultTZResolver("UTC"),
+// setupSampler creates the sampler for -every, -per, -closest or -count, only one of which can be given.
+func setupSampler(every int, per time.Duration, closestString string, count int, hasRange bool) (err error) {
+	modes := 0
+	for _, set := range []bool{every != 0, per != 0, closestString != "", count != 0} {
+		if set {
+			modes++
+		}
 	}
-	datetimeValue, _, err := ctx.Extract(tString)
-	if err != nil {
-		errLog.Printf("[time] couldn't extract datetime: %s", err)
+	if modes > 1 {
+		return fmt.Errorf("only one of -every, -per, -closest and -count can be used")
 	}
-
-	if datetimeValue.Empty() {
-		*t = defaultValue
-	} else {
-		datetimeValue.Time.SetHour(datetimeValue.Time.Hour())
-		datetimeValue.Time.SetMinute(datetimeValue.Time.Minute())
-		datetimeValue.Time.SetSecond(datetimeValue.Time.Second())
-		datetimeValue.Time.SetTZOffset(datetimeValue.Time.TZOffset())
-		*t, err = time.Parse("T15:04:05Z07:00", datetimeValue.ISOFormat())
-		if err != nil {
-			return err
+	switch {
+	case every != 0:
+		sampler, err = utils.NewEverySampler(every, emit)
+	case per != 0:
+		sampler, err = utils.NewPeriodSampler(per, emit)
+	case closestString != "":
+		var tod time.Time
+		if tod, err = time.Parse("15:04", closestString); err != nil {
+			if tod, err = time.Parse("15:04:05", closestString); err != nil {
+				return fmt.Errorf("couldn't parse -closest %q, use HH:MM", closestString)
+			}
+		}
+		timeOfDay := time.Duration(tod.Hour())*time.Hour + time.Duration(tod.Minute())*time.Minute + time.Duration(tod.Second())*time.Second
+		sampler, err = utils.NewDailySampler(timeOfDay, emit)
+	case count != 0:
+		var rangeStart, rangeEnd time.Time
+		if hasRange {
+			rangeStart, rangeEnd = start, end
 		}
+		sampler, err = utils.NewCountSampler(count, rangeStart, rangeEnd, emit)
 	}
-	return nil
+	return
 }
 
 func init() {
@@ -145,37 +454,151 @@ func init() {
 	flag.StringVar(&rootDir, "source", "", "source directory")
 	flag.StringVar(&outfmt, "outfmt", "path", "output format")
 	flag.StringVar(&infmt, "infmt", "path", "input format")
+	utils.HashFlags()
 
 	startString := flag.String("start", "", "start datetime")
 	endString := flag.String("end", "", "end datetime")
+	nowString := flag.String("now", "", "the time relative start and end times are relative to")
+	rangeMode := flag.String("range-mode", utils.RangeHalfOpen, "which ends of -start and -end are included")
 	startTodString := flag.String("starttod", "", "start time of day")
 	endTodString := flag.String("endtod", "", "end time of day")
+	flag.Var(&windows, "window", "time of day window")
+	calendarPath := flag.String("calendar", "", "calendar file of include and exclude rules")
+	flag.Float64Var(&lat, "lat", 0, "latitude of the camera")
+	flag.Float64Var(&lon, "lon", 0, "longitude of the camera")
+	tzString := flag.String("tz", "UTC", "time zone of the image timestamps")
+	daylight := flag.Bool("daylight", false, "select images between sunrise and sunset")
+	flag.Float64Var(&sunElevationMin, "sun-elevation-min", 0, "minimum sun elevation in degrees")
+	fromString := flag.String("from", "", "sun event to select from")
+	toString := flag.String("to", "", "sun event to select to")
+	flag.Float64Var(&lumMin, "lum-min", 0, "minimum mean luminance")
+	flag.Float64Var(&lumMax, "lum-max", 255, "maximum mean luminance")
+	flag.Float64Var(&clippedMax, "clipped-max", 1, "maximum fraction of clipped pixels")
+	flag.Float64Var(&sharpnessMin, "sharpness-min", 0, "minimum laplacian variance")
+	flag.Float64Var(&contrastMin, "contrast-min", 0, "minimum luminance standard deviation")
+	flag.BoolVar(&scoreQuality, "score", false, "compute quality scores")
+	flag.BoolVar(&validate, "validate", false, "drop corrupt and truncated images")
+	flag.StringVar(&quarantineDir, "quarantine", "", "directory to move invalid images into")
+	flag.Var(&includes, "include", "glob of names to select")
+	flag.Var(&excludes, "exclude", "glob of names to drop")
+	extString := flag.String("ext", "", "extensions to select")
+	whereString := flag.String("where", "", "expression to select images with")
+	every := flag.Int("every", 0, "emit every Nth image")
+	per := flag.Duration("per", 0, "emit one image per period")
+	closestString := flag.String("closest", "", "emit the image closest to a time of day each day")
+	count := flag.Int("count", 0, "emit N evenly spaced images")
+	prefer := flag.String("prefer", utils.PreferCentre, "how to choose an image for a slot")
+	sampleWindow := flag.Duration("sample-window", 0, "how far out of order images can arrive")
 	// parse the leading argument with normal flag.Parse
 	flag.Parse()
 
-	defaultStart, _ := time.Parse(time.RFC3339, "1970-01-01T00:00:00Z")
-	defaultEnd, _ := time.Parse(utils.TsForm, time.Now().Format(utils.TsForm))
-	defaultStartTod, _ := time.Parse(time.RFC3339, "1970-01-01T00:00:00Z")
-	defaultEndTod, _ := time.Parse(time.RFC3339, "1970-01-01T23:59:59Z")
+	var err error
+	if deduper, err = utils.FlagDeduper(); err != nil {
+		errLog.Printf("[dedupe] %s", err)
+		os.Exit(2)
+	}
 
-	err := parseDateTime(*startString, &start, defaultStart)
-	if err != nil {
-		panic(err)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "lum-min", "lum-max", "clipped-max", "sharpness-min", "contrast-min":
+			scoreQuality = true
+			filterQuality = true
+		}
+	})
+
+	if quarantineDir != "" {
+		validate = true
 	}
 
-	err = parseDateTime(*endString, &end, defaultEnd)
-	if err != nil {
-		panic(err)
+	if *whereString != "" {
+		var err error
+		if where, err = utils.ParsePredicate(*whereString); err != nil {
+			errLog.Printf("%s", err)
+			os.Exit(1)
+		}
+	}
+	if *extString != "" {
+		extensions = map[string]bool{}
+		for _, ext := range strings.Split(*extString, ",") {
+			extensions[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))] = true
+		}
 	}
 
-	err = parseTime(*startTodString, &startTod, defaultStartTod)
+	location, err := time.LoadLocation(*tzString)
 	if err != nil {
-		panic(err)
+		errLog.Printf("[time] -tz %s", err)
+		os.Exit(1)
+	}
+	if err := parseSunFlags(location, *fromString, *toString, *daylight); err != nil {
+		errLog.Printf("[sun] %s", err)
+		os.Exit(1)
 	}
 
-	err = parseTime(*endTodString, &endTod, defaultEndTod)
-	if err != nil {
-		panic(err)
+	now := utils.WallClockNow()
+	if *nowString != "" {
+		if now, err = utils.ParseAbsoluteTime(*nowString); err != nil {
+			errLog.Printf("[time] -now %s", err)
+			os.Exit(1)
+		}
+	}
+	start = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	end = now
+	if *startString != "" {
+		if start, err = utils.ParseTimeExpression(*startString, now); err != nil {
+			errLog.Printf("[time] -start %s", err)
+			os.Exit(1)
+		}
+	}
+	if *endString != "" {
+		if end, err = utils.ParseTimeExpression(*endString, now); err != nil {
+			errLog.Printf("[time] -end %s", err)
+			os.Exit(1)
+		}
+	}
+	if timeRange, err = utils.NewTimeRange(start, end, *rangeMode, location); err != nil {
+		errLog.Printf("[time] %s", err)
+		os.Exit(1)
+	}
+
+	startTod, endTod := time.Duration(0), 24*time.Hour-time.Second
+	if *startTodString != "" {
+		if startTod, err = utils.ParseTimeOfDay(*startTodString); err != nil {
+			errLog.Printf("[time] -starttod %s", err)
+			os.Exit(1)
+		}
+	}
+	if *endTodString != "" {
+		if endTod, err = utils.ParseTimeOfDay(*endTodString); err != nil {
+			errLog.Printf("[time] -endtod %s", err)
+			os.Exit(1)
+		}
+	}
+	if *startTodString != "" || *endTodString != "" || len(windows) == 0 {
+		windows = append(windows, utils.TimeOfDayWindow{Start: startTod, End: endTod})
+	}
+
+	if *calendarPath != "" {
+		if calendar, err = utils.LoadCalendar(*calendarPath); err != nil {
+			errLog.Printf("[calendar] %s", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := setupSampler(*every, *per, *closestString, *count, *startString != "" && *endString != ""); err != nil {
+		errLog.Printf("[sample] %s", err)
+		os.Exit(1)
+	}
+	if sampler != nil {
+		sampler.Prefer = *prefer
+		sampler.Window = *sampleWindow
+		switch *prefer {
+		case utils.PreferQuality:
+			scoreQuality = true
+		case utils.PreferCentre, utils.PreferFirst:
+		default:
+			errLog.Printf("[sample] unknown -prefer %q", *prefer)
+			os.Exit(1)
+		}
 	}
 
 	// verify that root exists
@@ -213,17 +636,6 @@ func main() {
 					}
 					visit(img)
 				}
-				data := strings.Replace(scanner.Text(), "\n", "", -1)
-				if strings.HasPrefix(data, "[") {
-					errLog.Printf("[stdin] %s", data)
-					continue
-				} else {
-					img, err := utils.LoadImage(data)
-					if err != nil {
-						errLog.Printf("[load] %s", err)
-					}
-					visit(img)
-				}
 			}
 
 		} else {
@@ -244,7 +656,15 @@ func main() {
 			//}
 			//continue
 
-			utils.Handle(visit, os.RemoveAll, infmt)
+			utils.Handle(visit, deferCleanup, infmt)
 		}
 	}
+
+	// emit the images still buffered for sampling before temporary files are cleaned up
+	if sampler != nil {
+		sampler.Flush()
+	}
+	for _, tempDir := range cleanupPaths {
+		os.RemoveAll(tempDir)
+	}
 }
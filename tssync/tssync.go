@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/borevitzlab/go-timestreamtools/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	errLog        *log.Logger
+	sources       sourceList
+	outfmt, infmt string
+	streamFrom    string
+	synchroniser  utils.Synchroniser
+	cleanupPaths  []string
+)
+
+// sourceList is a flag of source directories that can be given more than once
+type sourceList []string
+
+func (s *sourceList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *sourceList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// streamName returns the stream an image is from, the stream and variant in its filename or the directory it is in.
+func streamName(img utils.Image) string {
+	if streamFrom == "name" {
+		if img.Stream == "" {
+			img.ParseName()
+		}
+		if name := img.StreamName(); name != "" {
+			return name
+		}
+	}
+	return filepath.Base(filepath.Dir(img.Path))
+}
+
+func visitWalk(filePath string, info os.FileInfo, _ error) error {
+	// skip directories
+	if info.IsDir() {
+		return nil
+	}
+	// sidecars follow their image through the pipeline
+	if utils.IsSidecar(filePath) {
+		return nil
+	}
+	img, err := utils.LoadImage(filePath)
+	img.OriginalPath = filePath
+	if err != nil {
+		errLog.Printf("[load] %s", err)
+	}
+	return visit(img)
+}
+
+func visit(img utils.Image) error {
+	if img.Timestamp.IsZero() {
+		errLog.Printf("[timestamp] no timestamp for %s", img.Path)
+		return nil
+	}
+	if _, ok := synchroniser.Alignment.Slot(img.Timestamp); !ok {
+		errLog.Printf("[tolerance] %s is more than %s from its slot", img.Path, synchroniser.Alignment.Tolerance)
+		return nil
+	}
+	synchroniser.Add(streamName(img), img)
+	return nil
+}
+
+// emit outputs a set, recording it in the provenance of each image.
+func emit(set utils.SyncSet) {
+	if outfmt != "path" {
+		for stream, img := range set.Images {
+			if provErr := utils.RecordProvenance(&img, img.Path, img.Data, "", nil); provErr != nil {
+				errLog.Printf("[provenance] %s", provErr)
+			}
+			set.Images[stream] = img
+		}
+	}
+	if !set.Complete {
+		errLog.Printf("[missing] %s has no image from %s", set.Slot.Format(time.RFC3339), strings.Join(set.Missing, ","))
+	}
+	utils.EmitSet(set, outfmt)
+}
+
+// deferCleanup holds on to temporary directories from upstream tools until buffered images have been emitted.
+func deferCleanup(tempDir string) error {
+	cleanupPaths = append(cleanupPaths, tempDir)
+	return nil
+}
+
+var usage = func() {
+	use := `
+usage of %s:
+
+	match up the images from the left and right DSLRs and the picam in a chamber every 5 minutes:
+		%s -source GC03L -source GC03R -source GC03-Picam -streams GC03L,GC03R,GC03-Picam -tolerance 1m
+	only the slots every camera has an image for, as paths for the next tool:
+		tsselect -source <source> -start 2018-04-01 | %s -streams GC03L,GC03R -complete -outfmt path
+
+flags:
+	-source: a <source> directory, can be given more than once (optional, default=stdin)
+	-streams: comma separated streams every set should have (default=every stream in the input, grouped at the end)
+	-stream-from: where the stream of an image comes from (choices: name,dir default=name)
+	  name is the stream and variant in the filename, ie GC03L from GC03L_2018_04_01_10_00_00_00.jpg, dir the directory it is in
+	-complete: drop sets that are missing a stream
+	-interval: set the interval to align to (optional, default=5m)
+	-mode: which slot to align an image to (choices: floor,nearest,ceil default=nearest)
+	-tolerance: drop images further than this from their slot, ie 1m (default=no limit)
+	-offset: how far after each interval the slots are (default=0)
+	-anchor: what the slots are counted from (choices: day,epoch default=day)
+	-times: align to these times of day instead of an interval, ie 06:00,12:00,18:00
+	-prefer: which image to keep when several from a stream align to the same slot (choices: centre,first default=centre)
+	-sample-window: how far out of order images can arrive, ie 10m (default=0)
+	-outfmt: output format (choices: json,msgpack,path default=json)
+	-infmt: input format (choices: json,msgpack,path default=path)
+
+slots are the same as tsalign. json and msgpack output has one record per slot:
+	{"slot": <time>, "images": {<stream>: <image>...}, "missing": [<stream>...], "complete": <bool>}
+path output has the paths of the images in each set, one per line.
+images are not copied or renamed, use tsalign or tsrename on the output for that.
+sets are emitted once every stream has moved past their slot, so a camera that stops holds them back until the end.
+`
+	fmt.Printf(use, os.Args[0], os.Args[0], os.Args[0])
+}
+
+func init() {
+	errLog = log.New(os.Stderr, "[tssync] ", log.Ldate|log.Ltime|log.Lshortfile)
+	flag.Usage = usage
+	// set flags for flagset
+	flag.Var(&sources, "source", "source directory")
+	flag.StringVar(&outfmt, "outfmt", "json", "output format")
+	flag.StringVar(&infmt, "infmt", "path", "input format")
+	streamsString := flag.String("streams", "", "comma separated streams")
+	flag.StringVar(&streamFrom, "stream-from", "name", "where the stream comes from (name, dir)")
+	flag.BoolVar(&synchroniser.DropIncomplete, "complete", false, "drop incomplete sets")
+	interval := flag.Duration("interval", time.Minute*5, "interval to align to")
+	mode := flag.String("mode", utils.AlignNearest, "slot to align to (floor, nearest, ceil)")
+	tolerance := flag.Duration("tolerance", 0, "furthest an image can be from its slot")
+	offset := flag.Duration("offset", 0, "how far after each interval the slots are")
+	anchor := flag.String("anchor", utils.AnchorDay, "what the slots are counted from (day, epoch)")
+	timesString := flag.String("times", "", "comma separated times of day to align to instead of an interval")
+	flag.StringVar(&synchroniser.Prefer, "prefer", utils.PreferCentre, "which image to keep for a slot")
+	flag.DurationVar(&synchroniser.Window, "sample-window", 0, "how far out of order images can arrive")
+	// parse the leading argument with normal flag.Parse
+	flag.Parse()
+
+	var err error
+	if *timesString != "" {
+		times, err := utils.ParseTimesOfDay(*timesString)
+		if err != nil {
+			errLog.Printf("[align] -times %s", err)
+			os.Exit(1)
+		}
+		synchroniser.Alignment, err = utils.NewTimesAlignment(times, *mode, *tolerance)
+	} else {
+		synchroniser.Alignment, err = utils.NewAlignment(*interval, *mode, *tolerance)
+	}
+	if err != nil {
+		errLog.Printf("%s", err)
+		os.Exit(1)
+	}
+	switch *anchor {
+	case utils.AnchorDay, utils.AnchorEpoch:
+	default:
+		errLog.Printf("[align] unknown -anchor %q (choices: day,epoch)", *anchor)
+		os.Exit(1)
+	}
+	synchroniser.Alignment.Offset = *offset
+	synchroniser.Alignment.Anchor = *anchor
+	switch synchroniser.Prefer {
+	case utils.PreferCentre, utils.PreferFirst:
+	default:
+		errLog.Printf("[sync] unknown -prefer %q (choices: centre,first)", synchroniser.Prefer)
+		os.Exit(1)
+	}
+	switch streamFrom {
+	case "name", "dir":
+	default:
+		errLog.Printf("[sync] unknown -stream-from %q (choices: name,dir)", streamFrom)
+		os.Exit(1)
+	}
+	if *streamsString != "" {
+		for _, stream := range strings.Split(*streamsString, ",") {
+			synchroniser.Streams = append(synchroniser.Streams, strings.TrimSpace(stream))
+		}
+	}
+	synchroniser.Emit = emit
+
+	// verify that the sources exist
+	for _, rootDir := range sources {
+		if _, err := os.Stat(rootDir); err != nil {
+			if os.IsNotExist(err) {
+				errLog.Printf("[path] <source> %s does not exist.", rootDir)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+func main() {
+	if len(sources) > 0 {
+		for _, rootDir := range sources {
+			if err := filepath.Walk(rootDir, visitWalk); err != nil {
+				errLog.Printf("[walk] %s", err)
+			}
+		}
+	} else if infmt == "path" {
+		// start scanner and wait for stdin
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			text := strings.Replace(scanner.Text(), "\n", "", -1)
+			if strings.HasPrefix(text, "[") {
+				errLog.Printf("[stdin] %s", text)
+				continue
+			} else if strings.HasPrefix(text, "#-") {
+				// was signalled deletion of previous tmpdir, wait until finished
+				deferCleanup(strings.TrimPrefix(text, "#-"))
+			} else {
+				img, err := utils.LoadImage(text)
+				if err != nil {
+					errLog.Printf("[load] %s", err)
+				}
+				visit(img)
+			}
+		}
+	} else {
+		utils.Handle(visit, deferCleanup, infmt)
+	}
+
+	synchroniser.Flush()
+	for _, tempDir := range cleanupPaths {
+		os.RemoveAll(tempDir)
+	}
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// AlignFloor aligns an image to the slot at or before it
+	AlignFloor = "floor"
+	// AlignNearest aligns an image to the closest slot
+	AlignNearest = "nearest"
+	// AlignCeil aligns an image to the slot at or after it
+	AlignCeil = "ceil"
+
+	// AnchorDay starts the slots again at midnight every day, so intervals that dont divide a day still line up
+	AnchorDay = "day"
+	// AnchorEpoch counts the slots from the zero time, so they carry on across midnight
+	AnchorEpoch = "epoch"
+)
+
+// Alignment maps timestamps onto slots every Interval, or at fixed Times of day.
+//
+// slots are Offset after multiples of the Interval (ie -offset 2m for a camera that fires at :02),
+// counted from midnight of each day (AnchorDay, the default) or from the zero time (AnchorEpoch).
+// intervals of a day or more are always counted from the zero time.
+// timestamps are wall clock time at the camera, so days are its local days.
+type Alignment struct {
+	Interval time.Duration
+	Mode     string
+	// Tolerance is how far an image can be from its slot, zero for no limit
+	Tolerance time.Duration
+	Offset    time.Duration
+	Anchor    string
+	// Times are offsets from midnight to use as the slots instead of the interval, in order
+	Times []time.Duration
+}
+
+// NewAlignment checks the interval and mode, an empty mode is AlignFloor.
+func NewAlignment(interval time.Duration, mode string, tolerance time.Duration) (Alignment, error) {
+	if interval <= 0 {
+		return Alignment{}, fmt.Errorf("[align] interval must be positive")
+	}
+	if tolerance < 0 {
+		return Alignment{}, fmt.Errorf("[align] tolerance cant be negative")
+	}
+	switch mode {
+	case "":
+		mode = AlignFloor
+	case AlignFloor, AlignNearest, AlignCeil:
+	default:
+		return Alignment{}, fmt.Errorf("[align] unknown mode %q (choices: %s,%s,%s)", mode, AlignFloor, AlignNearest, AlignCeil)
+	}
+	return Alignment{Interval: interval, Mode: mode, Tolerance: tolerance}, nil
+}
+
+// NewTimesAlignment aligns to fixed times of day, ie 06:00, 12:00 and 18:00.
+func NewTimesAlignment(times []time.Duration, mode string, tolerance time.Duration) (Alignment, error) {
+	if len(times) == 0 {
+		return Alignment{}, fmt.Errorf("[align] no times of day")
+	}
+	sorted := append([]time.Duration(nil), times...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, tod := range sorted {
+		if tod < 0 || tod >= 24*time.Hour {
+			return Alignment{}, fmt.Errorf("[align] time of day %s isnt within the day", tod)
+		}
+		if i > 0 && tod == sorted[i-1] {
+			return Alignment{}, fmt.Errorf("[align] time of day %s given twice", tod)
+		}
+	}
+	// the interval is only used to check it
+	a, err := NewAlignment(time.Hour, mode, tolerance)
+	a.Times = sorted
+	return a, err
+}
+
+// neighbours returns the slots at or before and at or after t, which are the same if t is on a slot.
+func (a Alignment) neighbours(t time.Time) (floor, ceil time.Time) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if len(a.Times) > 0 {
+		tod := t.Sub(day)
+		floor = day.AddDate(0, 0, -1).Add(a.Times[len(a.Times)-1])
+		ceil = day.AddDate(0, 0, 1).Add(a.Times[0])
+		for _, slot := range a.Times {
+			if slot <= tod {
+				floor = day.Add(slot)
+			}
+			if slot >= tod {
+				ceil = day.Add(slot)
+				break
+			}
+		}
+		return
+	}
+
+	// the phase of the slots within the interval
+	phase := a.Offset % a.Interval
+	if phase < 0 {
+		phase += a.Interval
+	}
+	if a.Anchor == AnchorEpoch || a.Interval >= 24*time.Hour {
+		floor = t.Add(-phase).Truncate(a.Interval).Add(phase)
+	} else {
+		last := phase + (24*time.Hour-1-phase)/a.Interval*a.Interval
+		since := t.Sub(day) - phase
+		if since < 0 {
+			// before the first slot of the day
+			return day.AddDate(0, 0, -1).Add(last), day.Add(phase)
+		}
+		floor = day.Add(phase + since/a.Interval*a.Interval)
+		if !floor.Equal(t) && floor.Sub(day) == last {
+			// after the last slot of the day
+			return floor, day.AddDate(0, 0, 1).Add(phase)
+		}
+	}
+	ceil = floor
+	if floor.Before(t) {
+		ceil = floor.Add(a.Interval)
+	}
+	return
+}
+
+// Slot returns the slot t aligns to, and false if it is further than Tolerance from it.
+// in AlignNearest mode an image exactly between two slots aligns to the later one.
+func (a Alignment) Slot(t time.Time) (time.Time, bool) {
+	floor, ceil := a.neighbours(t)
+	slot := floor
+	switch a.Mode {
+	case AlignNearest:
+		if ceil.Sub(t) <= t.Sub(floor) {
+			slot = ceil
+		}
+	case AlignCeil:
+		slot = ceil
+	}
+	if a.Tolerance > 0 {
+		d := t.Sub(slot)
+		if d < 0 {
+			d = -d
+		}
+		if d > a.Tolerance {
+			return slot, false
+		}
+	}
+	return slot, true
+}
+
+// NewAlignedSampler keeps the best image for each slot of an alignment, the closest to the slot time by default.
+// images that are out of tolerance should be dropped before they are added.
+func NewAlignedSampler(a Alignment, emit func(Image)) *Sampler {
+	return &Sampler{Emit: emit, slot: func(t time.Time) (time.Time, time.Time) {
+		slot, _ := a.Slot(t)
+		return slot, slot
+	}}
+}
+
+// Between returns the slots strictly between after and before, in order.
+func (a Alignment) Between(after, before time.Time) (slots []time.Time) {
+	for slot := a.next(after); slot.Before(before); slot = a.next(slot) {
+		slots = append(slots, slot)
+	}
+	return
+}
+
+// next returns the first slot after t.
+func (a Alignment) next(t time.Time) time.Time {
+	_, ceil := a.neighbours(t.Add(time.Nanosecond))
+	return ceil
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAlignmentSlot(t *testing.T) {
+	at := func(s string) time.Time { return wallClock("2018-04-01T" + s) }
+	for mode, expected := range map[string][]string{
+		AlignFloor:   {"10:05:00", "10:10:00", "10:10:00", "10:10:00"},
+		AlignNearest: {"10:10:00", "10:10:00", "10:10:00", "10:15:00"},
+		AlignCeil:    {"10:10:00", "10:10:00", "10:15:00", "10:15:00"},
+	} {
+		a, err := NewAlignment(5*time.Minute, mode, 0)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		for i, ts := range []string{"10:09:59", "10:10:00", "10:10:01", "10:12:30"} {
+			slot, ok := a.Slot(at(ts))
+			assert.True(t, ok)
+			assert.Equal(t, at(expected[i]), slot, "%s %s", mode, ts)
+		}
+	}
+
+	a, _ := NewAlignment(5*time.Minute, AlignNearest, 30*time.Second)
+	_, ok := a.Slot(at("10:09:30"))
+	assert.True(t, ok)
+	_, ok = a.Slot(at("10:09:29"))
+	assert.False(t, ok)
+	_, ok = a.Slot(at("10:10:31"))
+	assert.False(t, ok)
+
+	a, err := NewAlignment(5*time.Minute, "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, AlignFloor, a.Mode)
+	_, err = NewAlignment(5*time.Minute, "round", 0)
+	assert.Error(t, err)
+	_, err = NewAlignment(0, AlignFloor, 0)
+	assert.Error(t, err)
+}
+
+func TestAlignedSampler(t *testing.T) {
+	a, _ := NewAlignment(5*time.Minute, AlignNearest, 0)
+	images := []Image{
+		{Path: "a", Timestamp: wallClock("2018-04-01T10:08:00")},
+		{Path: "b", Timestamp: wallClock("2018-04-01T10:09:59")},
+		{Path: "c", Timestamp: wallClock("2018-04-01T10:11:00")},
+		{Path: "d", Timestamp: wallClock("2018-04-01T10:14:00")},
+		// out of order within the window
+		{Path: "e", Timestamp: wallClock("2018-04-01T10:10:10")},
+	}
+	s := NewAlignedSampler(a, nil)
+	s.Window = 5 * time.Minute
+	assert.Equal(t, []string{"b", "d"}, runSampler(t, s, nil, images))
+
+	// the sharpest instead of the closest
+	images[2].Quality = &QualityScores{Sharpness: 10}
+	s = NewAlignedSampler(a, nil)
+	s.Prefer = PreferQuality
+	s.Window = 5 * time.Minute
+	assert.Equal(t, []string{"c", "d"}, runSampler(t, s, nil, images))
+}
+
+func TestAlignedSamplerOutOfOrder(t *testing.T) {
+	a, _ := NewAlignment(5*time.Minute, AlignFloor, 0)
+	// a merged input, with some images 15 minutes late
+	var images []Image
+	for _, ts := range []string{"10:00", "10:10", "10:20", "10:05", "10:30", "10:15", "10:25"} {
+		images = append(images, Image{Path: ts, Timestamp: wallClock("2018-04-01T" + ts + ":00")})
+	}
+	// the tsalign default window keeps them all, in slot order
+	s := NewAlignedSampler(a, nil)
+	s.Window = time.Hour
+	assert.Equal(t, []string{"10:00", "10:05", "10:10", "10:15", "10:20", "10:25", "10:30"}, runSampler(t, s, nil, images))
+
+	// without a window the images after a slot that was already written are dropped
+	s = NewAlignedSampler(a, nil)
+	assert.Equal(t, []string{"10:00", "10:10", "10:20", "10:25", "10:30"}, runSampler(t, s, nil, images))
+}
+
+func TestAlignmentOffsetAndAnchor(t *testing.T) {
+	// a camera that fires 2 minutes past every 5
+	a, _ := NewAlignment(5*time.Minute, AlignNearest, 0)
+	a.Offset = 2 * time.Minute
+	slot, _ := a.Slot(wallClock("2018-04-01T10:06:50"))
+	assert.Equal(t, wallClock("2018-04-01T10:07:00"), slot)
+	a.Mode = AlignFloor
+	slot, _ = a.Slot(wallClock("2018-04-01T10:01:00"))
+	assert.Equal(t, wallClock("2018-04-01T09:57:00"), slot)
+
+	// 7 minutes doesnt divide a day, so each day starts again at midnight
+	a, _ = NewAlignment(7*time.Minute, AlignFloor, 0)
+	slot, _ = a.Slot(wallClock("2018-04-02T00:08:00"))
+	assert.Equal(t, wallClock("2018-04-02T00:07:00"), slot)
+	slot, _ = a.Slot(wallClock("2018-04-01T23:59:00"))
+	assert.Equal(t, wallClock("2018-04-01T23:55:00"), slot)
+	a.Mode = AlignCeil
+	slot, _ = a.Slot(wallClock("2018-04-01T23:56:00"))
+	assert.Equal(t, wallClock("2018-04-02T00:00:00"), slot)
+	a.Mode = AlignNearest
+	slot, _ = a.Slot(wallClock("2018-04-01T23:58:00"))
+	assert.Equal(t, wallClock("2018-04-02T00:00:00"), slot)
+
+	// counted from the zero time instead the slots carry on across midnight
+	a.Anchor = AnchorEpoch
+	a.Mode = AlignFloor
+	slot, _ = a.Slot(wallClock("2018-04-03T00:08:00"))
+	assert.Equal(t, wallClock("2018-04-03T00:02:00"), slot)
+	a.Anchor = AnchorDay
+	slot, _ = a.Slot(wallClock("2018-04-03T00:08:00"))
+	assert.Equal(t, wallClock("2018-04-03T00:07:00"), slot)
+}
+
+func TestTimesAlignment(t *testing.T) {
+	times := []time.Duration{18 * time.Hour, 6 * time.Hour, 12 * time.Hour}
+	a, err := NewTimesAlignment(times, AlignNearest, time.Hour)
+	assert.NoError(t, err)
+
+	slot, ok := a.Slot(wallClock("2018-04-01T12:20:00"))
+	assert.True(t, ok)
+	assert.Equal(t, wallClock("2018-04-01T12:00:00"), slot)
+	_, ok = a.Slot(wallClock("2018-04-01T09:00:00"))
+	assert.False(t, ok)
+
+	a.Tolerance = 0
+	slot, _ = a.Slot(wallClock("2018-04-02T01:00:00"))
+	assert.Equal(t, wallClock("2018-04-02T06:00:00"), slot)
+	a.Mode = AlignFloor
+	slot, _ = a.Slot(wallClock("2018-04-02T05:00:00"))
+	assert.Equal(t, wallClock("2018-04-01T18:00:00"), slot)
+
+	_, err = NewTimesAlignment(nil, AlignFloor, 0)
+	assert.Error(t, err)
+	_, err = NewTimesAlignment([]time.Duration{6 * time.Hour, 6 * time.Hour}, AlignFloor, 0)
+	assert.Error(t, err)
+}
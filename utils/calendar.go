@@ -0,0 +1,300 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// TimeOfDayWindow is a window of time repeated every day, as offsets from midnight.
+// windows where End is before Start wrap midnight, ie 20:00-04:00.
+type TimeOfDayWindow struct {
+	Start, End time.Duration
+}
+
+// TimeOfDay returns the offset of t from its midnight.
+func TimeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+}
+
+// ParseTimeOfDay parses a time of day as HH:MM or HH:MM:SS into an offset from midnight.
+func ParseTimeOfDay(value string) (time.Duration, error) {
+	for _, form := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(form, strings.TrimSpace(value)); err == nil {
+			return TimeOfDay(t), nil
+		}
+	}
+	return 0, fmt.Errorf("couldn't parse time of day %q, use HH:MM or HH:MM:SS", value)
+}
+
+// ParseTimesOfDay parses a comma separated list of times of day, ie 06:00,12:00,18:00.
+func ParseTimesOfDay(value string) ([]time.Duration, error) {
+	var times []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		tod, err := ParseTimeOfDay(part)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, tod)
+	}
+	return times, nil
+}
+
+// ParseTimeOfDayWindow parses a window as <start>-<end>, ie 08:00-17:00 or 20:00-04:00.
+func ParseTimeOfDayWindow(value string) (w TimeOfDayWindow, err error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return w, fmt.Errorf("couldn't parse window %q, use HH:MM-HH:MM", value)
+	}
+	if w.Start, err = ParseTimeOfDay(parts[0]); err != nil {
+		return
+	}
+	w.End, err = ParseTimeOfDay(parts[1])
+	return
+}
+
+// TimeOfDayWindows is a flag of time of day windows that can be given more than once.
+type TimeOfDayWindows []TimeOfDayWindow
+
+func (w *TimeOfDayWindows) String() string {
+	var s []string
+	for _, window := range *w {
+		s = append(s, window.String())
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses and adds a window.
+func (w *TimeOfDayWindows) Set(value string) error {
+	window, err := ParseTimeOfDayWindow(value)
+	if err != nil {
+		return err
+	}
+	*w = append(*w, window)
+	return nil
+}
+
+// Contains returns true if the time of day of t is within the window, including both ends.
+func (w TimeOfDayWindow) Contains(t time.Time) bool {
+	tod := TimeOfDay(t)
+	if w.Start <= w.End {
+		return tod >= w.Start && tod <= w.End
+	}
+	return tod >= w.Start || tod <= w.End
+}
+
+// String formats the window as HH:MM:SS-HH:MM:SS
+func (w TimeOfDayWindow) String() string {
+	format := func(d time.Duration) string {
+		return time.Time{}.Add(d).Format("15:04:05")
+	}
+	return format(w.Start) + "-" + format(w.End)
+}
+
+const (
+	ruleRange   = "range"
+	ruleWeekday = "weekday"
+	ruleDaily   = "daily"
+)
+
+// calendarRule is a single include or exclude line of a calendar.
+type calendarRule struct {
+	include    bool
+	kind       string
+	start, end time.Time
+	weekdays   [7]bool
+	window     TimeOfDayWindow
+}
+
+func (r calendarRule) matches(t time.Time) bool {
+	switch r.kind {
+	case ruleRange:
+		return !t.Before(r.start) && t.Before(r.end)
+	case ruleWeekday:
+		return r.weekdays[t.Weekday()]
+	}
+	return r.window.Contains(t)
+}
+
+// Calendar selects times by include and exclude rules, see ParseCalendar.
+type Calendar struct {
+	rules []calendarRule
+}
+
+// calendarDateForms are the forms dates and datetimes can take in a calendar, all are wall clock UTC like timestamps.
+var calendarDateForms = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// parseCalendarDate parses a date or datetime, returning whether it was only a date.
+func parseCalendarDate(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	for _, form := range calendarDateForms {
+		if t, err := time.Parse(form, value); err == nil {
+			return t, form == "2006-01-02", nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("couldn't parse date %q, use YYYY-MM-DD or YYYY-MM-DDTHH:MM", value)
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWeekday parses a weekday name, full or abbreviated to 3 letters.
+func parseWeekday(value string) (time.Weekday, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if len(value) >= 3 {
+		if day, ok := weekdayNames[value[:3]]; ok && strings.HasPrefix(strings.ToLower(day.String()), value) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", value)
+}
+
+// parseWeekdays parses a comma separated list of weekdays and ranges of weekdays, ie mon-fri,sun
+func parseWeekdays(value string) (days [7]bool, err error) {
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		var first, last time.Weekday
+		if first, err = parseWeekday(bounds[0]); err != nil {
+			return
+		}
+		last = first
+		if len(bounds) == 2 {
+			if last, err = parseWeekday(bounds[1]); err != nil {
+				return
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return
+}
+
+// parseCalendarRule parses a single line of a calendar.
+func parseCalendarRule(line string) (rule calendarRule, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return rule, fmt.Errorf("expected include or exclude and a rule")
+	}
+	switch fields[0] {
+	case "include":
+		rule.include = true
+	case "exclude":
+	default:
+		return rule, fmt.Errorf("expected include or exclude, got %q", fields[0])
+	}
+
+	switch fields[1] {
+	case ruleWeekday:
+		if len(fields) != 3 {
+			return rule, fmt.Errorf("expected weekday <days>")
+		}
+		rule.kind = ruleWeekday
+		rule.weekdays, err = parseWeekdays(fields[2])
+	case ruleDaily:
+		if len(fields) != 3 {
+			return rule, fmt.Errorf("expected daily <HH:MM-HH:MM>")
+		}
+		rule.kind = ruleDaily
+		rule.window, err = ParseTimeOfDayWindow(fields[2])
+	default:
+		if len(fields) > 3 {
+			return rule, fmt.Errorf("expected <date> [<date>]")
+		}
+		rule.kind = ruleRange
+		var dateOnly bool
+		if rule.start, dateOnly, err = parseCalendarDate(fields[1]); err != nil {
+			return
+		}
+		rule.end = rule.start
+		if len(fields) == 3 {
+			if rule.end, dateOnly, err = parseCalendarDate(fields[2]); err != nil {
+				return
+			}
+		}
+		if dateOnly {
+			// dates include the whole of the last day
+			rule.end = rule.end.AddDate(0, 0, 1)
+		}
+		if !rule.end.After(rule.start) {
+			return rule, fmt.Errorf("range ends before it starts")
+		}
+	}
+	return
+}
+
+// ParseCalendar reads a calendar, one rule per line with # comments:
+//
+//	include|exclude <date> [<date>]       a date range, dates include the whole day and datetimes are exclusive ends
+//	include|exclude weekday <days>        ie mon-fri or sat,sun
+//	include|exclude daily <HH:MM-HH:MM>   a window every day, which can wrap midnight
+//
+// a time is selected if it matches at least one include rule of each kind that has include rules,
+// and no exclude rules.
+func ParseCalendar(r io.Reader) (*Calendar, error) {
+	c := &Calendar{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := parseCalendarRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("[calendar] line %d: %s", n, err)
+		}
+		c.rules = append(c.rules, rule)
+	}
+	return c, scanner.Err()
+}
+
+// LoadCalendar reads a calendar file, see ParseCalendar.
+func LoadCalendar(calendarPath string) (*Calendar, error) {
+	file, err := os.Open(calendarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseCalendar(file)
+}
+
+// Contains returns true if the calendar selects t.
+func (c *Calendar) Contains(t time.Time) bool {
+	if c == nil {
+		return true
+	}
+	hasInclude := map[string]bool{}
+	included := map[string]bool{}
+	for _, rule := range c.rules {
+		if !rule.include {
+			if rule.matches(t) {
+				return false
+			}
+			continue
+		}
+		hasInclude[rule.kind] = true
+		if rule.matches(t) {
+			included[rule.kind] = true
+		}
+	}
+	for kind := range hasInclude {
+		if !included[kind] {
+			return false
+		}
+	}
+	return true
+}
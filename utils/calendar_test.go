@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeOfDayWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2018, 4, 1, hour, minute, 0, 0, time.UTC)
+	}
+	day, err := ParseTimeOfDayWindow("08:00-17:00")
+	assert.NoError(t, err)
+	assert.True(t, day.Contains(at(8, 0)))
+	assert.True(t, day.Contains(at(17, 0)))
+	assert.False(t, day.Contains(at(17, 1)))
+	assert.False(t, day.Contains(at(7, 59)))
+
+	night, err := ParseTimeOfDayWindow("20:00-04:00")
+	assert.NoError(t, err)
+	assert.True(t, night.Contains(at(23, 30)))
+	assert.True(t, night.Contains(at(0, 0)))
+	assert.True(t, night.Contains(at(4, 0)))
+	assert.False(t, night.Contains(at(12, 0)))
+	assert.False(t, night.Contains(at(19, 59)))
+	assert.Equal(t, "20:00:00-04:00:00", night.String())
+
+	for _, bad := range []string{"08:00", "8-17", "08:00-25:00", "a-b"} {
+		_, err = ParseTimeOfDayWindow(bad)
+		assert.Error(t, err, bad)
+	}
+
+	var windows TimeOfDayWindows
+	assert.NoError(t, windows.Set("08:00-17:00"))
+	assert.NoError(t, windows.Set("20:00-04:00"))
+	assert.Error(t, windows.Set("08:00"))
+	assert.Equal(t, []TimeOfDayWindow{day, night}, []TimeOfDayWindow(windows))
+	assert.Equal(t, "08:00:00-17:00:00,20:00:00-04:00:00", windows.String())
+}
+
+const testCalendar = `
+# trial dates
+include 2018-04-01 2018-04-30
+# lights on
+include daily 06:00-20:00
+exclude weekday sun
+# watering
+exclude daily 12:00-12:30
+# chamber cleaning
+exclude 2018-04-10T08:00 2018-04-10T11:00
+exclude 2018-04-20
+`
+
+func TestCalendar(t *testing.T) {
+	c, err := ParseCalendar(strings.NewReader(testCalendar))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for datetime, expected := range map[string]bool{
+		"2018-04-02T10:00:00Z": true,
+		"2018-03-31T10:00:00Z": false, // before the trial
+		"2018-04-30T10:00:00Z": true,  // dates include the whole last day
+		"2018-05-01T10:00:00Z": false,
+		"2018-04-02T05:00:00Z": false, // lights off
+		"2018-04-01T10:00:00Z": false, // sunday
+		"2018-04-02T12:15:00Z": false, // watering
+		"2018-04-10T08:00:00Z": false, // cleaning
+		"2018-04-10T11:00:00Z": true,  // datetime ranges are exclusive of the end
+		"2018-04-20T15:00:00Z": false,
+	} {
+		tm, _ := time.Parse(time.RFC3339, datetime)
+		assert.Equal(t, expected, c.Contains(tm), datetime)
+	}
+
+	var nilCalendar *Calendar
+	assert.True(t, nilCalendar.Contains(time.Now()))
+
+	weekdays, err := parseWeekdays("fri-mon,wednesday")
+	assert.NoError(t, err)
+	assert.Equal(t, [7]bool{true, true, false, true, false, true, true}, weekdays)
+
+	for _, bad := range []string{
+		"include",
+		"maybe 2018-04-01",
+		"exclude weekday someday",
+		"exclude daily 12:00",
+		"exclude 2018-04-02 2018-04-01",
+		"exclude 01/04/2018",
+	} {
+		_, err := ParseCalendar(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,275 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ReferenceExif uses the exif DateTime as the reference clock
+	ReferenceExif = "exif"
+	// ReferenceMtime uses the modification time of the file as the reference clock, which is when it was uploaded
+	ReferenceMtime = "mtime"
+	// ReferenceEvents uses a file of known events, see LoadClockEvents
+	ReferenceEvents = "events"
+)
+
+// ClockSample pairs the time the camera clock gave to a moment with the time a reference clock gave it.
+type ClockSample struct {
+	Camera, Reference time.Time
+}
+
+// residual is how far the camera clock is behind the reference, in seconds.
+func (s ClockSample) residual() float64 {
+	return s.Reference.Sub(s.Camera).Seconds()
+}
+
+// ClockSegment is a run of images between clock steps, over which the camera clock is a fixed offset plus a linear drift
+// from the reference. Start and End are the first and last sample in camera time.
+type ClockSegment struct {
+	Start              time.Time `json:"start"`
+	End                time.Time `json:"end"`
+	OffsetSeconds      float64   `json:"offsetSeconds"`
+	DriftSecondsPerDay float64   `json:"driftSecondsPerDay"`
+	Samples            int       `json:"samples"`
+}
+
+// Correction returns how much to add to the camera time t.
+func (seg ClockSegment) Correction(t time.Time) time.Duration {
+	days := t.Sub(seg.Start).Hours() / 24
+	return time.Duration((seg.OffsetSeconds + seg.DriftSecondsPerDay*days) * float64(time.Second))
+}
+
+// ClockModel is a piecewise model of a camera clock against a reference, saved as json so it can be reviewed and reused.
+// segments are in reference time order.
+type ClockModel struct {
+	Reference string         `json:"reference"`
+	Created   time.Time      `json:"created"`
+	Outliers  int            `json:"outliers"`
+	Segments  []ClockSegment `json:"segments"`
+}
+
+// segment returns the segment for the camera time t. when segments overlap (the clock stepped backwards) the one
+// that puts t closest to the reference is used if there is a reference, otherwise the first.
+// times outside every segment use the nearest one.
+func (m *ClockModel) segment(t, reference time.Time) (ClockSegment, bool) {
+	if len(m.Segments) == 0 {
+		return ClockSegment{}, false
+	}
+	var best ClockSegment
+	found := false
+	bestDistance := time.Duration(math.MaxInt64)
+	for _, seg := range m.Segments {
+		if t.Before(seg.Start) || t.After(seg.End) {
+			continue
+		}
+		distance := time.Duration(0)
+		if !reference.IsZero() {
+			distance = absDuration(t.Add(seg.Correction(t)).Sub(reference))
+		}
+		if !found || distance < bestDistance {
+			best, bestDistance, found = seg, distance, true
+		}
+	}
+	if found {
+		return best, true
+	}
+	bestDistance = time.Duration(math.MaxInt64)
+	for _, seg := range m.Segments {
+		distance := absDuration(t.Sub(seg.Start))
+		if d := absDuration(t.Sub(seg.End)); d < distance {
+			distance = d
+		}
+		if distance < bestDistance {
+			best, bestDistance = seg, distance
+		}
+	}
+	return best, true
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Correct returns the corrected time for the camera time t, reference is used to choose between overlapping segments
+// and can be zero.
+func (m *ClockModel) Correct(t, reference time.Time) time.Time {
+	seg, ok := m.segment(t, reference)
+	if !ok {
+		return t
+	}
+	return t.Add(seg.Correction(t))
+}
+
+// SaveClockModel writes a model as indented json.
+func SaveClockModel(m *ClockModel, modelPath string) error {
+	byt, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(modelPath, byt, os.FileMode(OsUserRW|OsGroupRW))
+}
+
+// LoadClockModel reads a model written by SaveClockModel.
+func LoadClockModel(modelPath string) (*ClockModel, error) {
+	byt, err := ioutil.ReadFile(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	m := &ClockModel{}
+	if err := json.Unmarshal(byt, m); err != nil {
+		return nil, fmt.Errorf("[clock] couldn't read model %s: %s", modelPath, err)
+	}
+	return m, nil
+}
+
+// LoadClockEvents reads known reference events, one per line with # comments:
+//
+//	<camera time> <reference time>
+//
+// ie the image the lights came on in was stamped 2018-04-01T05:43:10 and they came on at 2018-04-01T06:00:00.
+// times are in the forms of ParseAbsoluteTime.
+func LoadClockEvents(eventsPath string) ([]ClockSample, error) {
+	file, err := os.Open(eventsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var samples []ClockSample
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("[clock] %s line %d: expected <camera time> <reference time>", eventsPath, n)
+		}
+		var s ClockSample
+		if s.Camera, err = ParseAbsoluteTime(fields[0]); err == nil {
+			s.Reference, err = ParseAbsoluteTime(fields[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[clock] %s line %d: %s", eventsPath, n, err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// ClockFitter fits a ClockModel to samples of the camera clock against a reference.
+//
+// samples are put in reference order, and a new segment starts where the offset steps by more than Step from the
+// offsets before it and the next sample agrees with the new offset. a single sample that disagrees with both sides
+// is an outlier and is ignored. each segment has a median offset, or if Drift is set and the segment covers at least
+// MinDriftSpan of reference time, a least squares offset and drift.
+type ClockFitter struct {
+	Reference    string
+	Step         time.Duration
+	Drift        bool
+	MinDriftSpan time.Duration
+
+	samples []ClockSample
+}
+
+// Add adds a sample.
+func (f *ClockFitter) Add(s ClockSample) {
+	f.samples = append(f.samples, s)
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	if len(sorted)%2 == 1 {
+		return sorted[len(sorted)/2]
+	}
+	return (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+}
+
+// fitSegment fits the offset and drift of one run of samples.
+func (f *ClockFitter) fitSegment(samples []ClockSample) ClockSegment {
+	seg := ClockSegment{Start: samples[0].Camera, End: samples[0].Camera, Samples: len(samples)}
+	residuals := make([]float64, len(samples))
+	for i, s := range samples {
+		residuals[i] = s.residual()
+		if s.Camera.Before(seg.Start) {
+			seg.Start = s.Camera
+		}
+		if s.Camera.After(seg.End) {
+			seg.End = s.Camera
+		}
+	}
+	seg.OffsetSeconds = median(residuals)
+
+	span := samples[len(samples)-1].Reference.Sub(samples[0].Reference)
+	if !f.Drift || len(samples) < 3 || span < f.MinDriftSpan {
+		return seg
+	}
+	var sumX, sumY, sumXX, sumXY float64
+	for i, s := range samples {
+		x := s.Camera.Sub(seg.Start).Hours() / 24
+		sumX += x
+		sumY += residuals[i]
+		sumXX += x * x
+		sumXY += x * residuals[i]
+	}
+	n := float64(len(samples))
+	if denominator := n*sumXX - sumX*sumX; denominator != 0 {
+		seg.DriftSecondsPerDay = (n*sumXY - sumX*sumY) / denominator
+		seg.OffsetSeconds = (sumY - seg.DriftSecondsPerDay*sumX) / n
+	}
+	return seg
+}
+
+// Fit fits the model to the samples added so far.
+func (f *ClockFitter) Fit() (*ClockModel, error) {
+	if len(f.samples) == 0 {
+		return nil, fmt.Errorf("[clock] no samples to fit")
+	}
+	step := f.Step.Seconds()
+	if step <= 0 {
+		return nil, fmt.Errorf("[clock] step must be positive")
+	}
+	samples := append([]ClockSample(nil), f.samples...)
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Reference.Before(samples[j].Reference) })
+
+	model := &ClockModel{Reference: f.Reference, Created: time.Now().UTC()}
+	var current []ClockSample
+	// level is the offset of the recent samples in the current segment
+	level := func() float64 {
+		var recent []float64
+		for i := len(current) - 1; i >= 0 && len(recent) < 5; i-- {
+			recent = append(recent, current[i].residual())
+		}
+		return median(recent)
+	}
+	for i, s := range samples {
+		if len(current) == 0 || math.Abs(s.residual()-level()) <= step {
+			current = append(current, s)
+			continue
+		}
+		if i+1 < len(samples) && math.Abs(samples[i+1].residual()-s.residual()) <= step {
+			// the clock stepped
+			model.Segments = append(model.Segments, f.fitSegment(current))
+			current = []ClockSample{s}
+			continue
+		}
+		model.Outliers++
+	}
+	model.Segments = append(model.Segments, f.fitSegment(current))
+	return model, nil
+}
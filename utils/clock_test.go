@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// clockSamples returns n samples interval apart from camera, with the reference offset ahead and drifting by
+// drift per day.
+func clockSamples(camera time.Time, offset, drift time.Duration, interval time.Duration, n int) []ClockSample {
+	var samples []ClockSample
+	for i := 0; i < n; i++ {
+		c := camera.Add(time.Duration(i) * interval)
+		days := float64(c.Sub(camera)) / float64(24*time.Hour)
+		samples = append(samples, ClockSample{Camera: c, Reference: c.Add(offset + time.Duration(days*float64(drift)))})
+	}
+	return samples
+}
+
+func fit(t *testing.T, f *ClockFitter, samples ...[]ClockSample) *ClockModel {
+	for _, run := range samples {
+		for _, s := range run {
+			f.Add(s)
+		}
+	}
+	model, err := f.Fit()
+	assert.NoError(t, err)
+	return model
+}
+
+func TestClockStep(t *testing.T) {
+	// a picam booted without a clock, then ntp set it
+	epoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	booted := wallClock("2018-04-01T06:00:00")
+	before := clockSamples(epoch, booted.Sub(epoch), 0, 5*time.Minute, 12)
+	after := clockSamples(booted.Add(time.Hour), 0, 0, 5*time.Minute, 12)
+	// an upload that was held up
+	after[5].Reference = after[5].Reference.Add(20 * time.Minute)
+
+	model := fit(t, &ClockFitter{Step: 5 * time.Minute}, before, after)
+	assert.Equal(t, 1, model.Outliers)
+	if assert.Len(t, model.Segments, 2) {
+		assert.Equal(t, epoch, model.Segments[0].Start)
+		assert.Equal(t, epoch.Add(55*time.Minute), model.Segments[0].End)
+		assert.Equal(t, 12, model.Segments[0].Samples)
+		assert.Equal(t, 11, model.Segments[1].Samples)
+		assert.InDelta(t, 0, model.Segments[1].OffsetSeconds, 1e-6)
+	}
+	assert.Equal(t, booted.Add(10*time.Minute), model.Correct(epoch.Add(10*time.Minute), time.Time{}))
+	assert.Equal(t, booted.Add(2*time.Hour), model.Correct(booted.Add(2*time.Hour), time.Time{}))
+}
+
+func TestClockDrift(t *testing.T) {
+	// a clock 30s behind losing 2s a day, sampled hourly for 10 days
+	start := wallClock("2018-04-01T00:00:00")
+	samples := clockSamples(start, 30*time.Second, 2*time.Second, time.Hour, 240)
+
+	model := fit(t, &ClockFitter{Step: time.Minute, Drift: true, MinDriftSpan: 24 * time.Hour}, samples)
+	if assert.Len(t, model.Segments, 1) {
+		assert.InDelta(t, 30, model.Segments[0].OffsetSeconds, 1e-3)
+		assert.InDelta(t, 2, model.Segments[0].DriftSecondsPerDay, 1e-3)
+	}
+	corrected := model.Correct(start.Add(5*24*time.Hour), time.Time{})
+	assert.InDelta(t, 0, corrected.Sub(start.Add(5*24*time.Hour+40*time.Second)).Seconds(), 1e-3)
+
+	// too short to fit a drift, so just the median offset
+	model = fit(t, &ClockFitter{Step: time.Minute, Drift: true, MinDriftSpan: 30 * 24 * time.Hour}, samples)
+	assert.Equal(t, 0.0, model.Segments[0].DriftSecondsPerDay)
+	assert.InDelta(t, 40, model.Segments[0].OffsetSeconds, 1)
+}
+
+func TestClockBackwardsStep(t *testing.T) {
+	// a clock an hour fast was stepped back, so camera times repeat
+	start := wallClock("2018-04-01T06:00:00")
+	fast := clockSamples(start.Add(time.Hour), -time.Hour, 0, 5*time.Minute, 24)
+	fixed := clockSamples(start.Add(2*time.Hour), 0, 0, 5*time.Minute, 24)
+	model := fit(t, &ClockFitter{Step: 5 * time.Minute}, fast, fixed)
+	if !assert.Len(t, model.Segments, 2) {
+		return
+	}
+	repeated := start.Add(2*time.Hour + 30*time.Minute)
+	// the reference chooses between the overlapping segments
+	assert.Equal(t, repeated.Add(-time.Hour), model.Correct(repeated, repeated.Add(-time.Hour+time.Minute)))
+	assert.Equal(t, repeated, model.Correct(repeated, repeated.Add(time.Minute)))
+	// without one the first is used
+	assert.Equal(t, repeated.Add(-time.Hour), model.Correct(repeated, time.Time{}))
+	// outside every segment the nearest is used
+	assert.Equal(t, start.Add(10*time.Hour), model.Correct(start.Add(10*time.Hour), time.Time{}))
+}
+
+func TestClockModelFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clock")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	eventsPath := filepath.Join(dir, "events.txt")
+	ioutil.WriteFile(eventsPath, []byte("# lights on\n2018-04-01T05:43:10 2018-04-01T06:00:00\n\n2018-04-02T05:43:30 2018-04-02T06:00:00 # next day\n"), 0644)
+	samples, err := LoadClockEvents(eventsPath)
+	assert.NoError(t, err)
+	assert.Len(t, samples, 2)
+
+	model := fit(t, &ClockFitter{Reference: ReferenceEvents, Step: time.Minute}, samples)
+	modelPath := filepath.Join(dir, "clock.json")
+	assert.NoError(t, SaveClockModel(model, modelPath))
+	loaded, err := LoadClockModel(modelPath)
+	assert.NoError(t, err)
+	assert.Equal(t, ReferenceEvents, loaded.Reference)
+	assert.Equal(t, model.Segments, loaded.Segments)
+
+	ioutil.WriteFile(eventsPath, []byte("2018-04-01T05:43:10\n"), 0644)
+	_, err = LoadClockEvents(eventsPath)
+	assert.Error(t, err)
+}
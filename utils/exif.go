@@ -0,0 +1,695 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/rwcarlsen/goexif/exif"
+	"hash/crc32"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	tagDateTime         = 0x0132
+	tagXMP              = 0x02BC
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagImageHistory     = 0x9213
+	tagUserComment      = 0x9286
+	tagPixelXDimension  = 0xA002
+	tagPixelYDimension  = 0xA003
+	tagInteropIFD       = 0xA005
+
+	tiffByte      = 1
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffUndefined = 7
+
+	// maximum size of a jpeg segment payload, minus the 2 byte length
+	maxJpegSegment = 0xFFFF - 2
+	// how deep to follow sub ifd pointers, guards against loops in broken exif
+	maxIfdDepth = 4
+)
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegXMPHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+	pngXMPKeyword  = []byte("XML:com.adobe.xmp\x00")
+
+	// tiffTypeSizes are the sizes in bytes of each tiff data type
+	tiffTypeSizes = map[uint16]uint32{
+		1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+	}
+
+	// structuralTags describe the layout of the pixel data of an image rather than the image itself
+	// they are never copied from one image to another.
+	structuralTags = map[uint16]bool{
+		0x00FE: true, // NewSubfileType
+		0x00FF: true, // SubfileType
+		0x0100: true, // ImageWidth
+		0x0101: true, // ImageLength
+		0x0102: true, // BitsPerSample
+		0x0103: true, // Compression
+		0x0106: true, // PhotometricInterpretation
+		0x0111: true, // StripOffsets
+		0x0115: true, // SamplesPerPixel
+		0x0116: true, // RowsPerStrip
+		0x0117: true, // StripByteCounts
+		0x011C: true, // PlanarConfiguration
+		0x013D: true, // Predictor
+		0x0140: true, // ColorMap
+		0x0142: true, // TileWidth
+		0x0143: true, // TileLength
+		0x0144: true, // TileOffsets
+		0x0145: true, // TileByteCounts
+		0x014A: true, // SubIFDs
+		0x0152: true, // ExtraSamples
+		0x0153: true, // SampleFormat
+		0x0201: true, // JPEGInterchangeFormat
+		0x0202: true, // JPEGInterchangeFormatLength
+	}
+)
+
+// ExifEdit describes changes to make to exif data when it is written into an image.
+// zero values leave the existing tags untouched. Orientation is always copied as it is, the pixels are never rotated.
+type ExifEdit struct {
+	// Width and Height set PixelXDimension and PixelYDimension
+	Width, Height int
+	// DateTime sets DateTime and DateTimeOriginal
+	DateTime time.Time
+	// UserComment sets the UserComment tag
+	UserComment string
+	// History is appended to the ImageHistory tag
+	History string
+}
+
+// ifdEntry is a single tag from a tiff image file directory, with its value already resolved.
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// ifd is a tiff image file directory, sub ifds (exif, gps, interop) are held separately
+// as their offsets change whenever the ifd is written.
+type ifd struct {
+	entries []ifdEntry
+	sub     map[uint16]*ifd
+	next    uint32
+}
+
+func isSubIfdTag(tag uint16) bool {
+	return tag == tagExifIFD || tag == tagGPSIFD || tag == tagInteropIFD
+}
+
+func (d *ifd) get(tag uint16) (ifdEntry, bool) {
+	for _, e := range d.entries {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return ifdEntry{}, false
+}
+
+// uint returns the value of a tag holding a single short or long.
+func (d *ifd) uint(tag uint16, order binary.ByteOrder) (uint64, bool) {
+	e, ok := d.get(tag)
+	if !ok || e.count != 1 {
+		return 0, false
+	}
+	switch e.typ {
+	case tiffShort:
+		return uint64(order.Uint16(e.value)), true
+	case tiffLong:
+		return uint64(order.Uint32(e.value)), true
+	}
+	return 0, false
+}
+
+func (d *ifd) set(e ifdEntry) {
+	for i := range d.entries {
+		if d.entries[i].tag == e.tag {
+			d.entries[i] = e
+			return
+		}
+	}
+	d.entries = append(d.entries, e)
+}
+
+// subIfd returns the sub ifd for tag, creating it if it doesnt exist.
+func (d *ifd) subIfd(tag uint16) *ifd {
+	if d.sub == nil {
+		d.sub = map[uint16]*ifd{}
+	}
+	if _, ok := d.sub[tag]; !ok {
+		d.sub[tag] = &ifd{sub: map[uint16]*ifd{}}
+	}
+	return d.sub[tag]
+}
+
+// size returns the number of bytes needed to encode the ifd, its values and all its sub ifds.
+func (d *ifd) size() uint32 {
+	s := 2 + 12*uint32(len(d.entries)+len(d.sub)) + 4
+	for _, e := range d.entries {
+		if l := uint32(len(e.value)); l > 4 {
+			s += l + l%2
+		}
+	}
+	for _, sub := range d.sub {
+		s += sub.size()
+	}
+	return s
+}
+
+// encode writes the ifd to buf, buf must start at the tiff header so that its length is the current offset.
+func (d *ifd) encode(buf *bytes.Buffer, order binary.ByteOrder) {
+	entries := append([]ifdEntry(nil), d.entries...)
+	subTags := make([]uint16, 0, len(d.sub))
+	for tag := range d.sub {
+		subTags = append(subTags, tag)
+	}
+	sort.Slice(subTags, func(i, j int) bool { return subTags[i] < subTags[j] })
+
+	start := uint32(buf.Len())
+	dataOffset := start + 2 + 12*uint32(len(entries)+len(subTags)) + 4
+	dataSize := uint32(0)
+	for _, e := range entries {
+		if l := uint32(len(e.value)); l > 4 {
+			dataSize += l + l%2
+		}
+	}
+	// sub ifds are written straight after this ifds values.
+	subOffset := dataOffset + dataSize
+	for _, tag := range subTags {
+		entries = append(entries, ifdEntry{tag: tag, typ: tiffLong, count: 1, value: uint32Bytes(order, subOffset)})
+		subOffset += d.sub[tag].size()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	data := new(bytes.Buffer)
+	binary.Write(buf, order, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, order, e.tag)
+		binary.Write(buf, order, e.typ)
+		binary.Write(buf, order, e.count)
+		if len(e.value) <= 4 {
+			inline := make([]byte, 4)
+			copy(inline, e.value)
+			buf.Write(inline)
+			continue
+		}
+		binary.Write(buf, order, dataOffset+uint32(data.Len()))
+		data.Write(e.value)
+		if len(e.value)%2 != 0 {
+			data.WriteByte(0)
+		}
+	}
+	binary.Write(buf, order, d.next)
+	buf.Write(data.Bytes())
+	for _, tag := range subTags {
+		d.sub[tag].encode(buf, order)
+	}
+}
+
+// convertOrder byte swaps all values in the ifd if the byte orders differ.
+func (d *ifd) convertOrder(from, to binary.ByteOrder) {
+	if from == to {
+		return
+	}
+	for i, e := range d.entries {
+		width := 0
+		switch e.typ {
+		case 3, 8:
+			width = 2
+		case 4, 5, 9, 10, 11, 13:
+			// rationals are a pair of longs
+			width = 4
+		case 12:
+			width = 8
+		}
+		if width == 0 {
+			continue
+		}
+		swapped := append([]byte(nil), e.value...)
+		for j := 0; j+width <= len(swapped); j += width {
+			for a, b := j, j+width-1; a < b; a, b = a+1, b-1 {
+				swapped[a], swapped[b] = swapped[b], swapped[a]
+			}
+		}
+		d.entries[i].value = swapped
+	}
+	for _, sub := range d.sub {
+		sub.convertOrder(from, to)
+	}
+}
+
+func uint16Bytes(order binary.ByteOrder, v uint16) []byte {
+	b := make([]byte, 2)
+	order.PutUint16(b, v)
+	return b
+}
+
+func uint32Bytes(order binary.ByteOrder, v uint32) []byte {
+	b := make([]byte, 4)
+	order.PutUint32(b, v)
+	return b
+}
+
+func asciiEntry(tag uint16, s string) ifdEntry {
+	value := append([]byte(s), 0)
+	return ifdEntry{tag: tag, typ: tiffASCII, count: uint32(len(value)), value: value}
+}
+
+// readTiffHeader reads the byte order and offset of the first ifd from tiff structured data
+func readTiffHeader(raw []byte) (binary.ByteOrder, uint32, error) {
+	if len(raw) < 8 {
+		return nil, 0, fmt.Errorf("[exif] tiff header too short")
+	}
+	var order binary.ByteOrder
+	switch string(raw[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("[exif] not a tiff header")
+	}
+	return order, order.Uint32(raw[4:8]), nil
+}
+
+// parseIfd reads the ifd at offset from tiff structured data.
+// entries with values outside of raw are dropped rather than failing the whole ifd.
+func parseIfd(raw []byte, order binary.ByteOrder, offset uint32, depth int) (*ifd, error) {
+	if depth > maxIfdDepth {
+		return nil, fmt.Errorf("[exif] ifds nested too deep")
+	}
+	if uint64(offset)+2 > uint64(len(raw)) {
+		return nil, fmt.Errorf("[exif] ifd offset %d out of range", offset)
+	}
+	n := uint64(order.Uint16(raw[offset:]))
+	end := uint64(offset) + 2 + n*12 + 4
+	if end > uint64(len(raw)) {
+		return nil, fmt.Errorf("[exif] ifd at %d overruns data", offset)
+	}
+
+	d := &ifd{sub: map[uint16]*ifd{}}
+	for i := uint64(0); i < n; i++ {
+		e := raw[uint64(offset)+2+i*12:]
+		entry := ifdEntry{tag: order.Uint16(e[0:]), typ: order.Uint16(e[2:]), count: order.Uint32(e[4:])}
+		typeSize, ok := tiffTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		length := uint64(typeSize) * uint64(entry.count)
+		if length <= 4 {
+			entry.value = append([]byte(nil), e[8:8+length]...)
+		} else {
+			valueOffset := uint64(order.Uint32(e[8:]))
+			if valueOffset+length > uint64(len(raw)) {
+				continue
+			}
+			entry.value = append([]byte(nil), raw[valueOffset:valueOffset+length]...)
+		}
+
+		if isSubIfdTag(entry.tag) && length >= 4 {
+			if sub, err := parseIfd(raw, order, order.Uint32(entry.value), depth+1); err == nil {
+				d.sub[entry.tag] = sub
+			}
+			continue
+		}
+		d.entries = append(d.entries, entry)
+	}
+	d.next = order.Uint32(raw[end-4:])
+	return d, nil
+}
+
+// metadataIfd parses tiff structured exif and returns its first ifd without any tags describing the pixel data.
+func metadataIfd(exifBytes []byte) (*ifd, binary.ByteOrder, error) {
+	order, offset, err := readTiffHeader(exifBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := parseIfd(exifBytes, order, offset, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	kept := d.entries[:0]
+	for _, e := range d.entries {
+		// xmp is carried separately, see InjectXMP
+		if !structuralTags[e.tag] && e.tag != tagXMP {
+			kept = append(kept, e)
+		}
+	}
+	d.entries = kept
+	// the thumbnail ifd describes the original image, drop it.
+	d.next = 0
+	return d, order, nil
+}
+
+// encodeTiff encodes a standalone tiff structure containing d, as stored in a jpeg APP1 segment.
+func encodeTiff(d *ifd, order binary.ByteOrder) []byte {
+	buf := new(bytes.Buffer)
+	if order == binary.BigEndian {
+		buf.WriteString("MM\x00*")
+	} else {
+		buf.WriteString("II*\x00")
+	}
+	binary.Write(buf, order, uint32(8))
+	d.encode(buf, order)
+	return buf.Bytes()
+}
+
+func (edit ExifEdit) apply(d *ifd, order binary.ByteOrder) {
+	if edit.Width > 0 && edit.Height > 0 {
+		exifIfd := d.subIfd(tagExifIFD)
+		exifIfd.set(ifdEntry{tag: tagPixelXDimension, typ: tiffLong, count: 1, value: uint32Bytes(order, uint32(edit.Width))})
+		exifIfd.set(ifdEntry{tag: tagPixelYDimension, typ: tiffLong, count: 1, value: uint32Bytes(order, uint32(edit.Height))})
+	}
+	if !edit.DateTime.IsZero() {
+		dt := edit.DateTime.Format(dumbExifForm)
+		d.set(asciiEntry(tagDateTime, dt))
+		d.subIfd(tagExifIFD).set(asciiEntry(tagDateTimeOriginal, dt))
+	}
+	if edit.UserComment != "" {
+		// UserComment is prefixed with an 8 byte character code
+		value := append([]byte("ASCII\x00\x00\x00"), []byte(edit.UserComment)...)
+		d.subIfd(tagExifIFD).set(ifdEntry{tag: tagUserComment, typ: tiffUndefined, count: uint32(len(value)), value: value})
+	}
+	if edit.History != "" {
+		history := edit.History
+		if e, ok := d.get(tagImageHistory); ok {
+			if previous := strings.TrimRight(string(e.value), "\x00"); previous != "" {
+				history = previous + "; " + history
+			}
+		}
+		d.set(asciiEntry(tagImageHistory, history))
+	}
+}
+
+// injectTiffIfd merges the tags in meta into the first ifd of tiff image data.
+// the merged ifd is appended to the end of the data and the header pointed at it, so that
+// the existing pixel data and its offsets are left untouched.
+func injectTiffIfd(data []byte, meta *ifd, metaOrder binary.ByteOrder) ([]byte, error) {
+	order, offset, err := readTiffHeader(data)
+	if err != nil {
+		return data, err
+	}
+	target, err := parseIfd(data, order, offset, 0)
+	if err != nil {
+		return data, err
+	}
+	meta.convertOrder(metaOrder, order)
+
+	merged := &ifd{sub: target.sub, next: target.next}
+	for _, e := range target.entries {
+		if _, ok := meta.get(e.tag); !ok {
+			merged.entries = append(merged.entries, e)
+		}
+	}
+	for _, e := range meta.entries {
+		if !structuralTags[e.tag] {
+			merged.entries = append(merged.entries, e)
+		}
+	}
+	for tag, sub := range meta.sub {
+		merged.sub[tag] = sub
+	}
+
+	buf := bytes.NewBuffer(append([]byte(nil), data...))
+	if buf.Len()%2 != 0 {
+		buf.WriteByte(0)
+	}
+	newOffset := uint32(buf.Len())
+	merged.encode(buf, order)
+	out := buf.Bytes()
+	order.PutUint32(out[4:8], newOffset)
+	return out, nil
+}
+
+// jpegAppSegment returns the payload (after header) of the first APP1 segment that starts with header.
+func jpegAppSegment(data, header []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		if marker < 0xE0 || marker > 0xEF {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			break
+		}
+		if payload := data[pos+4 : end]; marker == 0xE1 && bytes.HasPrefix(payload, header) {
+			return payload[len(header):]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// replaceJpegApp1 removes any APP1 segment starting with header and inserts a new one containing payload.
+// the new segment is placed after any APP0 (JFIF) segments.
+func replaceJpegApp1(data, header, payload []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data, fmt.Errorf("[jpeg] missing SOI marker")
+	}
+	if len(header)+len(payload) > maxJpegSegment {
+		return data, fmt.Errorf("[jpeg] segment too large (%d bytes)", len(header)+len(payload))
+	}
+
+	app0 := new(bytes.Buffer)
+	others := new(bytes.Buffer)
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		if marker < 0xE0 || marker > 0xEF {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			return data, fmt.Errorf("[jpeg] truncated APP%d segment", marker-0xE0)
+		}
+		switch {
+		case marker == 0xE0:
+			app0.Write(data[pos:end])
+		case marker == 0xE1 && bytes.HasPrefix(data[pos+4:end], header):
+			// drop existing segment
+		default:
+			others.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	out := new(bytes.Buffer)
+	out.Grow(len(data) + len(payload) + len(header) + 4)
+	out.Write(data[:2])
+	out.Write(app0.Bytes())
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(out, binary.BigEndian, uint16(len(header)+len(payload)+2))
+	out.Write(header)
+	out.Write(payload)
+	out.Write(others.Bytes())
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+// pngChunk returns the data of the first png chunk of type typ whose data starts with prefix
+func pngChunk(data []byte, typ string, prefix []byte) []byte {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			break
+		}
+		if chunkData := data[pos+8 : pos+8+length]; string(data[pos+4:pos+8]) == typ && bytes.HasPrefix(chunkData, prefix) {
+			return chunkData[len(prefix):]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// replacePngChunk removes any chunk of type typ whose data starts with prefix and inserts a new one before the first IDAT.
+func replacePngChunk(data []byte, typ string, prefix, payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return data, fmt.Errorf("[png] missing signature")
+	}
+	chunk := new(bytes.Buffer)
+	binary.Write(chunk, binary.BigEndian, uint32(len(prefix)+len(payload)))
+	chunk.WriteString(typ)
+	chunk.Write(prefix)
+	chunk.Write(payload)
+	binary.Write(chunk, binary.BigEndian, crc32.ChecksumIEEE(chunk.Bytes()[4:]))
+
+	out := new(bytes.Buffer)
+	out.Grow(len(data) + chunk.Len())
+	out.Write(pngSignature)
+	inserted := false
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+12 > len(data) {
+			return data, fmt.Errorf("[png] truncated chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return data, fmt.Errorf("[png] truncated chunk")
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		if chunkType == typ && bytes.HasPrefix(data[pos+8:pos+8+length], prefix) {
+			pos = end
+			continue
+		}
+		if chunkType == "IDAT" && !inserted {
+			out.Write(chunk.Bytes())
+			inserted = true
+		}
+		out.Write(data[pos:end])
+		pos = end
+	}
+	if !inserted {
+		return data, fmt.Errorf("[png] no IDAT chunk")
+	}
+	return out.Bytes(), nil
+}
+
+// ExtractExif returns the raw tiff structured exif from jpeg or tiff image data, or nil if there is none.
+func ExtractExif(data []byte) []byte {
+	if exifBytes := pngChunk(data, "eXIf", nil); exifBytes != nil {
+		return exifBytes
+	}
+	exifData, _ := exif.Decode(bytes.NewReader(data))
+	if exifData == nil {
+		return nil
+	}
+	return exifData.Raw
+}
+
+// ExtractXMP returns the xmp packet embedded in jpeg, tiff or png image data, or nil if there is none.
+func ExtractXMP(data []byte) []byte {
+	if xmp := jpegAppSegment(data, jpegXMPHeader); xmp != nil {
+		return xmp
+	}
+	if xmp := pngChunk(data, "iTXt", pngXMPKeyword); len(xmp) > 2 {
+		// skip compression flag and method, then the null terminated language tag and translated keyword
+		parts := bytes.SplitN(xmp[2:], []byte{0}, 3)
+		if len(parts) == 3 {
+			return parts[2]
+		}
+	}
+	order, offset, err := readTiffHeader(data)
+	if err != nil {
+		return nil
+	}
+	d, err := parseIfd(data, order, offset, 0)
+	if err != nil {
+		return nil
+	}
+	if e, ok := d.get(tagXMP); ok {
+		return e.value
+	}
+	return nil
+}
+
+// InjectExif writes exifBytes (tiff structured exif, as in Image.ExifBytes) into encoded jpeg, tiff or png image data
+// applying edit along the way. Tags describing the pixel layout of the original image and its thumbnail are dropped.
+func InjectExif(data, exifBytes []byte, edit ExifEdit) ([]byte, error) {
+	meta, order, err := metadataIfd(exifBytes)
+	if err != nil {
+		return data, err
+	}
+	edit.apply(meta, order)
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return replaceJpegApp1(data, jpegExifHeader, encodeTiff(meta, order))
+	case bytes.HasPrefix(data, pngSignature):
+		return replacePngChunk(data, "eXIf", nil, encodeTiff(meta, order))
+	default:
+		return injectTiffIfd(data, meta, order)
+	}
+}
+
+// InjectXMP writes an xmp packet into encoded jpeg, tiff or png image data, replacing any that exists.
+func InjectXMP(data, xmp []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return replaceJpegApp1(data, jpegXMPHeader, xmp)
+	case bytes.HasPrefix(data, pngSignature):
+		// uncompressed, no language tag, no translated keyword
+		return replacePngChunk(data, "iTXt", pngXMPKeyword, append([]byte{0, 0, 0, 0}, xmp...))
+	default:
+		meta := &ifd{entries: []ifdEntry{{tag: tagXMP, typ: tiffByte, count: uint32(len(xmp)), value: xmp}}}
+		return injectTiffIfd(data, meta, binary.LittleEndian)
+	}
+}
+
+// RewriteExif applies edit to the exif already embedded in jpeg, tiff or png image data.
+// the image data itself is not decoded or recompressed.
+func RewriteExif(data []byte, edit ExifEdit) ([]byte, error) {
+	exifBytes := ExtractExif(data)
+	if exifBytes == nil {
+		exifBytes = encodeTiff(&ifd{}, binary.LittleEndian)
+	}
+	return InjectExif(data, exifBytes, edit)
+}
+
+// CopyMetadata copies the exif and xmp from a source image into newly encoded image data.
+// if the source image has no ExifBytes they are read from its Data.
+// on error the returned data is still a valid image, just missing some or all of the metadata.
+func CopyMetadata(src Image, data []byte, edit ExifEdit) ([]byte, error) {
+	exifBytes := src.ExifBytes
+	if len(exifBytes) == 0 {
+		exifBytes = ExtractExif(src.Data)
+	}
+	var err error
+	if len(exifBytes) != 0 {
+		if data, err = InjectExif(data, exifBytes, edit); err != nil {
+			return data, err
+		}
+	}
+	if xmp := ExtractXMP(src.Data); len(xmp) != 0 {
+		if data, err = InjectXMP(data, xmp); err != nil {
+			return data, err
+		}
+	}
+	return data, nil
+}
+
+// CopyWithExif writes an image to destPath with edit applied to its exif.
+// the image data is taken from img.Data, or read from img.Path if it is empty.
+func CopyWithExif(img Image, destPath string, edit ExifEdit) (err error) {
+	if len(img.Data) == 0 {
+		if img.Data, err = ioutil.ReadFile(img.Path); err != nil {
+			return
+		}
+	}
+	if img.Data, err = RewriteExif(img.Data, edit); err != nil {
+		return
+	}
+	return WriteImageToFile(img, destPath)
+}
+
+// TimestampEdit returns an ExifEdit that sets the exif datetimes of an image to t.
+// if keepOriginal is set the previous datetime is kept in UserComment.
+func TimestampEdit(img Image, t time.Time, keepOriginal bool) ExifEdit {
+	edit := ExifEdit{DateTime: t}
+	if keepOriginal {
+		original := img.ExifTimestamp
+		if original.IsZero() {
+			original = img.Timestamp
+		}
+		edit.UserComment = "original DateTime " + original.Format(dumbExifForm)
+	}
+	return edit
+}
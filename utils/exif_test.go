@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func testExifBytes(order binary.ByteOrder) []byte {
+	d := &ifd{}
+	d.set(asciiEntry(0x010F, "Canon"))
+	d.set(asciiEntry(0x0110, "Canon EOS 600D"))
+	d.set(asciiEntry(tagDateTime, "2018:04:01 10:03:00"))
+	// Orientation, rotated 90 degrees
+	d.set(ifdEntry{tag: 0x0112, typ: tiffShort, count: 1, value: uint16Bytes(order, 6)})
+	// structural tags from the original image shouldn't be carried over
+	d.set(ifdEntry{tag: 0x0100, typ: tiffLong, count: 1, value: uint32Bytes(order, 5184)})
+	d.subIfd(tagExifIFD).set(asciiEntry(tagDateTimeOriginal, "2018:04:01 10:03:00"))
+	d.subIfd(tagExifIFD).set(ifdEntry{tag: tagPixelXDimension, typ: tiffLong, count: 1, value: uint32Bytes(order, 5184)})
+	return encodeTiff(d, order)
+}
+
+func encodeTestImage(t *testing.T, format string) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	buf := new(bytes.Buffer)
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(buf, img, nil)
+	case "png":
+		err = png.Encode(buf, img)
+	case "tiff":
+		err = tiff.Encode(buf, img, &tiff.Options{Compression: tiff.Deflate})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func assertExifString(t *testing.T, x *exif.Exif, name exif.FieldName, expected string) {
+	tag, err := x.Get(name)
+	if !assert.NoError(t, err, string(name)) {
+		return
+	}
+	val, err := tag.StringVal()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, val, string(name))
+}
+
+// imageHistory reads ImageHistory, which goexif doesnt know about
+func imageHistory(t *testing.T, exifBytes []byte) string {
+	d, _, err := metadataIfd(exifBytes)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	e, _ := d.get(tagImageHistory)
+	return string(bytes.TrimRight(e.value, "\x00"))
+}
+
+func TestInjectExif(t *testing.T) {
+	for _, format := range []string{"jpeg", "tiff", "png"} {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			data := encodeTestImage(t, format)
+			out, err := InjectExif(data, testExifBytes(order), ExifEdit{Width: 64, Height: 48, History: "tsresize -res 64x48"})
+			if !assert.NoError(t, err, format) {
+				continue
+			}
+
+			// image must still decode
+			_, decodedFormat, err := image.Decode(bytes.NewReader(out))
+			assert.NoError(t, err, format)
+			assert.Equal(t, format, decodedFormat)
+
+			x, err := exif.Decode(bytes.NewReader(ExtractExif(out)))
+			if !assert.NoError(t, err, format) {
+				continue
+			}
+			assertExifString(t, x, exif.Model, "Canon EOS 600D")
+			assertExifString(t, x, exif.DateTime, "2018:04:01 10:03:00")
+			assert.Equal(t, "tsresize -res 64x48", imageHistory(t, x.Raw), format)
+			px, err := x.Get(exif.PixelXDimension)
+			if assert.NoError(t, err) {
+				v, _ := px.Int(0)
+				assert.Equal(t, 64, v, format)
+			}
+			orientation, err := x.Get(exif.Orientation)
+			if assert.NoError(t, err) {
+				v, _ := orientation.Int(0)
+				assert.Equal(t, 6, v, format)
+			}
+			if format != "tiff" {
+				_, err = x.Get(exif.ImageWidth)
+				assert.Error(t, err, "structural tag copied into %s", format)
+			}
+		}
+	}
+}
+
+func TestRewriteExif(t *testing.T) {
+	for _, format := range []string{"jpeg", "tiff"} {
+		data, err := InjectExif(encodeTestImage(t, format), testExifBytes(binary.LittleEndian), ExifEdit{History: "first"})
+		if !assert.NoError(t, err) {
+			continue
+		}
+		aligned := time.Date(2018, 4, 1, 10, 0, 0, 0, time.UTC)
+		out, err := RewriteExif(data, ExifEdit{DateTime: aligned, UserComment: "original 2018:04:01 10:03:00", History: "second"})
+		if !assert.NoError(t, err) {
+			continue
+		}
+		_, _, err = image.Decode(bytes.NewReader(out))
+		assert.NoError(t, err, format)
+
+		x, err := exif.Decode(bytes.NewReader(out))
+		if !assert.NoError(t, err, format) {
+			continue
+		}
+		assertExifString(t, x, exif.DateTime, "2018:04:01 10:00:00")
+		assertExifString(t, x, exif.DateTimeOriginal, "2018:04:01 10:00:00")
+		assert.Equal(t, "first; second", imageHistory(t, x.Raw), format)
+		assertExifString(t, x, exif.Model, "Canon EOS 600D")
+	}
+}
+
+func TestInjectXMP(t *testing.T) {
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)
+	for _, format := range []string{"jpeg", "tiff", "png"} {
+		out, err := InjectXMP(encodeTestImage(t, format), xmp)
+		if !assert.NoError(t, err, format) {
+			continue
+		}
+		_, _, err = image.Decode(bytes.NewReader(out))
+		assert.NoError(t, err, format)
+		assert.Equal(t, xmp, ExtractXMP(out), format)
+	}
+}
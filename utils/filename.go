@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// VariantSeparator separates the stream name from the variant, ie TR0114-GC03R-RGB01~fullres
+const VariantSeparator = "~"
+
+// FilenameParts are the parts of a timestream filename:
+//
+//	<stream>[~<variant>]_<TsForm>[_<subsecond>]<ext>
+//
+// ie TR0114-GC03R-RGB01~fullres_2018_04_01_10_00_00_00.jpg has the stream TR0114-GC03R-RGB01, the variant fullres,
+// the subsecond 00 and the extension .jpg.
+type FilenameParts struct {
+	Stream    string
+	Variant   string
+	Timestamp time.Time
+	// Subsecond is whatever is after the timestamp, usually the sub second or burst number 00
+	Subsecond string
+	Ext       string
+}
+
+// ParseFilename splits the base of a path into its parts, it is an error if there isnt a timestamp.
+func ParseFilename(thisFile string) (p FilenameParts, err error) {
+	base := filepath.Base(thisFile)
+	p.Ext = filepath.Ext(base)
+	base = strings.TrimSuffix(base, p.Ext)
+
+	loc := TsRegex.FindStringIndex(base)
+	if loc == nil {
+		return p, fmt.Errorf("no timestamp in filename %s", thisFile)
+	}
+	if p.Timestamp, err = time.Parse(TsForm, base[loc[0]:loc[1]]); err != nil {
+		return p, err
+	}
+	p.Stream, p.Variant = SplitStreamName(strings.TrimRight(base[:loc[0]], "_"))
+	p.Subsecond = strings.TrimPrefix(base[loc[1]:], "_")
+	return p, nil
+}
+
+// SplitStreamName splits a stream name into the stream and the variant, ie TR0114-GC03R-RGB01~fullres
+func SplitStreamName(name string) (stream, variant string) {
+	if i := strings.LastIndex(name, VariantSeparator); i >= 0 {
+		return name[:i], name[i+len(VariantSeparator):]
+	}
+	return name, ""
+}
+
+// Name returns the stream and variant as they are in the filename, ie TR0114-GC03R-RGB01~fullres
+func (p FilenameParts) Name() string {
+	if p.Variant == "" {
+		return p.Stream
+	}
+	return p.Stream + VariantSeparator + p.Variant
+}
+
+// Filename puts the parts back together.
+func (p FilenameParts) Filename() string {
+	name := p.Timestamp.Format(TsForm)
+	if p.Name() != "" {
+		name = p.Name() + "_" + name
+	}
+	if p.Subsecond != "" {
+		name += "_" + p.Subsecond
+	}
+	return name + p.Ext
+}
+
+// ParseName fills in the Stream, Variant and Subsecond of an image from its filename, leaving them if it doesnt have
+// a timestamp.
+func (img *Image) ParseName() {
+	if p, err := ParseFilename(img.Path); err == nil {
+		img.Stream, img.Variant, img.Subsecond = p.Stream, p.Variant, p.Subsecond
+	}
+}
+
+// StreamName returns the stream and variant of an image, ie TR0114-GC03R-RGB01~fullres
+func (img Image) StreamName() string {
+	return FilenameParts{Stream: img.Stream, Variant: img.Variant}.Name()
+}
+
+// ArchiveName returns the name of the archive for a week of images, <name>~<week>.tar.
+// without a name it is the stream and variant of the image, so each stream and variant gets its own archive.
+func ArchiveName(filePath, name string, week time.Time) string {
+	if name == "" {
+		if parts, err := ParseFilename(filePath); err == nil {
+			name = parts.Name()
+		}
+	}
+	return fmt.Sprintf(week.Format(ArchiveForm), name)
+}
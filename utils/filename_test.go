@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseFilename(t *testing.T) {
+	p, err := ParseFilename("/data/TR0114-GC03R-RGB01~fullres_2018_04_01_10_00_00_00.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "TR0114-GC03R-RGB01", p.Stream)
+	assert.Equal(t, "fullres", p.Variant)
+	assert.Equal(t, time.Date(2018, 4, 1, 10, 0, 0, 0, time.UTC), p.Timestamp)
+	assert.Equal(t, "00", p.Subsecond)
+	assert.Equal(t, ".jpg", p.Ext)
+	assert.Equal(t, "TR0114-GC03R-RGB01~fullres", p.Name())
+	assert.Equal(t, "TR0114-GC03R-RGB01~fullres_2018_04_01_10_00_00_00.jpg", p.Filename())
+
+	// changing just the variant keeps the rest
+	p.Variant = "1920"
+	assert.Equal(t, "TR0114-GC03R-RGB01~1920_2018_04_01_10_00_00_00.jpg", p.Filename())
+
+	p, err = ParseFilename("GC03L_2018_04_01_10_00_00.CR2")
+	assert.NoError(t, err)
+	assert.Equal(t, "GC03L", p.Stream)
+	assert.Equal(t, "", p.Variant)
+	assert.Equal(t, "", p.Subsecond)
+	assert.Equal(t, ".CR2", p.Ext)
+	assert.Equal(t, "GC03L_2018_04_01_10_00_00.CR2", p.Filename())
+
+	p, err = ParseFilename("2018_04_01_10_00_00_00.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "", p.Stream)
+	assert.Equal(t, "2018_04_01_10_00_00_00.jpg", p.Filename())
+
+	_, err = ParseFilename("IMG_0001.jpg")
+	assert.Error(t, err)
+
+	img := Image{Path: "/data/GC03-Picam~1920_2018_04_01_10_00_00_00.jpg"}
+	img.ParseName()
+	assert.Equal(t, "GC03-Picam", img.Stream)
+	assert.Equal(t, "1920", img.Variant)
+	assert.Equal(t, "GC03-Picam~1920", img.StreamName())
+}
+
+func TestSplitStreamName(t *testing.T) {
+	stream, variant := SplitStreamName("TR0114-GC03R-RGB01~fullres")
+	assert.Equal(t, "TR0114-GC03R-RGB01", stream)
+	assert.Equal(t, "fullres", variant)
+	stream, variant = SplitStreamName("GC03L")
+	assert.Equal(t, "GC03L", stream)
+	assert.Equal(t, "", variant)
+}
+
+func TestArchiveName(t *testing.T) {
+	week := time.Date(2018, 4, 7, 0, 0, 0, 0, time.UTC)
+	full := ArchiveName("/data/GC03L~fullres_2018_04_01_10_00_00_00.jpg", "", week)
+	small := ArchiveName("/data/GC03L~1920_2018_04_01_10_00_00_00.jpg", "", week)
+	assert.Equal(t, "GC03L~fullres~2018-04-07.tar", full)
+	assert.Equal(t, "GC03L~1920~2018-04-07.tar", small)
+	// the rest of the week goes in the same archive
+	assert.Equal(t, full, ArchiveName("/data/GC03L~fullres_2018_04_03_10_00_00_00.jpg", "", week))
+	assert.Equal(t, "chamber~2018-04-07.tar", ArchiveName("/data/GC03L~1920_2018_04_01_10_00_00_00.jpg", "chamber", week))
+}
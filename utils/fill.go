@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// FillNone leaves slots without an image empty
+	FillNone = "none"
+	// FillNearest fills a slot with a copy of the nearest image
+	FillNearest = "nearest"
+	// FillSymlink fills a slot with a symlink to the nearest image
+	FillSymlink = "symlink"
+	// FillPlaceholder fills a slot with a black frame the size of the nearest image
+	FillPlaceholder = "placeholder"
+)
+
+// GapFiller finds the slots of an alignment without an image between the images it is given, which must be in slot
+// order (ie from a Sampler), and calls Fill for each of them with the image nearest to it.
+// slots before the first image and after the last are not filled.
+type GapFiller struct {
+	Alignment Alignment
+	// MaxGap is the longest gap to fill, longer gaps (ie the camera was off or its clock jumped) are left, zero for no limit
+	MaxGap time.Duration
+	// Emit is called with each image
+	Emit func(Image)
+	// Fill is called for each empty slot before the image after it is emitted
+	Fill func(slot time.Time, nearest Image)
+
+	previous     *Image
+	previousSlot time.Time
+}
+
+// Add fills the slots between the previous image and img then emits img.
+func (f *GapFiller) Add(img Image) {
+	slot, _ := f.Alignment.Slot(img.Timestamp)
+	if f.previous != nil {
+		if gap := slot.Sub(f.previousSlot); f.MaxGap > 0 && gap > f.MaxGap {
+			errLog.Printf("[fill] not filling the %s gap from %s to %s", gap, f.previousSlot.Format(time.RFC3339), slot.Format(time.RFC3339))
+		} else {
+			for _, missing := range f.Alignment.Between(f.previousSlot, slot) {
+				nearest := *f.previous
+				if absDuration(img.Timestamp.Sub(missing)) < absDuration(missing.Sub(nearest.Timestamp)) {
+					nearest = img
+				}
+				f.Fill(missing, nearest)
+			}
+		}
+	}
+	f.Emit(img)
+	f.previous = &img
+	f.previousSlot = slot
+}
+
+// Placeholder draws a black frame with text in the middle, scaled up to about a third of the width.
+func Placeholder(width, height int, text string) (image.Image, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("[fill] placeholder must have a size")
+	}
+	frame := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(frame, frame.Bounds(), image.NewUniform(color.Black), image.ZP, draw.Src)
+
+	// draw the text small then copy it up in blocks, the basic font is only 13 pixels high
+	face := basicfont.Face7x13
+	textWidth := font.MeasureString(face, text).Ceil()
+	label := image.NewGray(image.Rect(0, 0, textWidth, face.Height))
+	drawer := font.Drawer{Dst: label, Src: image.White, Face: face, Dot: fixed.P(0, face.Ascent)}
+	drawer.DrawString(text)
+
+	scale := width / 3 / textWidth
+	if scale < 1 {
+		scale = 1
+	}
+	left, top := (width-textWidth*scale)/2, (height-face.Height*scale)/2
+	for y := 0; y < face.Height; y++ {
+		for x := 0; x < textWidth; x++ {
+			if label.GrayAt(x, y).Y == 0 {
+				continue
+			}
+			block := image.Rect(left+x*scale, top+y*scale, left+(x+1)*scale, top+(y+1)*scale)
+			draw.Draw(frame, block, image.NewUniform(label.GrayAt(x, y)), image.ZP, draw.Src)
+		}
+	}
+	return frame, nil
+}
+
+// WritePlaceholder writes a placeholder the size of nearest to dest, encoded for the extension of dest.
+func WritePlaceholder(nearest Image, dest string) error {
+	data, err := imageData(nearest)
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("[fill] couldn't get the size of %s: %s", nearest.Path, err)
+	}
+	m, err := Placeholder(config.Width, config.Height, "missing")
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	switch strings.ToLower(filepath.Ext(dest)) {
+	case ".png":
+		return png.Encode(file, m)
+	case ".tif", ".tiff":
+		return tiff.Encode(file, m, &tiff.Options{Compression: tiff.Deflate})
+	}
+	return jpeg.Encode(file, m, &jpeg.Options{Quality: 95})
+}
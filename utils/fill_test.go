@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestGapFiller(t *testing.T) {
+	a, _ := NewAlignment(5*time.Minute, AlignNearest, 0)
+	var got []string
+	f := &GapFiller{
+		Alignment: a,
+		MaxGap:    time.Hour,
+		Emit:      func(img Image) { got = append(got, img.Path) },
+		Fill: func(slot time.Time, nearest Image) {
+			got = append(got, slot.Format("15:04")+"="+nearest.Path)
+		},
+	}
+	f.Add(Image{Path: "a", Timestamp: wallClock("2018-04-01T10:00:10")})
+	f.Add(Image{Path: "b", Timestamp: wallClock("2018-04-01T10:19:40")})
+	f.Add(Image{Path: "c", Timestamp: wallClock("2018-04-01T10:25:00")})
+	// longer than MaxGap
+	f.Add(Image{Path: "d", Timestamp: wallClock("2018-04-01T12:00:00")})
+	assert.Equal(t, []string{"a", "10:05=a", "10:10=b", "10:15=b", "b", "c", "d"}, got)
+}
+
+func TestAlignmentBetween(t *testing.T) {
+	a, _ := NewTimesAlignment([]time.Duration{6 * time.Hour, 18 * time.Hour}, AlignFloor, 0)
+	slots := a.Between(wallClock("2018-04-01T06:00:00"), wallClock("2018-04-02T18:00:00"))
+	assert.Equal(t, []time.Time{wallClock("2018-04-01T18:00:00"), wallClock("2018-04-02T06:00:00")}, slots)
+	assert.Empty(t, a.Between(wallClock("2018-04-01T06:00:00"), wallClock("2018-04-01T18:00:00")))
+}
+
+func TestPlaceholder(t *testing.T) {
+	m, err := Placeholder(640, 480, "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, 640, m.Bounds().Dx())
+	assert.Equal(t, 480, m.Bounds().Dy())
+	assert.Equal(t, color.RGBAModel.Convert(color.Black), color.RGBAModel.Convert(m.At(0, 0)))
+
+	// some of the text is drawn in the middle band
+	lit := 0
+	for x := 0; x < 640; x++ {
+		for y := 200; y < 280; y++ {
+			if r, _, _, _ := m.At(x, y).RGBA(); r > 0 {
+				lit++
+			}
+		}
+	}
+	assert.True(t, lit > 0)
+
+	_, err = Placeholder(0, 480, "missing")
+	assert.Error(t, err)
+}
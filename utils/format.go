@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// FormatJPEG is jpeg data
+	FormatJPEG = "jpeg"
+	// FormatPNG is png data
+	FormatPNG = "png"
+	// FormatTIFF is tiff data
+	FormatTIFF = "tiff"
+	// FormatCR2 is canon raw data, which is a tiff with CR at offset 8
+	FormatCR2 = "cr2"
+	// FormatUnknown is data that isnt any of the formats
+	FormatUnknown = ""
+)
+
+// FormatExtensions are the canonical extension for each format
+var FormatExtensions = map[string]string{
+	FormatJPEG: ".jpg",
+	FormatPNG:  ".png",
+	FormatTIFF: ".tif",
+	FormatCR2:  ".cr2",
+}
+
+// extensionFormats are the extensions each format is found with
+var extensionFormats = map[string]string{
+	".jpg":  FormatJPEG,
+	".jpeg": FormatJPEG,
+	".jpe":  FormatJPEG,
+	".png":  FormatPNG,
+	".tif":  FormatTIFF,
+	".tiff": FormatTIFF,
+	".cr2":  FormatCR2,
+}
+
+// DetectFormat returns the format of data from its magic bytes, only the first 12 bytes are needed.
+func DetectFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG
+	case bytes.HasPrefix(data, pngSignature):
+		return FormatPNG
+	case bytes.HasPrefix(data, []byte("II*\x00")) && len(data) >= 10 && string(data[8:10]) == "CR":
+		return FormatCR2
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return FormatTIFF
+	}
+	return FormatUnknown
+}
+
+// DetectImageFormat returns the format of an image from its data if it has any, otherwise from the start of the file
+// at its path.
+func DetectImageFormat(img Image) (string, error) {
+	if len(img.Data) != 0 {
+		return DetectFormat(img.Data), nil
+	}
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	defer file.Close()
+	head := make([]byte, 12)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return FormatUnknown, err
+	}
+	return DetectFormat(head[:n]), nil
+}
+
+// ExtensionFormat returns the format a file extension is for, in any case, or FormatUnknown.
+func ExtensionFormat(ext string) string {
+	return extensionFormats[strings.ToLower(ext)]
+}
+
+// CanonicalExtension returns the extension an image should have and whether its extension matches its content.
+// the format comes from the content, or from the extension if the content isnt a known format.
+// extensions that arent images are kept as they are, lower cased.
+func CanonicalExtension(img Image) (ext string, matches bool, err error) {
+	ext = strings.ToLower(filepath.Ext(img.Path))
+	extFormat := ExtensionFormat(ext)
+	format, err := DetectImageFormat(img)
+	if err != nil || format == FormatUnknown {
+		if canonical, ok := FormatExtensions[extFormat]; ok {
+			ext = canonical
+		}
+		return ext, true, err
+	}
+	return FormatExtensions[format], format == extFormat, nil
+}
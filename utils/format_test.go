@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	assert.Equal(t, FormatJPEG, DetectFormat([]byte{0xFF, 0xD8, 0xFF, 0xE1}))
+	assert.Equal(t, FormatPNG, DetectFormat(pngSignature))
+	assert.Equal(t, FormatTIFF, DetectFormat([]byte("II*\x00\x08\x00\x00\x00")))
+	assert.Equal(t, FormatTIFF, DetectFormat([]byte("MM\x00*\x00\x00\x00\x08")))
+	assert.Equal(t, FormatCR2, DetectFormat([]byte("II*\x00\x10\x00\x00\x00CR\x02\x00")))
+	assert.Equal(t, FormatUnknown, DetectFormat([]byte("not an image")))
+	assert.Equal(t, FormatUnknown, DetectFormat(nil))
+	assert.Equal(t, FormatTIFF, ExtensionFormat(".TIFF"))
+	assert.Equal(t, FormatUnknown, ExtensionFormat(".txt"))
+}
+
+func TestCanonicalExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "format-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tiffData := []byte("II*\x00\x08\x00\x00\x00")
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		ext     string
+		matches bool
+	}{
+		{"a.JPEG", []byte{0xFF, 0xD8, 0xFF, 0xE0}, ".jpg", true},
+		{"b.TIFF", tiffData, ".tif", true},
+		// a camera that writes tiff data into a .jpg
+		{"c.jpg", tiffData, ".tif", false},
+		{"d.CR2", []byte("II*\x00\x10\x00\x00\x00CR\x02\x00"), ".cr2", true},
+		// unknown content keeps the extension
+		{"e.Png", []byte("??"), ".png", true},
+		{"f.txt", []byte("text"), ".txt", true},
+	} {
+		p := filepath.Join(dir, c.name)
+		ioutil.WriteFile(p, c.data, 0644)
+		ext, matches, err := CanonicalExtension(Image{Path: p})
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, c.ext, ext, c.name)
+		assert.Equal(t, c.matches, matches, c.name)
+	}
+
+	ext, matches, _ := CanonicalExtension(Image{Path: "g.jpg", Data: pngSignature})
+	assert.Equal(t, ".png", ext)
+	assert.False(t, matches)
+}
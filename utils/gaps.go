@@ -0,0 +1,357 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Gap is a run of missing slots between two images (or the start or end of the range).
+type Gap struct {
+	After   time.Time `json:"after"`
+	Before  time.Time `json:"before"`
+	Missing int       `json:"missing"`
+}
+
+// ClockJump is a step in the camera clock between two consecutive images.
+type ClockJump struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	Step string    `json:"step"`
+}
+
+// DayCadence is the cadence of a stream over one day.
+type DayCadence struct {
+	Date       string    `json:"date"`
+	Images     int       `json:"images"`
+	Expected   int       `json:"expected"`
+	Missing    int       `json:"missing"`
+	Duplicates int       `json:"duplicates"`
+	Irregular  int       `json:"irregular"`
+	Jumps      int       `json:"jumps"`
+	First      time.Time `json:"first"`
+	Last       time.Time `json:"last"`
+}
+
+// Coverage is the fraction of expected slots that have an image.
+func (d DayCadence) Coverage() float64 {
+	if d.Expected == 0 {
+		return 0
+	}
+	return float64(d.Expected-d.Missing) / float64(d.Expected)
+}
+
+// GapReport is the result of a cadence analysis, see GapAnalyzer.
+type GapReport struct {
+	Interval   string       `json:"interval"`
+	Tolerance  string       `json:"tolerance"`
+	Images     int          `json:"images"`
+	Expected   int          `json:"expected"`
+	Missing    int          `json:"missing"`
+	Duplicates int          `json:"duplicates"`
+	Irregular  int          `json:"irregular"`
+	First      time.Time    `json:"first"`
+	Last       time.Time    `json:"last"`
+	Days       []DayCadence `json:"days"`
+	Gaps       []Gap        `json:"gaps"`
+	Jumps      []ClockJump  `json:"jumps"`
+}
+
+// GapAnalyzer finds missing slots, duplicate slots, clock jumps and irregular intervals in a stream of timestamps.
+//
+// images are expected every Interval (inferred from the median step between images if zero), give or take Tolerance
+// (a tenth of the interval if zero). timestamps are analysed in the order they are added, so a clock that steps
+// backwards shows up as a jump. an image off the cadence that the following images keep to is a clock jump
+// (ie an NTP correction), one they dont keep to is irregular. an image within Tolerance of the previous one is a duplicate.
+type GapAnalyzer struct {
+	Interval, Tolerance time.Duration
+	// MaxGap is the longest run of missing slots before it is counted as a clock jump instead, zero for no limit
+	MaxGap time.Duration
+	// Windows are the times of day images are expected, missing slots outside them arent counted. none is all day.
+	Windows []TimeOfDayWindow
+	// Start and End extend the expected slots before the first and after the last image, if they are set.
+	Start, End time.Time
+
+	timestamps []time.Time
+}
+
+// Add adds the timestamp of the next image.
+func (a *GapAnalyzer) Add(t time.Time) {
+	a.timestamps = append(a.timestamps, t)
+}
+
+// InferInterval returns the median step between the timestamps in time order, rounded to the second.
+func InferInterval(timestamps []time.Time) (time.Duration, error) {
+	sorted := append([]time.Time(nil), timestamps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+	var steps []time.Duration
+	for i := 1; i < len(sorted); i++ {
+		if step := sorted[i].Sub(sorted[i-1]); step >= time.Second {
+			steps = append(steps, step)
+		}
+	}
+	if len(steps) == 0 {
+		return 0, fmt.Errorf("[gaps] need at least two images a second or more apart to infer the interval")
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i] < steps[j] })
+	return steps[len(steps)/2].Round(time.Second), nil
+}
+
+// gapState is the running state of an analysis.
+type gapState struct {
+	*GapAnalyzer
+	report *GapReport
+	days   map[string]*DayCadence
+}
+
+func (s *gapState) day(t time.Time) *DayCadence {
+	date := t.Format("2006-01-02")
+	d, ok := s.days[date]
+	if !ok {
+		d = &DayCadence{Date: date}
+		s.days[date] = d
+	}
+	return d
+}
+
+func (s *gapState) inWindows(t time.Time) bool {
+	if len(s.Windows) == 0 {
+		return true
+	}
+	for _, w := range s.Windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// steps returns the number of whole intervals from a to b and how far b is from the nearest one.
+func (s *gapState) steps(a, b time.Time) (int, time.Duration) {
+	d := b.Sub(a)
+	n := (d + s.Interval/2) / s.Interval
+	if d < 0 {
+		n = (d - s.Interval/2) / s.Interval
+	}
+	off := d - n*s.Interval
+	if off < 0 {
+		off = -off
+	}
+	return int(n), off
+}
+
+// missing records the slots every interval between after and before that are in the windows, stepping forwards
+// from after, or backwards from before down to and including after.
+func (s *gapState) missing(after, before time.Time, backwards bool) {
+	gap := Gap{After: after, Before: before}
+	for i := time.Duration(1); ; i++ {
+		slot := after.Add(i * s.Interval)
+		if backwards {
+			slot = before.Add(-i * s.Interval)
+			if slot.Before(after) {
+				break
+			}
+		} else if before.Sub(slot) <= s.Tolerance {
+			break
+		}
+		if !s.inWindows(slot) {
+			continue
+		}
+		d := s.day(slot)
+		d.Missing++
+		d.Expected++
+		gap.Missing++
+	}
+	if gap.Missing > 0 {
+		s.report.Gaps = append(s.report.Gaps, gap)
+	}
+}
+
+// gap records the missing slots between two images on the cadence, or a clock jump if they are more than MaxGap apart.
+func (s *gapState) gap(after, before time.Time) {
+	if s.MaxGap > 0 && before.Sub(after) > s.MaxGap {
+		s.jump(after, before)
+		return
+	}
+	s.missing(after, before, false)
+}
+
+func (s *gapState) jump(from, to time.Time) {
+	s.report.Jumps = append(s.report.Jumps, ClockJump{From: from, To: to, Step: to.Sub(from).String()})
+	s.day(to).Jumps++
+}
+
+// Report analyses the timestamps added so far.
+func (a *GapAnalyzer) Report() (*GapReport, error) {
+	if len(a.timestamps) == 0 {
+		return nil, fmt.Errorf("[gaps] no images")
+	}
+	s := gapState{GapAnalyzer: &GapAnalyzer{}, report: &GapReport{}, days: map[string]*DayCadence{}}
+	*s.GapAnalyzer = *a
+	if s.Interval == 0 {
+		var err error
+		if s.Interval, err = InferInterval(a.timestamps); err != nil {
+			return nil, err
+		}
+	}
+	if s.Interval <= 0 {
+		return nil, fmt.Errorf("[gaps] interval must be positive")
+	}
+	if s.Tolerance == 0 {
+		s.Tolerance = s.Interval / 10
+	}
+	s.report.Interval, s.report.Tolerance = s.Interval.String(), s.Tolerance.String()
+	s.report.First, s.report.Last = a.timestamps[0], a.timestamps[0]
+
+	// anchor is an image on the current cadence, onCadence the last image on it and pending an image off it
+	anchor, onCadence, prev := a.timestamps[0], a.timestamps[0], a.timestamps[0]
+	var pending time.Time
+	for i, t := range a.timestamps {
+		d := s.day(t)
+		d.Images++
+		if d.First.IsZero() || t.Before(d.First) {
+			d.First = t
+		}
+		if t.After(d.Last) {
+			d.Last = t
+		}
+		if t.Before(s.report.First) {
+			s.report.First = t
+		}
+		if t.After(s.report.Last) {
+			s.report.Last = t
+		}
+		if i == 0 {
+			d.Expected++
+			continue
+		}
+
+		step := t.Sub(prev)
+		switch {
+		case step < -s.Tolerance:
+			// the clock went backwards
+			s.jump(prev, t)
+			d.Expected++
+			anchor, onCadence, pending = t, t, time.Time{}
+		case step <= s.Tolerance:
+			// in the same slot as the previous image
+			d.Duplicates++
+		default:
+			if _, off := s.steps(anchor, t); off <= s.Tolerance {
+				if !pending.IsZero() {
+					s.day(pending).Irregular++
+					pending = time.Time{}
+				}
+				s.gap(onCadence, t)
+				d.Expected++
+				onCadence = t
+				break
+			}
+			if !pending.IsZero() {
+				if n, off := s.steps(pending, t); n >= 1 && off <= s.Tolerance {
+					// the images after pending keep to its cadence, so the clock stepped
+					s.jump(onCadence, pending)
+					s.day(pending).Expected++
+					s.gap(pending, t)
+					d.Expected++
+					anchor, onCadence, pending = pending, t, time.Time{}
+					break
+				}
+				s.day(pending).Irregular++
+			}
+			pending = t
+		}
+		prev = t
+	}
+	if !pending.IsZero() {
+		s.day(pending).Irregular++
+	}
+
+	sorted := append([]time.Time(nil), a.timestamps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+	if !a.Start.IsZero() && a.Start.Before(sorted[0]) {
+		s.missing(a.Start, sorted[0], true)
+	}
+	if !a.End.IsZero() && a.End.After(sorted[len(sorted)-1]) {
+		s.missing(sorted[len(sorted)-1], a.End, false)
+	}
+	sort.Slice(s.report.Gaps, func(i, j int) bool { return s.report.Gaps[i].After.Before(s.report.Gaps[j].After) })
+
+	for _, d := range s.days {
+		s.report.Days = append(s.report.Days, *d)
+		s.report.Images += d.Images
+		s.report.Expected += d.Expected
+		s.report.Missing += d.Missing
+		s.report.Duplicates += d.Duplicates
+		s.report.Irregular += d.Irregular
+	}
+	sort.Slice(s.report.Days, func(i, j int) bool { return s.report.Days[i].Date < s.report.Days[j].Date })
+	return s.report, nil
+}
+
+var dayCadenceHeader = []string{"date", "images", "expected", "missing", "duplicates", "irregular", "jumps", "coverage", "first", "last"}
+
+func (d DayCadence) row() []string {
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("15:04:05")
+	}
+	return []string{d.Date, strconv.Itoa(d.Images), strconv.Itoa(d.Expected), strconv.Itoa(d.Missing),
+		strconv.Itoa(d.Duplicates), strconv.Itoa(d.Irregular), strconv.Itoa(d.Jumps),
+		strconv.FormatFloat(d.Coverage(), 'f', 3, 64), format(d.First), format(d.Last)}
+}
+
+// WriteCSV writes one row per day.
+func (r *GapReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(dayCadenceHeader)
+	for _, d := range r.Days {
+		cw.Write(d.row())
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteTable writes a summary, a table of the days and the gaps and clock jumps for reading in a terminal.
+func (r *GapReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "interval %s (tolerance %s), %d images from %s to %s\n", r.Interval, r.Tolerance, r.Images,
+		r.First.Format(time.RFC3339), r.Last.Format(time.RFC3339))
+	fmt.Fprintf(tw, "expected %d, missing %d, duplicates %d, irregular %d, jumps %d\n\n", r.Expected, r.Missing,
+		r.Duplicates, r.Irregular, len(r.Jumps))
+	for i, h := range dayCadenceHeader {
+		if i > 0 {
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprint(tw, h)
+	}
+	fmt.Fprintln(tw)
+	for _, d := range r.Days {
+		for i, v := range d.row() {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, v)
+		}
+		fmt.Fprintln(tw)
+	}
+	if len(r.Gaps) > 0 {
+		fmt.Fprintln(tw, "\ngaps:")
+		for _, g := range r.Gaps {
+			fmt.Fprintf(tw, "\t%s\t%s\t%d missing\n", g.After.Format(time.RFC3339), g.Before.Format(time.RFC3339), g.Missing)
+		}
+	}
+	if len(r.Jumps) > 0 {
+		fmt.Fprintln(tw, "\nclock jumps:")
+		for _, j := range r.Jumps {
+			fmt.Fprintf(tw, "\t%s\t%s\t%s\n", j.From.Format(time.RFC3339), j.To.Format(time.RFC3339), j.Step)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// every returns n timestamps interval apart from start
+func every(start time.Time, interval time.Duration, n int) []time.Time {
+	var ts []time.Time
+	for i := 0; i < n; i++ {
+		ts = append(ts, start.Add(time.Duration(i)*interval))
+	}
+	return ts
+}
+
+func analyse(t *testing.T, a *GapAnalyzer, timestamps ...[]time.Time) *GapReport {
+	for _, ts := range timestamps {
+		for _, timestamp := range ts {
+			a.Add(timestamp)
+		}
+	}
+	report, err := a.Report()
+	assert.NoError(t, err)
+	return report
+}
+
+func TestInferInterval(t *testing.T) {
+	start := wallClock("2018-04-01T06:00:00")
+	ts := every(start, 5*time.Minute, 20)
+	// a duplicate and a long gap dont move the median
+	ts = append(ts, ts[3], start.Add(10*time.Hour))
+	interval, err := InferInterval(ts)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, interval)
+
+	_, err = InferInterval([]time.Time{start, start})
+	assert.Error(t, err)
+}
+
+func TestGapsRegular(t *testing.T) {
+	start := wallClock("2018-04-01T06:00:02")
+	// jitter of a few seconds is still on the cadence
+	ts := every(start, 5*time.Minute, 12)
+	ts[4] = ts[4].Add(3 * time.Second)
+	ts[7] = ts[7].Add(-4 * time.Second)
+	report := analyse(t, &GapAnalyzer{}, ts)
+	assert.Equal(t, "5m0s", report.Interval)
+	assert.Equal(t, 12, report.Images)
+	assert.Equal(t, 12, report.Expected)
+	assert.Equal(t, 0, report.Missing+report.Duplicates+report.Irregular)
+	assert.Empty(t, report.Gaps)
+	assert.Empty(t, report.Jumps)
+}
+
+func TestGapsMissingAndDuplicates(t *testing.T) {
+	start := wallClock("2018-04-01T06:00:00")
+	ts := every(start, 5*time.Minute, 6)
+	// the camera stopped for 3 slots, then took the same frame twice
+	ts = append(ts, every(start.Add(45*time.Minute), 5*time.Minute, 4)...)
+	ts = append(ts, start.Add(60*time.Minute).Add(time.Second))
+	// one image off the cadence
+	ts = append(ts, start.Add(62*time.Minute), start.Add(65*time.Minute))
+	report := analyse(t, &GapAnalyzer{Interval: 5 * time.Minute}, ts)
+	assert.Equal(t, 13, report.Images)
+	assert.Equal(t, 3, report.Missing)
+	assert.Equal(t, 1, report.Duplicates)
+	assert.Equal(t, 1, report.Irregular)
+	assert.Equal(t, 14, report.Expected)
+	if assert.Len(t, report.Gaps, 1) {
+		assert.Equal(t, start.Add(25*time.Minute), report.Gaps[0].After)
+		assert.Equal(t, start.Add(45*time.Minute), report.Gaps[0].Before)
+		assert.Equal(t, 3, report.Gaps[0].Missing)
+	}
+	assert.Empty(t, report.Jumps)
+}
+
+func TestGapsClockJumps(t *testing.T) {
+	// a picam without a clock starts in 1970, then ntp steps it forward
+	epoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	synced := wallClock("2018-04-01T10:02:17")
+	report := analyse(t, &GapAnalyzer{Interval: 5 * time.Minute}, every(epoch, 5*time.Minute, 4), every(synced, 5*time.Minute, 4))
+	if assert.Len(t, report.Jumps, 1) {
+		assert.Equal(t, epoch.Add(15*time.Minute), report.Jumps[0].From)
+		assert.Equal(t, synced, report.Jumps[0].To)
+	}
+	assert.Equal(t, 0, report.Missing)
+	assert.Equal(t, 0, report.Irregular)
+	assert.Len(t, report.Days, 2)
+
+	// a clock stepped back an hour
+	start := wallClock("2018-04-01T10:00:00")
+	report = analyse(t, &GapAnalyzer{Interval: 5 * time.Minute}, every(start, 5*time.Minute, 4), every(start.Add(-45*time.Minute), 5*time.Minute, 4))
+	if assert.Len(t, report.Jumps, 1) {
+		assert.Equal(t, "-1h0m0s", report.Jumps[0].Step)
+	}
+
+	// a step onto the cadence is a gap unless it is longer than MaxGap
+	report = analyse(t, &GapAnalyzer{Interval: 5 * time.Minute, MaxGap: 24 * time.Hour}, every(epoch, 5*time.Minute, 4), every(wallClock("2018-04-01T10:00:00"), 5*time.Minute, 4))
+	assert.Len(t, report.Jumps, 1)
+	assert.Equal(t, 0, report.Missing)
+}
+
+func TestGapsWindowsAndRange(t *testing.T) {
+	// images 06:00-08:00 on two days, with a window so the night isnt missing
+	day1 := every(wallClock("2018-04-01T06:00:00"), 30*time.Minute, 5)
+	day2 := every(wallClock("2018-04-02T06:00:00"), 30*time.Minute, 3)
+	a := &GapAnalyzer{
+		Interval: 30 * time.Minute,
+		Windows:  []TimeOfDayWindow{{Start: 6 * time.Hour, End: 8 * time.Hour}},
+		Start:    wallClock("2018-04-01T00:00:00"),
+		End:      wallClock("2018-04-03T00:00:00"),
+	}
+	report := analyse(t, a, day1, day2)
+	assert.Equal(t, 0, report.Days[0].Missing)
+	// day 2 stopped uploading after 07:00
+	if assert.Len(t, report.Days, 2) {
+		assert.Equal(t, 2, report.Days[1].Missing)
+		assert.Equal(t, 5, report.Days[1].Expected)
+		assert.InDelta(t, 0.6, report.Days[1].Coverage(), 1e-9)
+	}
+
+	// the start of the range adds the slots before the first image
+	a = &GapAnalyzer{Interval: 30 * time.Minute, Start: wallClock("2018-04-01T05:00:00")}
+	report = analyse(t, a, day1)
+	assert.Equal(t, 2, report.Missing)
+}
+
+func TestGapReportOutput(t *testing.T) {
+	start := wallClock("2018-04-01T06:00:00")
+	report := analyse(t, &GapAnalyzer{Interval: 5 * time.Minute}, every(start, 5*time.Minute, 3), every(start.Add(30*time.Minute), 5*time.Minute, 2))
+
+	var csvOut bytes.Buffer
+	assert.NoError(t, report.WriteCSV(&csvOut))
+	lines := strings.Split(strings.TrimSpace(csvOut.String()), "\n")
+	assert.Equal(t, "date,images,expected,missing,duplicates,irregular,jumps,coverage,first,last", lines[0])
+	assert.Equal(t, "2018-04-01,5,8,3,0,0,0,0.625,06:00:00,06:35:00", lines[1])
+
+	var table bytes.Buffer
+	assert.NoError(t, report.WriteTable(&table))
+	assert.Contains(t, table.String(), "gaps:")
+
+	data, err := json.Marshal(report)
+	assert.NoError(t, err)
+	var decoded GapReport
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, report.Missing, decoded.Missing)
+	assert.Len(t, decoded.Days, 1)
+}
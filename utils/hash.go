@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/cespare/xxhash"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// HashSha256 is the SHA-256 content hash
+	HashSha256 = "sha256"
+	// HashXxhash is the (much faster, non cryptographic) 64 bit xxhash content hash
+	HashXxhash = "xxhash"
+)
+
+// HashAlgorithm is the hash LoadImage (and CopyImage and MoveImage, for images without one) compute into
+// Image.Hash, empty to disable hashing.
+var HashAlgorithm = ""
+
+var (
+	dedupeFlag    bool
+	hashIndexFlag string
+)
+
+// HashFlags adds the -hash, -dedupe and -hashindex flags shared by the tools, call it before flag.Parse.
+func HashFlags() {
+	flag.StringVar(&HashAlgorithm, "hash", "", "content hash to compute (sha256, xxhash)")
+	flag.BoolVar(&dedupeFlag, "dedupe", false, "drop byte identical images")
+	flag.StringVar(&hashIndexFlag, "hashindex", "", "persistent hash index for -dedupe")
+}
+
+// FlagDeduper checks -hash and returns a Deduper for -dedupe and -hashindex, or nil if neither was given.
+// call it after flag.Parse.
+func FlagDeduper() (*Deduper, error) {
+	if HashAlgorithm != "" {
+		if _, err := newHasher(HashAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+	if !dedupeFlag && hashIndexFlag == "" {
+		return nil, nil
+	}
+	return NewDeduper(HashAlgorithm, hashIndexFlag)
+}
+
+// newHasher returns a hash.Hash for an algorithm name.
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashSha256:
+		return sha256.New(), nil
+	case HashXxhash:
+		return xxhash.New(), nil
+	}
+	return nil, fmt.Errorf("[hash] unknown hash algorithm %q", algorithm)
+}
+
+// formatHash formats a hash sum as <algorithm>:<hex>, the form stored in Image.Hash.
+func formatHash(algorithm string, hasher hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+// HashReader streams r through the hash algorithm and returns the formatted hash.
+func HashReader(r io.Reader, algorithm string) (string, error) {
+	hasher, err := newHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return formatHash(algorithm, hasher), nil
+}
+
+// HashImage returns the hash of an image, from its data if it has any otherwise from the file at its path.
+func HashImage(img Image, algorithm string) (string, error) {
+	if len(img.Data) != 0 {
+		return HashReader(bytes.NewReader(img.Data), algorithm)
+	}
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return HashReader(file, algorithm)
+}
+
+// CopyImage copies the file of an image to dest, filling in img.Hash from the copy if HashAlgorithm is set
+// and the image doesnt already have one.
+func CopyImage(img *Image, dest string) error {
+	algorithm := HashAlgorithm
+	if img.Hash != "" {
+		algorithm = ""
+	}
+	sum, err := CopyFileHashed(img.Path, dest, false, algorithm)
+	if sum != "" {
+		img.Hash = sum
+	}
+	return err
+}
+
+// MoveImage renames the file of an image to dest, copying and removing it if it cant be renamed (ie across
+// filesystems). img.Hash is filled in first if HashAlgorithm is set and the image doesnt already have one.
+func MoveImage(img *Image, dest string) error {
+	if HashAlgorithm != "" && img.Hash == "" {
+		sum, err := HashImage(*img, HashAlgorithm)
+		if err != nil {
+			return err
+		}
+		img.Hash = sum
+	}
+	if err := os.Rename(img.Path, dest); err == nil {
+		return nil
+	}
+	return MoveFilebyCopy(img.Path, dest, true)
+}
+
+// Deduper drops images whose content has already been kept, either earlier in the run or in a persistent hash index.
+// images are checked with Drop, and only recorded with Keep once they have been written out, so that images that
+// are later dropped or fail to write arent taken for duplicates next time.
+// the index is a text file of "<hash>  <path>" lines, appended to by Keep. writes to it arent buffered.
+type Deduper struct {
+	algorithm string
+	seen      map[string]string
+	index     *os.File
+	mutex     sync.Mutex
+}
+
+// NewDeduper creates a Deduper using algorithm to hash images without a Hash.
+// if indexPath is not empty the hashes in it are loaded and new hashes are appended to it.
+func NewDeduper(algorithm, indexPath string) (*Deduper, error) {
+	if algorithm == "" {
+		algorithm = HashSha256
+	}
+	if _, err := newHasher(algorithm); err != nil {
+		return nil, err
+	}
+	d := &Deduper{algorithm: algorithm, seen: map[string]string{}}
+	if indexPath == "" {
+		return d, nil
+	}
+
+	index, err := os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, os.FileMode(OsUserRW|OsGroupRW))
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(index)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		d.seen[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		index.Close()
+		return nil, err
+	}
+	d.index = index
+	return d, nil
+}
+
+// hash fills in img.Hash with the algorithm of the Deduper if it doesnt have one.
+func (d *Deduper) hash(img *Image) (err error) {
+	if img.Hash == "" || !strings.HasPrefix(img.Hash, d.algorithm+":") {
+		img.Hash, err = HashImage(*img, d.algorithm)
+	}
+	return
+}
+
+// Seen hashes an image (filling img.Hash if it is empty) and returns the path of the image kept with the same hash,
+// and true if the image is a duplicate. an image is never a duplicate of itself, ie when a run is repeated.
+func (d *Deduper) Seen(img *Image) (string, bool, error) {
+	if err := d.hash(img); err != nil {
+		return "", false, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if original, ok := d.seen[img.Hash]; ok && original != img.Path {
+		return original, true, nil
+	}
+	return "", false, nil
+}
+
+// Keep records the hash of an image that has been written out, so that later images with the same content are
+// dropped. call it with the image as it was passed to Drop, before its path is changed. errors are logged.
+func (d *Deduper) Keep(img Image) {
+	if d == nil {
+		return
+	}
+	if err := d.hash(&img); err != nil {
+		errLog.Printf("[dedupe] %s", err)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.seen[img.Hash]; ok {
+		return
+	}
+	d.seen[img.Hash] = img.Path
+	if d.index != nil {
+		if _, err := fmt.Fprintf(d.index, "%s  %s\n", img.Hash, img.Path); err != nil {
+			errLog.Printf("[dedupe] %s", err)
+		}
+	}
+}
+
+// Drop returns true if an image is a duplicate and should be dropped, logging what it duplicates.
+// images that fail to hash are kept. a nil Deduper never drops anything.
+func (d *Deduper) Drop(img *Image) bool {
+	if d == nil {
+		return false
+	}
+	original, dup, err := d.Seen(img)
+	if err != nil {
+		errLog.Printf("[dedupe] %s", err)
+		return false
+	}
+	if dup {
+		errLog.Printf("[dedupe] %s is a duplicate of %s", img.Path, original)
+	}
+	return dup
+}
+
+// Filter wraps emit so that images are checked again as they are emitted, for tools that buffer images before
+// writing them (ie the samplers of tsalign). an image checked when it arrived isnt a duplicate of an image kept
+// while it was buffered, it is dropped here instead. a nil Deduper filters nothing.
+func (d *Deduper) Filter(emit func(Image)) func(Image) {
+	if d == nil {
+		return emit
+	}
+	return func(img Image) {
+		if !d.Drop(&img) {
+			emit(img)
+		}
+	}
+}
+
+// Close closes the hash index
+func (d *Deduper) Close() error {
+	if d == nil || d.index == nil {
+		return nil
+	}
+	return d.index.Close()
+}
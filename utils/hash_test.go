@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyFileHashed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src.jpg")
+	ioutil.WriteFile(src, []byte("not really a jpeg"), 0644)
+
+	for _, algorithm := range []string{HashSha256, HashXxhash} {
+		dest := filepath.Join(dir, algorithm+".jpg")
+		sum, err := CopyFileHashed(src, dest, false, algorithm)
+		if !assert.NoError(t, err, algorithm) {
+			continue
+		}
+		assert.True(t, strings.HasPrefix(sum, algorithm+":"), sum)
+		assert.FileExists(t, dest)
+
+		expected, err := HashImage(Image{Path: src}, algorithm)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, sum)
+	}
+	sum, err := HashImage(Image{Data: []byte("not really a jpeg")}, HashSha256)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+HashBytes([]byte("not really a jpeg")), sum)
+
+	_, err = HashImage(Image{Path: src}, "md5")
+	assert.Error(t, err)
+}
+
+func TestMoveImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "move-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src.jpg")
+	ioutil.WriteFile(src, []byte("not really a jpeg"), 0644)
+	HashAlgorithm = HashSha256
+	defer func() { HashAlgorithm = "" }()
+
+	img := Image{Path: src}
+	dest := filepath.Join(dir, "dest.jpg")
+	assert.NoError(t, MoveImage(&img, dest))
+	assert.FileExists(t, dest)
+	_, err = os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "sha256:"+HashBytes([]byte("not really a jpeg")), img.Hash)
+}
+
+func TestDeduper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedupe-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := Image{Path: filepath.Join(dir, "a.jpg"), Data: []byte("aaaa")}
+	b := Image{Path: filepath.Join(dir, "b.jpg"), Data: []byte("bbbb")}
+	aCopy := Image{Path: filepath.Join(dir, "a-copy.jpg"), Data: []byte("aaaa")}
+	index := filepath.Join(dir, "hashes.txt")
+
+	d, err := NewDeduper(HashXxhash, index)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, d.Drop(&a))
+	assert.False(t, d.Drop(&b))
+	// nothing is a duplicate of an image that wasnt kept, ie one that failed to write
+	assert.False(t, d.Drop(&aCopy))
+	d.Keep(a)
+	d.Keep(b)
+	assert.True(t, d.Drop(&aCopy))
+	assert.Equal(t, a.Hash, aCopy.Hash)
+	// an image isnt a duplicate of itself
+	assert.False(t, d.Drop(&a))
+	assert.NoError(t, d.Close())
+
+	// a later run with the same index drops images seen in the first run
+	d, err = NewDeduper(HashXxhash, index)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.Close()
+	bCopy := Image{Path: filepath.Join(dir, "b-copy.jpg"), Data: []byte("bbbb")}
+	original, dup, err := d.Seen(&bCopy)
+	assert.NoError(t, err)
+	assert.True(t, dup)
+	assert.Equal(t, b.Path, original)
+	// a repeated run over the same paths
+	_, dup, err = d.Seen(&b)
+	assert.NoError(t, err)
+	assert.False(t, dup)
+
+	var nilDeduper *Deduper
+	assert.False(t, nilDeduper.Drop(&a))
+	nilDeduper.Keep(a)
+	assert.NoError(t, nilDeduper.Close())
+}
+
+func TestDeduperFilter(t *testing.T) {
+	d, err := NewDeduper(HashXxhash, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	a, _ := NewAlignment(5*time.Minute, AlignFloor, 0)
+	var written []string
+	s := NewAlignedSampler(a, d.Filter(func(img Image) {
+		written = append(written, img.Path)
+		d.Keep(img)
+	}))
+	for _, img := range []Image{
+		{Path: "original", Data: []byte("aaaa"), Timestamp: wallClock("2018-04-01T10:00:00")},
+		// a re-upload in the same slot, only one of them is kept by the sampler
+		{Path: "same-slot", Data: []byte("aaaa"), Timestamp: wallClock("2018-04-01T10:01:00")},
+		// and in the next slot, it arrives before the original is written
+		{Path: "next-slot", Data: []byte("aaaa"), Timestamp: wallClock("2018-04-01T10:05:00")},
+		{Path: "other", Data: []byte("bbbb"), Timestamp: wallClock("2018-04-01T10:10:00")},
+	} {
+		if !d.Drop(&img) {
+			s.Add(img)
+		}
+	}
+	s.Flush()
+	assert.Equal(t, []string{"original", "other"}, written)
+
+	// nil filters nothing
+	var none *Deduper
+	emitted := 0
+	none.Filter(func(Image) { emitted++ })(Image{})
+	assert.Equal(t, 1, emitted)
+}
@@ -0,0 +1,477 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// IndexJSONLines writes indices as one json object per line
+	IndexJSONLines = "jsonl"
+	// IndexCSV writes indices as csv with a header row
+	IndexCSV = "csv"
+
+	// IndexName is the index of the images in each directory, IndexName.<format>
+	IndexName = ".tsindex"
+	// StreamIndexName is the summary of each stream at the root, StreamIndexName.<format>
+	StreamIndexName = ".tsindex-streams"
+	// DirIndexName is the list of indexed directories at the root, DirIndexName.<format>
+	DirIndexName = ".tsindex-dirs"
+
+	// IndexFlushInterval is the longest an Indexer holds changes in memory, how stale the indices of a killed run get
+	IndexFlushInterval = 10 * time.Second
+)
+
+var (
+	indexHeader       = []string{"name", "timestamp", "stream", "variant", "size", "hash"}
+	streamIndexHeader = []string{"stream", "first", "last", "count"}
+	dirIndexHeader    = []string{"dir"}
+)
+
+// IndexEntry is an image in a directory index.
+type IndexEntry struct {
+	Name      string    `json:"name"`
+	Timestamp time.Time `json:"timestamp"`
+	Stream    string    `json:"stream,omitempty"`
+	Variant   string    `json:"variant,omitempty"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+// StreamSummary is a row of the stream index.
+// First and Last only ever widen, removing the first or last image of a stream leaves them as they were.
+type StreamSummary struct {
+	Stream string    `json:"stream"`
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+	Count  int       `json:"count"`
+}
+
+// DirEntry is a row of the directory index, Dir is relative to the root.
+type DirEntry struct {
+	Dir string `json:"dir"`
+}
+
+type indexRow interface {
+	record() []string
+}
+
+func (e IndexEntry) record() []string {
+	return []string{e.Name, e.Timestamp.Format(time.RFC3339Nano), e.Stream, e.Variant, strconv.FormatInt(e.Size, 10), e.Hash}
+}
+
+func (s StreamSummary) record() []string {
+	return []string{s.Stream, s.First.Format(time.RFC3339Nano), s.Last.Format(time.RFC3339Nano), strconv.Itoa(s.Count)}
+}
+
+func (d DirEntry) record() []string {
+	return []string{d.Dir}
+}
+
+// Indexer keeps the indices of a tree of images up to date as images are added and removed, so that the tree
+// can be read without walking it. each index is replaced atomically (written to a temporary file and renamed).
+// changes are kept in memory and written when an image from another directory is added or removed, when they are
+// older than FlushInterval, and by Flush, which must be called at the end.
+// an Indexer assumes it is the only one writing to its root. a nil Indexer does nothing.
+type Indexer struct {
+	Root   string
+	Format string
+	// FlushInterval is how long changes can be held before they are written, zero to only write them when the
+	// directory changes and at Flush
+	FlushInterval time.Duration
+
+	// the images of the last directory touched
+	dir     string
+	entries []IndexEntry
+
+	streams map[string]*StreamSummary
+	dirs    map[string]bool
+
+	// which indices have changes that arent written yet, and when they were last written
+	dirDirty, streamsDirty, dirsDirty bool
+	flushed                           time.Time
+}
+
+// NewIndexer returns an Indexer for the tree under root, loading the stream and directory indices if they exist.
+func NewIndexer(root, format string) (*Indexer, error) {
+	if format != IndexJSONLines && format != IndexCSV {
+		return nil, fmt.Errorf("unknown index format %q (choices: %s,%s)", format, IndexJSONLines, IndexCSV)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	ix := &Indexer{
+		Root:          root,
+		Format:        format,
+		FlushInterval: IndexFlushInterval,
+		streams:       map[string]*StreamSummary{},
+		dirs:          map[string]bool{},
+		flushed:       time.Now(),
+	}
+
+	err = readIndex(ix.indexPath(StreamIndexName), format, func(record []string, line []byte) error {
+		var s StreamSummary
+		if line != nil {
+			if err := json.Unmarshal(line, &s); err != nil {
+				return err
+			}
+		} else if len(record) >= len(streamIndexHeader) {
+			s.Stream = record[0]
+			s.First, _ = time.Parse(time.RFC3339Nano, record[1])
+			s.Last, _ = time.Parse(time.RFC3339Nano, record[2])
+			s.Count, _ = strconv.Atoi(record[3])
+		}
+		ix.streams[s.Stream] = &s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = readIndex(ix.indexPath(DirIndexName), format, func(record []string, line []byte) error {
+		var d DirEntry
+		if line != nil {
+			if err := json.Unmarshal(line, &d); err != nil {
+				return err
+			}
+		} else if len(record) >= 1 {
+			d.Dir = record[0]
+		}
+		ix.dirs[d.Dir] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// indexPath returns the path of an index named name in the root.
+func (ix *Indexer) indexPath(name string) string {
+	return filepath.Join(ix.Root, name+"."+ix.Format)
+}
+
+// IsIndex returns true if a path is an index or a temporary file of one.
+func IsIndex(filePath string) bool {
+	return strings.HasPrefix(filepath.Base(filePath), IndexName)
+}
+
+// load makes dir the current directory, writing the changes to the last one and reading the index of dir.
+func (ix *Indexer) load(dir string) error {
+	if dir == ix.dir {
+		return nil
+	}
+	if err := ix.Flush(); err != nil {
+		return err
+	}
+	var entries []IndexEntry
+	err := readIndex(filepath.Join(dir, IndexName+"."+ix.Format), ix.Format, func(record []string, line []byte) error {
+		var e IndexEntry
+		if line != nil {
+			if err := json.Unmarshal(line, &e); err != nil {
+				return err
+			}
+		} else if len(record) >= len(indexHeader) {
+			e.Name, e.Stream, e.Variant, e.Hash = record[0], record[2], record[3], record[5]
+			e.Timestamp, _ = time.Parse(time.RFC3339Nano, record[1])
+			e.Size, _ = strconv.ParseInt(record[4], 10, 64)
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ix.dir, ix.entries = dir, entries
+	return nil
+}
+
+// Add adds an image (or replaces it if it is already in the index).
+func (ix *Indexer) Add(img Image) error {
+	if ix == nil {
+		return nil
+	}
+	absPath, err := filepath.Abs(img.Path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(absPath)
+	if err := ix.load(dir); err != nil {
+		return err
+	}
+
+	entry := IndexEntry{
+		Name:      filepath.Base(absPath),
+		Timestamp: img.Timestamp,
+		Stream:    img.Stream,
+		Variant:   img.Variant,
+		Size:      info.Size(),
+		Hash:      img.Hash,
+	}
+	replaced := false
+	for i, e := range ix.entries {
+		if e.Name == entry.Name {
+			ix.entries = append(ix.entries[:i], ix.entries[i+1:]...)
+			replaced = true
+			break
+		}
+	}
+	// in timestamp order
+	i := sort.Search(len(ix.entries), func(i int) bool {
+		e := ix.entries[i]
+		return e.Timestamp.After(entry.Timestamp) || (e.Timestamp.Equal(entry.Timestamp) && e.Name > entry.Name)
+	})
+	ix.entries = append(ix.entries, IndexEntry{})
+	copy(ix.entries[i+1:], ix.entries[i:])
+	ix.entries[i] = entry
+	ix.dirDirty = true
+
+	stream := img.StreamName()
+	s, ok := ix.streams[stream]
+	if !ok {
+		s = &StreamSummary{Stream: stream, First: entry.Timestamp, Last: entry.Timestamp}
+		ix.streams[stream] = s
+	}
+	if entry.Timestamp.Before(s.First) {
+		s.First = entry.Timestamp
+	}
+	if entry.Timestamp.After(s.Last) {
+		s.Last = entry.Timestamp
+	}
+	if !replaced {
+		s.Count++
+	}
+	ix.streamsDirty = true
+	return ix.flushIfDue()
+}
+
+// Remove removes an image from the indices, an image that isnt in them is ignored.
+func (ix *Indexer) Remove(imgPath string) error {
+	if ix == nil {
+		return nil
+	}
+	absPath, err := filepath.Abs(imgPath)
+	if err != nil {
+		return err
+	}
+	if err := ix.load(filepath.Dir(absPath)); err != nil {
+		return err
+	}
+	name := filepath.Base(absPath)
+	for i, e := range ix.entries {
+		if e.Name != name {
+			continue
+		}
+		ix.entries = append(ix.entries[:i], ix.entries[i+1:]...)
+		ix.dirDirty = true
+		stream := FilenameParts{Stream: e.Stream, Variant: e.Variant}.Name()
+		if s, ok := ix.streams[stream]; ok {
+			if s.Count--; s.Count <= 0 {
+				delete(ix.streams, stream)
+			}
+			ix.streamsDirty = true
+		}
+		return ix.flushIfDue()
+	}
+	return nil
+}
+
+// flushIfDue flushes the changes if the indices havent been written for FlushInterval.
+func (ix *Indexer) flushIfDue() error {
+	if ix.FlushInterval > 0 && time.Since(ix.flushed) >= ix.FlushInterval {
+		return ix.Flush()
+	}
+	return nil
+}
+
+// Flush writes the indices that have changed.
+func (ix *Indexer) Flush() error {
+	if ix == nil {
+		return nil
+	}
+	if ix.dirDirty {
+		if err := ix.writeDir(); err != nil {
+			return err
+		}
+		ix.dirDirty = false
+	}
+	if ix.streamsDirty {
+		if err := ix.writeStreams(); err != nil {
+			return err
+		}
+		ix.streamsDirty = false
+	}
+	if ix.dirsDirty {
+		if err := ix.writeDirs(); err != nil {
+			return err
+		}
+		ix.dirsDirty = false
+	}
+	ix.flushed = time.Now()
+	return nil
+}
+
+// writeDir writes the index of the current directory, removing it if the directory has no images left, and
+// adds or removes the directory from the directory index (written by Flush).
+func (ix *Indexer) writeDir() error {
+	indexPath := filepath.Join(ix.dir, IndexName+"."+ix.Format)
+	rel, err := filepath.Rel(ix.Root, ix.dir)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+
+	if len(ix.entries) == 0 {
+		if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if ix.dirs[rel] {
+			delete(ix.dirs, rel)
+			ix.dirsDirty = true
+		}
+		return nil
+	}
+	rows := make([]indexRow, len(ix.entries))
+	for i, e := range ix.entries {
+		rows[i] = e
+	}
+	if err := writeIndex(indexPath, ix.Format, indexHeader, rows); err != nil {
+		return err
+	}
+	if !ix.dirs[rel] {
+		ix.dirs[rel] = true
+		ix.dirsDirty = true
+	}
+	return nil
+}
+
+// writeStreams writes the stream index, in stream order.
+func (ix *Indexer) writeStreams() error {
+	var rows []indexRow
+	for _, s := range ix.streams {
+		rows = append(rows, *s)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].(StreamSummary).Stream < rows[j].(StreamSummary).Stream })
+	return writeIndex(ix.indexPath(StreamIndexName), ix.Format, streamIndexHeader, rows)
+}
+
+// writeDirs writes the directory index, in directory order.
+func (ix *Indexer) writeDirs() error {
+	var dirs []string
+	for dir := range ix.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	rows := make([]indexRow, len(dirs))
+	for i, dir := range dirs {
+		rows[i] = DirEntry{Dir: dir}
+	}
+	return writeIndex(ix.indexPath(DirIndexName), ix.Format, dirIndexHeader, rows)
+}
+
+// readIndex calls add with each row of an index, the csv record or the json line depending on the format.
+// an index that doesnt exist has no rows.
+func readIndex(indexPath, format string, add func(record []string, line []byte) error) error {
+	file, err := os.Open(indexPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if format == IndexCSV {
+		reader := csv.NewReader(file)
+		// skip the header
+		if _, err := reader.Read(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%s: %s", indexPath, err)
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", indexPath, err)
+			}
+			if err := add(record, nil); err != nil {
+				return fmt.Errorf("%s: %s", indexPath, err)
+			}
+		}
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := add(nil, scanner.Bytes()); err != nil {
+			return fmt.Errorf("%s: %s", indexPath, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// writeIndex replaces an index with rows, writing it alongside and renaming it over the old one so readers
+// never see it half written.
+func writeIndex(indexPath, format string, header []string, rows []indexRow) error {
+	if len(rows) == 0 {
+		if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(indexPath), filepath.Base(indexPath)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	if format == IndexCSV {
+		w := csv.NewWriter(writer)
+		w.Write(header)
+		for _, row := range rows {
+			w.Write(row.record())
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		encoder := json.NewEncoder(writer)
+		for _, row := range rows {
+			if err = encoder.Encode(row); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(os.FileMode(OsUserRW | OsGroupRW | OsOthR))
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), indexPath)
+}
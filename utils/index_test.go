@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexer(t *testing.T) {
+	for _, format := range []string{IndexJSONLines, IndexCSV} {
+		root, err := ioutil.TempDir("", "index-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+
+		add := func(ix *Indexer, name, ts string) Image {
+			img := Image{Path: filepath.Join(root, name), Timestamp: wallClock(ts)}
+			img.ParseName()
+			os.MkdirAll(filepath.Dir(img.Path), 0755)
+			ioutil.WriteFile(img.Path, []byte(name), 0644)
+			assert.NoError(t, ix.Add(img), format)
+			return img
+		}
+
+		ix, err := NewIndexer(root, format)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		add(ix, "10/GC03L_2018_04_01_10_30_00_00.jpg", "2018-04-01T10:30:00")
+		add(ix, "10/GC03L_2018_04_01_10_00_00_00.jpg", "2018-04-01T10:00:00")
+		add(ix, "10/GC03L_2018_04_01_10_00_00_00.jpg", "2018-04-01T10:00:00")
+		add(ix, "11/GC03L_2018_04_01_11_00_00_00.jpg", "2018-04-01T11:00:00")
+		add(ix, "11/GC04L_2018_04_01_11_00_00_00.jpg", "2018-04-01T11:00:00")
+		assert.NoError(t, ix.Flush())
+
+		// read back by a new indexer, as a consumer would
+		ix, err = NewIndexer(root, format)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, map[string]bool{"10": true, "11": true}, ix.dirs, format)
+		if assert.Contains(t, ix.streams, "GC03L", format) {
+			assert.Equal(t, StreamSummary{Stream: "GC03L", First: wallClock("2018-04-01T10:00:00"), Last: wallClock("2018-04-01T11:00:00"), Count: 3}, *ix.streams["GC03L"])
+		}
+		assert.Equal(t, 1, ix.streams["GC04L"].Count, format)
+
+		assert.NoError(t, ix.load(filepath.Join(root, "10")))
+		if assert.Len(t, ix.entries, 2, format) {
+			// in timestamp order, replaced rather than added twice
+			assert.Equal(t, "GC03L_2018_04_01_10_00_00_00.jpg", ix.entries[0].Name)
+			assert.Equal(t, "GC03L", ix.entries[0].Stream)
+			assert.Equal(t, int64(len("10/GC03L_2018_04_01_10_00_00_00.jpg")), ix.entries[0].Size)
+			assert.Equal(t, wallClock("2018-04-01T10:30:00"), ix.entries[1].Timestamp)
+		}
+
+		assert.NoError(t, ix.Remove(filepath.Join(root, "11/GC04L_2018_04_01_11_00_00_00.jpg")))
+		assert.NoError(t, ix.Remove(filepath.Join(root, "11/GC03L_2018_04_01_11_00_00_00.jpg")))
+		assert.NoError(t, ix.Remove(filepath.Join(root, "11/notindexed.jpg")))
+		assert.NoError(t, ix.Flush())
+		assert.NotContains(t, ix.streams, "GC04L")
+		assert.Equal(t, 2, ix.streams["GC03L"].Count)
+		_, err = os.Stat(filepath.Join(root, "11", IndexName+"."+format))
+		assert.True(t, os.IsNotExist(err), "empty index is removed")
+
+		ix, _ = NewIndexer(root, format)
+		assert.Equal(t, map[string]bool{"10": true}, ix.dirs, format)
+
+		// no temporary files are left behind
+		files, _ := filepath.Glob(filepath.Join(root, "*", IndexName+"*"))
+		assert.Len(t, files, 1, format)
+		assert.True(t, IsIndex(files[0]))
+	}
+
+	_, err := NewIndexer(os.TempDir(), "xml")
+	assert.Error(t, err)
+	var ix *Indexer
+	assert.NoError(t, ix.Add(Image{}))
+	assert.NoError(t, ix.Flush())
+}
+
+func TestIndexerBatches(t *testing.T) {
+	root, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ix, err := NewIndexer(root, IndexJSONLines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(name, ts string) {
+		img := Image{Path: filepath.Join(root, name), Timestamp: wallClock(ts)}
+		img.ParseName()
+		os.MkdirAll(filepath.Dir(img.Path), 0755)
+		ioutil.WriteFile(img.Path, []byte(name), 0644)
+		assert.NoError(t, ix.Add(img))
+	}
+	indexed := func(dir string) bool {
+		_, err := os.Stat(filepath.Join(root, dir, IndexName+"."+IndexJSONLines))
+		return err == nil
+	}
+
+	// nothing is written while the images are in the same directory
+	add("10/GC03L_2018_04_01_10_00_00_00.jpg", "2018-04-01T10:00:00")
+	add("10/GC03L_2018_04_01_10_30_00_00.jpg", "2018-04-01T10:30:00")
+	assert.False(t, indexed("10"))
+	_, err = os.Stat(ix.indexPath(StreamIndexName))
+	assert.True(t, os.IsNotExist(err))
+
+	// moving on to another directory writes the last one
+	add("11/GC03L_2018_04_01_11_00_00_00.jpg", "2018-04-01T11:00:00")
+	assert.True(t, indexed("10"))
+	assert.False(t, indexed("11"))
+	reader, _ := NewIndexer(root, IndexJSONLines)
+	assert.Equal(t, map[string]bool{"10": true}, reader.dirs)
+	assert.Equal(t, 2, reader.streams["GC03L"].Count)
+
+	// or once the changes are older than FlushInterval
+	ix.flushed = ix.flushed.Add(-IndexFlushInterval)
+	add("11/GC03L_2018_04_01_11_30_00_00.jpg", "2018-04-01T11:30:00")
+	assert.True(t, indexed("11"))
+	add("11/GC03L_2018_04_01_11_45_00_00.jpg", "2018-04-01T11:45:00")
+	reader, _ = NewIndexer(root, IndexJSONLines)
+	assert.Equal(t, 4, reader.streams["GC03L"].Count)
+
+	// and the rest is written by Flush
+	assert.NoError(t, ix.Flush())
+	assert.True(t, indexed("11"))
+	reader, _ = NewIndexer(root, IndexJSONLines)
+	assert.Equal(t, map[string]bool{"10": true, "11": true}, reader.dirs)
+	assert.Equal(t, 5, reader.streams["GC03L"].Count)
+}
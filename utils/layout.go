@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// LayoutTimestream is the DefaultTsDirectoryStructure, 2018/2018_04/2018_04_01/2018_04_01_10/
+	LayoutTimestream = "timestream"
+	// LayoutDaily is a directory per day, 2018/2018_04/2018_04_01/
+	LayoutDaily = "daily"
+	// LayoutHive is hive style partitions, year=2018/month=04/day=01/
+	LayoutHive = "hive"
+	// LayoutISOWeek is a directory per ISO week, 2018/2018-W13/
+	LayoutISOWeek = "isoweek"
+	// LayoutFlat puts every image in the top directory
+	LayoutFlat = "flat"
+
+	// layoutStreamPrefix puts a layout under a directory per stream, ie stream/hive is GC03L/year=2018/month=04/day=01/
+	layoutStreamPrefix = "stream/"
+)
+
+// Layouts are the named layouts
+var Layouts = []string{LayoutTimestream, LayoutDaily, LayoutHive, LayoutISOWeek, LayoutFlat}
+
+// Layout is how images are arranged in directories by their timestamp, and optionally their stream.
+type Layout struct {
+	Name string
+	// Stream puts each stream in its own top level directory
+	Stream bool
+	// Format is a time.Format layout for the directories when Name is empty
+	Format string
+}
+
+// ParseLayout parses a named layout, optionally prefixed with stream/ (ie stream/hive), or a time.Format layout
+// (ie 2006/01/02/) if it isnt one of the names.
+func ParseLayout(value string) (Layout, error) {
+	var l Layout
+	if strings.HasPrefix(value, layoutStreamPrefix) {
+		l.Stream = true
+		value = strings.TrimPrefix(value, layoutStreamPrefix)
+	}
+	for _, name := range Layouts {
+		if value == name {
+			l.Name = name
+			return l, nil
+		}
+	}
+	if !strings.Contains(value, "2006") && !strings.Contains(value, "06") {
+		return l, fmt.Errorf("%q isnt a layout (choices: %s) or a time format with a year", value, strings.Join(Layouts, ","))
+	}
+	l.Format = value
+	return l, nil
+}
+
+// String returns the layout as it would be parsed.
+func (l Layout) String() string {
+	value := l.Name
+	if value == "" {
+		value = l.Format
+	}
+	if l.Stream {
+		value = layoutStreamPrefix + value
+	}
+	return value
+}
+
+// Dir returns the directory an image goes in, relative to the root of the layout.
+func (l Layout) Dir(img Image) string {
+	t := img.Timestamp
+	var dir string
+	switch l.Name {
+	case LayoutTimestream:
+		dir = t.Format(DefaultTsDirectoryStructure)
+	case LayoutDaily:
+		dir = t.Format("2006/2006_01/2006_01_02/")
+	case LayoutHive:
+		dir = t.Format("year=2006/month=01/day=02/")
+	case LayoutISOWeek:
+		year, week := t.ISOWeek()
+		dir = fmt.Sprintf("%04d/%04d-W%02d/", year, year, week)
+	case LayoutFlat:
+	default:
+		dir = t.Format(l.Format)
+	}
+	if l.Stream {
+		stream := img.StreamName()
+		if stream == "" {
+			stream = "unknown"
+		}
+		dir = filepath.Join(stream, dir)
+	}
+	return filepath.Clean(filepath.FromSlash(dir))
+}
+
+// Path returns where an image goes under root.
+func (l Layout) Path(root string, img Image) string {
+	return filepath.Join(root, l.Dir(img), filepath.Base(img.Path))
+}
+
+// MoveVerified moves src to dest, checking the content hash of dest matches src before src is removed.
+// it is renamed if it can be, which doesnt change the content so isnt hashed, otherwise copied and both are hashed.
+// if dest already exists with the same content src is removed, with different content it is an error.
+func MoveVerified(src, dest, algorithm string) error {
+	if algorithm == "" {
+		algorithm = HashSha256
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return removeIfSame(src, dest, algorithm, fmt.Sprintf("%s already exists with different content", dest))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	// across filesystems
+	if err := MoveFilebyCopy(src, dest, false); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	if err := removeIfSame(src, dest, algorithm, fmt.Sprintf("%s doesnt match %s after it was copied", dest, src)); err != nil {
+		// the source is still there
+		os.Remove(dest)
+		return err
+	}
+	return nil
+}
+
+// removeIfSame removes src if it has the same content hash as dest, otherwise returns an error with the message.
+func removeIfSame(src, dest, algorithm, message string) error {
+	srcHash, err := HashImage(Image{Path: src}, algorithm)
+	if err != nil {
+		return err
+	}
+	destHash, err := HashImage(Image{Path: dest}, algorithm)
+	if err != nil {
+		return err
+	}
+	if destHash != srcHash {
+		return errors.New(message)
+	}
+	return os.Remove(src)
+}
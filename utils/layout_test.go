@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	img := Image{Path: "/data/GC03L~fullres_2018_04_01_10_00_00_00.jpg", Timestamp: wallClock("2018-04-01T10:00:00")}
+	img.ParseName()
+
+	for value, dir := range map[string]string{
+		LayoutTimestream:    "2018/2018_04/2018_04_01/2018_04_01_10",
+		LayoutDaily:         "2018/2018_04/2018_04_01",
+		LayoutHive:          "year=2018/month=04/day=01",
+		LayoutISOWeek:       "2018/2018-W13",
+		LayoutFlat:          ".",
+		"stream/hive":       "GC03L~fullres/year=2018/month=04/day=01",
+		"stream/flat":       "GC03L~fullres",
+		"2006/01/02":        "2018/04/01",
+		"stream/2006_01_02": "GC03L~fullres/2018_04_01",
+	} {
+		l, err := ParseLayout(value)
+		if !assert.NoError(t, err, value) {
+			continue
+		}
+		assert.Equal(t, filepath.FromSlash(dir), l.Dir(img), value)
+		assert.Equal(t, value, l.String())
+	}
+	l, _ := ParseLayout("stream/flat")
+	assert.Equal(t, filepath.FromSlash("/out/GC03L~fullres/GC03L~fullres_2018_04_01_10_00_00_00.jpg"), l.Path("/out", img))
+
+	// the first days of january can be in the last week of the year before
+	img.Timestamp = wallClock("2021-01-01T10:00:00")
+	l, _ = ParseLayout(LayoutISOWeek)
+	assert.Equal(t, filepath.FromSlash("2020/2020-W53"), l.Dir(img))
+
+	_, err := ParseLayout("weekly")
+	assert.Error(t, err)
+}
+
+func TestMoveVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "a.jpg")
+	dest := filepath.Join(dir, "2018", "a.jpg")
+	ioutil.WriteFile(src, []byte("a"), 0644)
+	assert.NoError(t, MoveVerified(src, dest, ""))
+	assert.FileExists(t, dest)
+	_, err = os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+
+	// already migrated
+	ioutil.WriteFile(src, []byte("a"), 0644)
+	assert.NoError(t, MoveVerified(src, dest, HashXxhash))
+	_, err = os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+
+	// a different file in the way is left alone
+	ioutil.WriteFile(src, []byte("b"), 0644)
+	assert.Error(t, MoveVerified(src, dest, ""))
+	assert.FileExists(t, src)
+	data, _ := ioutil.ReadFile(dest)
+	assert.Equal(t, "a", string(data))
+}
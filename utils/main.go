@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/ugorji/go/codec"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -30,10 +31,10 @@ const (
 )
 
 var (
-	errLog        *log.Logger
-	jsonEncoder   *json.Encoder
-	jsonDecoder   *json.Decoder
-	mh      codec.MsgpackHandle
+	errLog      *log.Logger
+	jsonEncoder *json.Encoder
+	jsonDecoder *json.Decoder
+	mh          codec.MsgpackHandle
 	//jh      codec.JsonHandle
 	msgpackDecoder *codec.Decoder
 	msgpackEncoder *codec.Encoder
@@ -41,78 +42,89 @@ var (
 
 const (
 	// OsRead Read bit
-	OsRead        = 04
+	OsRead = 04
 	// OsWrite bit
-	OsWrite       = 02
+	OsWrite = 02
 	// OsEx execute bit
-	OsEx          = 01
+	OsEx = 01
 	// OsUserShift user shift
-	OsUserShift  = 6
+	OsUserShift = 6
 	// OsGroupShift group Shift
 	OsGroupShift = 3
 	// OsOtherShift other shift
-	OsOtherShift   = 0
+	OsOtherShift = 0
 
 	// OsUserR user read
-	OsUserR   = OsRead << OsUserShift
+	OsUserR = OsRead << OsUserShift
 	// OsUserW user write
-	OsUserW   = OsWrite << OsUserShift
+	OsUserW = OsWrite << OsUserShift
 	// OsUserX user execute
-	OsUserX   = OsEx << OsUserShift
+	OsUserX = OsEx << OsUserShift
 	// OsUserRW user read/write
-	OsUserRW  = OsUserR | OsUserW
+	OsUserRW = OsUserR | OsUserW
 	// OsUserRWX user read/write/execute
 	OsUserRWX = OsUserRW | OsUserX
 
 	// OsGroupR group read
-	OsGroupR   = OsRead << OsGroupShift
+	OsGroupR = OsRead << OsGroupShift
 	// OsGroupW group write
-	OsGroupW   = OsWrite << OsGroupShift
+	OsGroupW = OsWrite << OsGroupShift
 	// OsGroupX group execute
-	OsGroupX   = OsEx << OsGroupShift
+	OsGroupX = OsEx << OsGroupShift
 	// OsGroupRW group read/write
-	OsGroupRW  = OsGroupR | OsGroupW
+	OsGroupRW = OsGroupR | OsGroupW
 	// OsGroupRWX group read/write/execute
 	OsGroupRWX = OsGroupRW | OsGroupX
 
 	// OsOthR other read
-	OsOthR   = OsRead << OsOtherShift
+	OsOthR = OsRead << OsOtherShift
 	// OsOthW other write
-	OsOthW   = OsWrite << OsOtherShift
+	OsOthW = OsWrite << OsOtherShift
 	// OsOthX other execute
-	OsOthX   = OsEx << OsOtherShift
+	OsOthX = OsEx << OsOtherShift
 	// OsOthRW other read/write
-	OsOthRW  = OsOthR | OsOthW
+	OsOthRW = OsOthR | OsOthW
 	// OsOthRWX other read/write/execute
 	OsOthRWX = OsOthRW | OsOthX
 
 	// OsAllR all read
-	OsAllR   = OsUserR | OsGroupR | OsOthR
+	OsAllR = OsUserR | OsGroupR | OsOthR
 	// OsAllW all write
-	OsAllW   = OsUserW | OsGroupW | OsOthW
+	OsAllW = OsUserW | OsGroupW | OsOthW
 	// OsAllX all execute
-	OsAllX   = OsUserX | OsGroupX | OsOthX
+	OsAllX = OsUserX | OsGroupX | OsOthX
 	// OsAllRW all read/write
-	OsAllRW  = OsAllR | OsAllW
+	OsAllRW = OsAllR | OsAllW
 	// OsAllRWX all read/write/execute
 	OsAllRWX = OsAllRW | OsGroupX
 )
 
 // Image struct, definition of images and associated metadata
 type Image struct {
-	Path            string    `json:"path"`
-	OriginalPath    string    `json:"originalPath"`
-	Timestamp       time.Time `json:"timestamp"`
-	ExifTimestamp   time.Time `json:"exifTimestamp"`
-	ExifBytes       []byte    `json:"-" codec:"exifBytes"`
-	Data            []byte    `json:"-" codec:"data"`
-	CmdList         []string  `json:"cmdList"`
-	TempCleanupPath string    `json:"temp_cleanup_path,omitempty"`
+	Path            string            `json:"path"`
+	OriginalPath    string            `json:"originalPath"`
+	Timestamp       time.Time         `json:"timestamp"`
+	ExifTimestamp   time.Time         `json:"exifTimestamp"`
+	ExifBytes       []byte            `json:"-" codec:"exifBytes"`
+	Data            []byte            `json:"-" codec:"data"`
+	CmdList         []string          `json:"cmdList"`
+	TempCleanupPath string            `json:"temp_cleanup_path,omitempty"`
+	Sidecars        []string          `json:"sidecars,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Provenance      []ProvenanceStep  `json:"provenance,omitempty"`
+	Hash            string            `json:"hash,omitempty"`
+	Quality         *QualityScores    `json:"quality,omitempty"`
+	// Synthetic is how the image was made up for a slot without one (see FillNearest etc), empty for real images
+	Synthetic string `json:"synthetic,omitempty"`
+	// Stream, Variant and Subsecond are parsed from the filename, see FilenameParts
+	Stream    string `json:"stream,omitempty"`
+	Variant   string `json:"variant,omitempty"`
+	Subsecond string `json:"subsecond,omitempty"`
 }
 
 // Emit outputs a serialised image to stdout using the defined output format
 func Emit(img Image, outfmt string) error {
-	switch  outfmt {
+	switch outfmt {
 	case "path":
 		_, err := fmt.Fprintln(os.Stdout, img.Path)
 		return err
@@ -124,6 +136,12 @@ func Emit(img Image, outfmt string) error {
 	return jsonEncoder.Encode(img)
 }
 
+// EmitPath outputs a path to stdout
+func EmitPath(thisPath string) error {
+	_, err := fmt.Fprintln(os.Stdout, thisPath)
+	return err
+}
+
 //func EmitJson(img Image) error {
 //
 //	//jsonStr, err := json.Marshal(img)
@@ -136,7 +154,7 @@ func Emit(img Image, outfmt string) error {
 //}
 
 // EmitCleanup emit a directory cleanup message.
-func EmitCleanup(tmpDir, outfmt string) error{
+func EmitCleanup(tmpDir, outfmt string) error {
 	// pass delete dir onto next step once finished
 	switch outfmt {
 	case "path":
@@ -153,6 +171,7 @@ func EmitCleanup(tmpDir, outfmt string) error{
 
 // handleImageFn function type for handing images
 type handleImageFn func(img Image) error
+
 // handleTempFn function type for handling cleanup
 type handleTempFn func(path string) error
 
@@ -189,6 +208,7 @@ func Handle(handleImageFn handleImageFn, cleanupFn handleTempFn, infmt string) e
 	}
 	return nil
 }
+
 // getDtFromExif get a datetime from exif data
 func getDtFromExif(exifData *exif.Exif) (datetime time.Time, err error) {
 	// get the exif datetime
@@ -249,13 +269,39 @@ func LoadImage(imgPath string) (img Image, err error) {
 		}
 	}
 
+	// sidecars take precedence over the embedded exif
+	img.Sidecars = FindSidecars(img.Path)
+	if len(img.Sidecars) != 0 {
+		if sidecarTime, sidecarErr := sidecarTimestamp(img.Sidecars); sidecarErr == nil {
+			img.ExifTimestamp = sidecarTime
+		}
+	}
+
 	if timestamp, err := GetTimeFromFileTimestamp(imgPath); err == nil {
 		img.Timestamp = timestamp
 	}
+	img.ParseName()
+
+	// carry on the provenance chain of the tool that wrote the image
+	if steps, provErr := ReadProvenance(img.Path); provErr == nil {
+		img.Provenance = steps
+	} else {
+		errLog.Printf("[provenance] %s", provErr)
+	}
 
 	// make sure we seek back
 	file.Seek(0, io.SeekStart)
 
+	if HashAlgorithm != "" {
+		// stream the whole file through the hash, then seek back again
+		if hash, hashErr := HashReader(file, HashAlgorithm); hashErr == nil {
+			img.Hash = hash
+		} else {
+			errLog.Printf("[hash] %s", hashErr)
+		}
+		file.Seek(0, io.SeekStart)
+	}
+
 	if len(img.Data) != 0 {
 		// read the image bytes into the img.Data
 		buf := new(bytes.Buffer)
@@ -293,56 +339,26 @@ func ParseExifDatetime(datetimeString string) (time.Time, error) {
 	return thisTime, nil
 }
 
-// exifFromJSON unmarshal struct for exif datetimes.
-type exifFromJSON struct {
-	DateTime          string
-	DateTimeOriginal  string
-	DateTimeDigitized string
-}
-
-// GetTimeFromExif gets a time.Time from either the exif in an image, or the exif json for that image
+// GetTimeFromExif gets a time.Time from either the sidecars of an image, or the exif in the image
 func GetTimeFromExif(thisFile string) (datetime time.Time, err error) {
-
-	var datetimeString string
-	if _, ferr := os.Stat(thisFile + ".json"); ferr == nil {
-		eData := exifFromJSON{}
-		//	do something with the json.
-
-		byt, err := ioutil.ReadFile(thisFile + ".json")
-		if err != nil {
-			return time.Time{}, err
-		}
-		if err := json.Unmarshal(byt, &eData); err != nil {
-			return time.Time{}, err
+	if sidecars := FindSidecars(thisFile); len(sidecars) != 0 {
+		if datetime, err = sidecarTimestamp(sidecars); err == nil {
+			return
 		}
-		datetimeString = eData.DateTime
+	}
 
-	} else {
-		fileHandler, err := os.Open(thisFile)
-		if err != nil {
-			// file wouldnt open
-			return time.Time{}, err
-		}
-		exifData, err := exif.Decode(fileHandler)
-		if err != nil {
-			// exif wouldnt decode
-			return time.Time{}, fmt.Errorf("[exif] couldn't decode exif from image %s", err)
-		}
-		dt, err := exifData.Get(exif.DateTime) // normally, don't ignore errors!
-		if err != nil {
-			// couldnt get DateTime from exifex
-			return time.Time{}, err
-		}
-		datetimeString, err = dt.StringVal()
-		if err != nil {
-			// couldnt get
-			return time.Time{}, err
-		}
+	fileHandler, err := os.Open(thisFile)
+	if err != nil {
+		// file wouldnt open
+		return time.Time{}, err
 	}
-	if datetime, err = ParseExifDatetime(datetimeString); err != nil {
-		return
+	defer fileHandler.Close()
+	exifData, err := exif.Decode(fileHandler)
+	if err != nil {
+		// exif wouldnt decode
+		return time.Time{}, fmt.Errorf("[exif] couldn't decode exif from image %s", err)
 	}
-	return
+	return getDtFromExif(exifData)
 }
 
 // GetTimeFromFileTimestamp gets a time.Time from the timestamp of an image
@@ -361,11 +377,18 @@ func GetTimeFromFileTimestamp(thisFile string) (time.Time, error) {
 	return t, nil
 }
 
-// MoveFilebyCopy copiers a file
-func MoveFilebyCopy(src, dst string) error {
+// MoveFilebyCopy copies a file, removing the source once it is copied if del is true
+func MoveFilebyCopy(src, dst string, del bool) error {
+	_, err := CopyFileHashed(src, dst, del, "")
+	return err
+}
+
+// CopyFileHashed copies a file like MoveFilebyCopy, streaming it through the hash algorithm on the way.
+// returns the formatted hash, or an empty string if algorithm is empty.
+func CopyFileHashed(src, dst string, del bool, algorithm string) (string, error) {
 	s, err := os.Open(src)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// no need to check errors on read only file, we already got everything
 	// we need from the filesystem, so nothing can go wrong now.
@@ -373,17 +396,39 @@ func MoveFilebyCopy(src, dst string) error {
 
 	d, err := os.Create(dst)
 	if err != nil {
-		return err
+		return "", err
 	}
 	fileMode := os.FileMode(OsUserRW | OsGroupRW)
 	d.Chmod(fileMode)
 
-	if _, err := io.Copy(d, s); err != nil {
+	var writer io.Writer = d
+	var hasher hash.Hash
+	if algorithm != "" {
+		if hasher, err = newHasher(algorithm); err != nil {
+			d.Close()
+			return "", err
+		}
+		writer = io.MultiWriter(d, hasher)
+	}
+
+	if _, err := io.Copy(writer, s); err != nil {
 		d.Close()
-		return err
+		return "", err
+	}
+
+	if err := d.Close(); err != nil {
+		return "", err
 	}
 
-	return d.Close()
+	var sum string
+	if hasher != nil {
+		sum = formatHash(algorithm, hasher)
+	}
+	if del {
+		s.Close()
+		return sum, os.Remove(src)
+	}
+	return sum, nil
 }
 
 func init() {
@@ -391,12 +436,12 @@ func init() {
 	//jsonDecoder = json.NewDecoder(os.Stdin)
 	mh.MapType = reflect.TypeOf(map[string]interface{}(nil))
 	jsonEncoder = json.NewEncoder(os.Stdout)
-		//encoder = codec.NewEncoder(os.Stdout, &jh)
+	//encoder = codec.NewEncoder(os.Stdout, &jh)
 	//case "msgpack":
 	msgpackEncoder = codec.NewEncoder(os.Stdout, &mh)
 	//}
 
-	jsonDecoder= json.NewDecoder(os.Stdin)
+	jsonDecoder = json.NewDecoder(os.Stdin)
 	//decoder= codec.NewDecoder(os.Stdin, &jh)
 	msgpackDecoder = codec.NewDecoder(os.Stdin, &mh)
 	errLog = log.New(os.Stderr, "[util] ", log.Ldate|log.Ltime|log.Lshortfile)
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultNameTemplate is <stream>[~<variant>]_<TsForm>_<subsecond><ext>, see FilenameParts
+const DefaultNameTemplate = "{{.Stream}}{{if .Variant}}~{{.Variant}}{{end}}_{{.Ts}}_{{.Subsecond}}{{.Ext}}"
+
+// gridDirectory matches the directories tscrop writes grid positions to, ie 0,1
+var gridDirectory = regexp.MustCompile(`^[0-9]+,[0-9]+$`)
+
+// NameFields are what a name template can use from an image:
+//
+//	{{.Stream}} the stream name, {{.Variant}} the variant (ie fullres), {{.Ts}} the timestamp as TsForm,
+//	{{.Subsecond}} what was after the timestamp in the filename (default 00), {{.Time "2006/01/02"}} the timestamp in any layout,
+//	{{.Timestamp}} the time itself, {{.Sequence}} the position of the image in its stream from 0,
+//	{{.Camera}} the camera model, {{.Grid}} the grid position from tscrop (ie 0,1), {{.Original}} the original
+//	basename without its extension, {{.Width}}, {{.Height}} and {{.Resolution}} (ie 1920x1080),
+//	{{.HashPrefix 8}} the start of the content hash and {{.Ext}} the extension with its dot.
+type NameFields struct {
+	Stream    string
+	Variant   string
+	Subsecond string
+	Timestamp time.Time
+	Ts        string
+	Sequence  int
+	Original  string
+	Ext       string
+
+	img    Image
+	config *image.Config
+}
+
+// Time formats the timestamp with a layout.
+func (f *NameFields) Time(layout string) string {
+	return f.Timestamp.Format(layout)
+}
+
+// Camera returns the camera model from the metadata with spaces replaced, or "unknown".
+func (f *NameFields) Camera() string {
+	if _, ok := f.img.Metadata["Model"]; !ok {
+		LoadMetadata(&f.img)
+	}
+	if model := strings.TrimSpace(f.img.Metadata["Model"]); model != "" {
+		return strings.Replace(model, " ", "-", -1)
+	}
+	return "unknown"
+}
+
+// Grid returns the grid position of a crop from tscrop, or an empty string.
+func (f *NameFields) Grid() string {
+	if grid, ok := f.img.Metadata["GridPosition"]; ok {
+		return grid
+	}
+	if dir := filepath.Base(filepath.Dir(f.img.Path)); gridDirectory.MatchString(dir) {
+		return dir
+	}
+	return ""
+}
+
+func (f *NameFields) size() (image.Config, error) {
+	if f.config == nil {
+		data, err := imageData(f.img)
+		if err != nil {
+			return image.Config{}, err
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return config, fmt.Errorf("couldn't get the size of %s: %s", f.img.Path, err)
+		}
+		f.config = &config
+	}
+	return *f.config, nil
+}
+
+// Width returns the width of the image in pixels.
+func (f *NameFields) Width() (int, error) {
+	config, err := f.size()
+	return config.Width, err
+}
+
+// Height returns the height of the image in pixels.
+func (f *NameFields) Height() (int, error) {
+	config, err := f.size()
+	return config.Height, err
+}
+
+// Resolution returns the size of the image as <width>x<height>.
+func (f *NameFields) Resolution() (string, error) {
+	config, err := f.size()
+	return fmt.Sprintf("%dx%d", config.Width, config.Height), err
+}
+
+// HashPrefix returns the first n hex digits of the content hash, hashing the image with HashAlgorithm (or sha256) if
+// it doesnt have one.
+func (f *NameFields) HashPrefix(n int) (string, error) {
+	if f.img.Hash == "" {
+		algorithm := HashAlgorithm
+		if algorithm == "" {
+			algorithm = HashSha256
+		}
+		sum, err := HashImage(f.img, algorithm)
+		if err != nil {
+			return "", err
+		}
+		f.img.Hash = sum
+	}
+	digest := f.img.Hash[strings.Index(f.img.Hash, ":")+1:]
+	if n < len(digest) {
+		digest = digest[:n]
+	}
+	return digest, nil
+}
+
+// NameTemplate names images from a text/template over NameFields, checking that no two images get the same name.
+type NameTemplate struct {
+	template *template.Template
+	sequence map[string]int
+	names    map[string]string
+}
+
+// NewNameTemplate parses a template and checks it on an example image.
+func NewNameTemplate(text string) (*NameTemplate, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("[template] %s", err)
+	}
+	t := &NameTemplate{template: tmpl, sequence: map[string]int{}, names: map[string]string{}}
+	example := &NameFields{
+		Stream:    "stream",
+		Variant:   "variant",
+		Subsecond: "00",
+		Timestamp: time.Date(2018, 4, 1, 10, 0, 0, 0, time.UTC),
+		Original:  "original",
+		Ext:       ".jpg",
+		img:       Image{Hash: "sha256:0000000000000000", Metadata: map[string]string{"Model": "camera"}},
+		config:    &image.Config{Width: 1, Height: 1},
+	}
+	example.Ts = example.Timestamp.Format(TsForm)
+	if _, err := t.execute(example); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *NameTemplate) execute(fields *NameFields) (string, error) {
+	var buf bytes.Buffer
+	if err := t.template.Execute(&buf, fields); err != nil {
+		return "", fmt.Errorf("[template] %s", err)
+	}
+	name := buf.String()
+	if strings.TrimSpace(name) == "" {
+		return "", fmt.Errorf("[template] the name is empty")
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("[template] %s is outside the output directory", name)
+		}
+	}
+	return name, nil
+}
+
+// Name returns the name for an image from a stream with the extension ext, which can include directories.
+// the variant and subsecond come from the image.
+// it is an error for two different images to get the same name.
+func (t *NameTemplate) Name(img Image, stream, ext string) (string, error) {
+	base := filepath.Base(img.Path)
+	subsecond := img.Subsecond
+	if subsecond == "" {
+		subsecond = "00"
+	}
+	fields := &NameFields{
+		Stream:    stream,
+		Variant:   img.Variant,
+		Subsecond: subsecond,
+		Timestamp: img.Timestamp,
+		Ts:        img.Timestamp.Format(TsForm),
+		Sequence:  t.sequence[stream],
+		Original:  strings.TrimSuffix(base, filepath.Ext(base)),
+		Ext:       ext,
+		img:       img,
+	}
+	name, err := t.execute(fields)
+	if err != nil {
+		return "", err
+	}
+	name = filepath.Clean(name)
+	if other, ok := t.names[name]; ok && other != img.Path {
+		return "", fmt.Errorf("[template] %s and %s would both be named %s", other, img.Path, name)
+	}
+	t.names[name] = img.Path
+	t.sequence[stream]++
+	return name, nil
+}
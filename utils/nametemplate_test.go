@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNameTemplate(t *testing.T) {
+	tmpl, err := NewNameTemplate(DefaultNameTemplate)
+	assert.NoError(t, err)
+	img := Image{Path: "/data/GC03L_2018_04_01_10_00_00_00.JPG", Timestamp: wallClock("2018-04-01T10:00:00")}
+	name, err := tmpl.Name(img, "GC03L", ".jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "GC03L_2018_04_01_10_00_00_00.jpg", name)
+	// the same image again is fine
+	_, err = tmpl.Name(img, "GC03L", ".jpg")
+	assert.NoError(t, err)
+	// the variant and subsecond are kept
+	img = Image{Path: "TR0114-GC03R-RGB01~fullres_2018_04_01_10_00_00_01.jpg", Timestamp: wallClock("2018-04-01T10:00:00")}
+	img.ParseName()
+	name, err = tmpl.Name(img, "GC03R", ".jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "GC03R~fullres_2018_04_01_10_00_00_01.jpg", name)
+	// a new name with a variant replaces the variant, as tsrename -name "$NAME~1920" does
+	stream, variant := SplitStreamName("GC03-Picam~1920")
+	img.Variant = variant
+	name, err = tmpl.Name(img, stream, ".jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "GC03-Picam~1920_2018_04_01_10_00_00_01.jpg", name)
+
+	tmpl, err = NewNameTemplate(`{{.Stream}}/{{.Time "2006/2006_01_02"}}/{{printf "%05d" .Sequence}}-{{.Grid}}-{{.Camera}}-{{.HashPrefix 6}}{{.Ext}}`)
+	assert.NoError(t, err)
+	img = Image{
+		Path:      "/data/0,1/a.jpg",
+		Timestamp: wallClock("2018-04-01T10:00:00"),
+		Hash:      "sha256:abcdef0123",
+		Metadata:  map[string]string{"Model": "Canon EOS 600D"},
+	}
+	name, err = tmpl.Name(img, "GC03L", ".jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "GC03L/2018/2018_04_01/00000-0,1-Canon-EOS-600D-abcdef.jpg", name)
+
+	img.Path = "/data/0,1/b.jpg"
+	name, err = tmpl.Name(img, "GC03L", ".jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "GC03L/2018/2018_04_01/00001-0,1-Canon-EOS-600D-abcdef.jpg", name)
+
+	// names that collide
+	tmpl, _ = NewNameTemplate(`{{.Stream}}_{{.Time "2006_01_02"}}{{.Ext}}`)
+	_, err = tmpl.Name(Image{Path: "a.jpg", Timestamp: wallClock("2018-04-01T10:00:00")}, "GC03L", ".jpg")
+	assert.NoError(t, err)
+	_, err = tmpl.Name(Image{Path: "b.jpg", Timestamp: wallClock("2018-04-01T11:00:00")}, "GC03L", ".jpg")
+	assert.Error(t, err)
+
+	for _, bad := range []string{"{{.Stream", "{{.Nope}}", "../{{.Stream}}", " "} {
+		_, err = NewNameTemplate(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,418 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Predicate is a parsed -where expression, evaluated against images.
+//
+// expressions compare fields with ==, !=, <, <=, >, >=, ~ (regex match) and !~,
+// combined with &&, || and ! and grouped with parentheses, ie:
+//
+//	exif.Model == "Canon EOS 600D" && exif.ISO <= 400 && name ~ "NIR"
+//
+// values that both parse as numbers (including exif rationals like 1/100) are compared as numbers, otherwise as strings.
+// ordered comparisons against a missing field are false, a field on its own is true if it is present and not empty.
+//
+// fields are:
+//
+//	path, name (base name), dir, ext (lower case, without the dot), stem (name without the extension)
+//	timestamp (RFC3339), year, month, day, hour, minute, second, weekday (0=sunday), yday
+//	size (bytes), hash
+//	exif.<tag> or meta.<key>: metadata from the embedded exif and sidecars, exif.ISO is short for exif.ISOSpeedRatings
+type Predicate struct {
+	source       string
+	match        func(img *Image) bool
+	usesMetadata bool
+}
+
+// metadataAliases are short names for metadata keys
+var metadataAliases = map[string]string{
+	"ISO": "ISOSpeedRatings",
+}
+
+// operand returns the value of one side of a comparison for an image, and false if it is missing.
+type operand func(img *Image) (string, bool)
+
+// imageField returns the operand for a named field, or an error if there is no such field.
+func imageField(name string) (operand, bool, error) {
+	for _, prefix := range []string{"exif.", "meta."} {
+		if strings.HasPrefix(name, prefix) {
+			key := strings.TrimPrefix(name, prefix)
+			if alias, ok := metadataAliases[key]; ok {
+				key = alias
+			}
+			return func(img *Image) (string, bool) {
+				v, ok := img.Metadata[key]
+				return v, ok
+			}, true, nil
+		}
+	}
+
+	timeField := func(f func(t time.Time) int) operand {
+		return func(img *Image) (string, bool) {
+			return strconv.Itoa(f(img.Timestamp)), !img.Timestamp.IsZero()
+		}
+	}
+	var op operand
+	switch name {
+	case "path":
+		op = func(img *Image) (string, bool) { return img.Path, true }
+	case "name":
+		op = func(img *Image) (string, bool) { return filepath.Base(img.Path), true }
+	case "dir":
+		op = func(img *Image) (string, bool) { return filepath.Dir(img.Path), true }
+	case "ext":
+		op = func(img *Image) (string, bool) {
+			return strings.ToLower(strings.TrimPrefix(filepath.Ext(img.Path), ".")), true
+		}
+	case "stem":
+		op = func(img *Image) (string, bool) {
+			base := filepath.Base(img.Path)
+			return strings.TrimSuffix(base, filepath.Ext(base)), true
+		}
+	case "timestamp":
+		op = func(img *Image) (string, bool) { return img.Timestamp.Format(time.RFC3339), !img.Timestamp.IsZero() }
+	case "year":
+		op = timeField(time.Time.Year)
+	case "month":
+		op = timeField(func(t time.Time) int { return int(t.Month()) })
+	case "day":
+		op = timeField(time.Time.Day)
+	case "hour":
+		op = timeField(time.Time.Hour)
+	case "minute":
+		op = timeField(time.Time.Minute)
+	case "second":
+		op = timeField(time.Time.Second)
+	case "weekday":
+		op = timeField(func(t time.Time) int { return int(t.Weekday()) })
+	case "yday":
+		op = timeField(time.Time.YearDay)
+	case "size":
+		op = func(img *Image) (string, bool) {
+			if len(img.Data) != 0 {
+				return strconv.Itoa(len(img.Data)), true
+			}
+			finfo, err := os.Stat(img.Path)
+			if err != nil {
+				return "", false
+			}
+			return strconv.FormatInt(finfo.Size(), 10), true
+		}
+	case "hash":
+		op = func(img *Image) (string, bool) { return img.Hash, img.Hash != "" }
+	default:
+		return nil, false, fmt.Errorf("unknown field %q", name)
+	}
+	return op, false, nil
+}
+
+// parseNumber parses a number or a rational (1/100) as found in exif.
+func parseNumber(s string) (float64, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	if parts := strings.SplitN(s, "/", 2); len(parts) == 2 {
+		n, errN := strconv.ParseFloat(parts[0], 64)
+		d, errD := strconv.ParseFloat(parts[1], 64)
+		if errN == nil && errD == nil && d != 0 {
+			return n / d, true
+		}
+	}
+	return 0, false
+}
+
+// compare returns -1, 0 or 1 comparing a to b, as numbers if both are numbers.
+func compare(a, b string) int {
+	if x, ok := parseNumber(a); ok {
+		if y, ok := parseNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+type predicateToken struct {
+	kind  string // "ident", "string", "number" or the operator itself
+	value string
+	pos   int
+}
+
+var predicateOperators = []string{"==", "!=", "<=", ">=", "!~", "&&", "||", "<", ">", "~", "!", "(", ")"}
+
+// lexPredicate splits an expression into tokens.
+func lexPredicate(src string) ([]predicateToken, error) {
+	var tokens []predicateToken
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(src) && rune(src[j]) != c; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			value := src[i+1 : j]
+			if c == '"' {
+				unquoted, err := strconv.Unquote(src[i : j+1])
+				if err != nil {
+					return nil, fmt.Errorf("bad string at %d: %s", i, err)
+				}
+				value = unquoted
+			}
+			tokens = append(tokens, predicateToken{"string", value, i})
+			i = j + 1
+		case unicode.IsDigit(c) || c == '-' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1])):
+			j := i + 1
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.' || src[j] == '/') {
+				j++
+			}
+			tokens = append(tokens, predicateToken{"number", src[i:j], i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, predicateToken{"ident", src[i:j], i})
+			i = j
+		default:
+			matched := false
+			for _, op := range predicateOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, predicateToken{op, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// predicateParser is a recursive descent parser over the tokens of an expression.
+type predicateParser struct {
+	tokens       []predicateToken
+	pos          int
+	usesMetadata bool
+}
+
+func (p *predicateParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].kind
+	}
+	return ""
+}
+
+func (p *predicateParser) errorf(format string, args ...interface{}) error {
+	where := "end of expression"
+	if p.pos < len(p.tokens) {
+		where = fmt.Sprintf("%q at %d", p.tokens[p.pos].value, p.tokens[p.pos].pos)
+	}
+	return fmt.Errorf("%s near %s", fmt.Sprintf(format, args...), where)
+}
+
+// or := and ("||" and)*
+func (p *predicateParser) or() (func(*Image) bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(img *Image) bool { return l(img) || right(img) }
+	}
+	return left, nil
+}
+
+// and := unary ("&&" unary)*
+func (p *predicateParser) and() (func(*Image) bool, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(img *Image) bool { return l(img) && right(img) }
+	}
+	return left, nil
+}
+
+// unary := "!" unary | "(" or ")" | comparison
+func (p *predicateParser) unary() (func(*Image) bool, error) {
+	switch p.peek() {
+	case "!":
+		p.pos++
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(img *Image) bool { return !inner(img) }, nil
+	case "(":
+		p.pos++
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return inner, nil
+	}
+	return p.comparison()
+}
+
+// operand := ident | string | number
+func (p *predicateParser) operand() (operand, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, p.errorf("expected a field or value")
+	}
+	tok := p.tokens[p.pos]
+	switch tok.kind {
+	case "ident":
+		op, usesMetadata, err := imageField(tok.value)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		p.usesMetadata = p.usesMetadata || usesMetadata
+		p.pos++
+		return op, nil
+	case "string", "number":
+		p.pos++
+		return func(*Image) (string, bool) { return tok.value, true }, nil
+	}
+	return nil, p.errorf("expected a field or value")
+}
+
+// comparison := operand (op operand)?
+func (p *predicateParser) comparison() (func(*Image) bool, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "~", "!~":
+	default:
+		// a field on its own
+		return func(img *Image) bool {
+			v, ok := left(img)
+			return ok && v != ""
+		}, nil
+	}
+	p.pos++
+
+	if op == "~" || op == "!~" {
+		if p.peek() != "string" {
+			return nil, p.errorf("expected a regular expression string")
+		}
+		re, err := regexp.Compile(p.tokens[p.pos].value)
+		if err != nil {
+			return nil, p.errorf("bad regular expression: %s", err)
+		}
+		p.pos++
+		return func(img *Image) bool {
+			v, ok := left(img)
+			return ok && re.MatchString(v) == (op == "~")
+		}, nil
+	}
+
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return func(img *Image) bool {
+		a, okA := left(img)
+		b, okB := right(img)
+		switch op {
+		case "==":
+			return okA == okB && compare(a, b) == 0
+		case "!=":
+			return okA != okB || compare(a, b) != 0
+		}
+		if !okA || !okB {
+			return false
+		}
+		c := compare(a, b)
+		switch op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}, nil
+}
+
+// ParsePredicate parses a -where expression.
+func ParsePredicate(src string) (*Predicate, error) {
+	tokens, err := lexPredicate(src)
+	if err != nil {
+		return nil, fmt.Errorf("[where] %s", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("[where] empty expression")
+	}
+	p := &predicateParser{tokens: tokens}
+	match, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = p.errorf("unexpected")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[where] %s", err)
+	}
+	return &Predicate{source: src, match: match, usesMetadata: p.usesMetadata}, nil
+}
+
+// Match evaluates the predicate against an image, loading its metadata first if the predicate uses it.
+func (pred *Predicate) Match(img *Image) bool {
+	if pred.usesMetadata && img.Metadata == nil {
+		if err := LoadMetadata(img); err != nil {
+			errLog.Printf("[where] %s", err)
+		}
+	}
+	return pred.match(img)
+}
+
+// String returns the source of the predicate
+func (pred *Predicate) String() string {
+	return pred.source
+}
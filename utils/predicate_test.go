@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPredicate(t *testing.T) {
+	img := Image{
+		Path:      "/data/GC03L-NIR/GC03L-NIR_2018_04_01_10_03_00.JPG",
+		Timestamp: time.Date(2018, 4, 1, 10, 3, 0, 0, time.UTC),
+		Metadata: map[string]string{
+			"Model":           "Canon EOS 600D",
+			"ISOSpeedRatings": "400",
+			"ExposureTime":    "1/100",
+		},
+	}
+	for expr, expected := range map[string]bool{
+		`exif.Model == "Canon EOS 600D" && exif.ISO <= 400 && name ~ "NIR"`: true,
+		`exif.Model == "Canon EOS 600D" && exif.ISO < 400`:                  false,
+		`exif.ExposureTime > 1/200 && exif.ExposureTime >= 0.01`:            true,
+		`ext == "jpg" && stem ~ "^GC03L"`:                                   true,
+		`!(hour >= 9 && hour < 17)`:                                         false,
+		`hour == 10 || exif.Missing == "x"`:                                 true,
+		`exif.Missing`:                                                      false,
+		`exif.Model`:                                                        true,
+		`exif.Missing < 5`:                                                  false,
+		`exif.Missing != "x"`:                                               true,
+		`name !~ '(?i)rgb'`:                                                 true,
+		`timestamp >= "2018-04-01T00:00:00Z" && month == 4 && yday == 91`:   true,
+		`dir == "/data/GC03L-NIR"`:                                          true,
+		`exif.Model == "Canon" || exif.Model == "Nikon"`:                    false,
+	} {
+		pred, err := ParsePredicate(expr)
+		if !assert.NoError(t, err, expr) {
+			continue
+		}
+		assert.Equal(t, expected, pred.Match(&img), expr)
+	}
+
+	for _, expr := range []string{
+		``,
+		`unknown == 1`,
+		`name ==`,
+		`(hour == 1`,
+		`name ~ 5`,
+		`name ~ "("`,
+		`name == "unterminated`,
+		`hour == 1 hour`,
+		`hour @ 1`,
+	} {
+		_, err := ParsePredicate(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// ProvenanceExtension is appended to an output path when its provenance is written out.
+const ProvenanceExtension = ".prov.json"
+
+// Version is the version of the tools, set at build time with
+// -ldflags "-X github.com/borevitzlab/go-timestreamtools/utils.Version=<version>"
+var Version = ""
+
+// ProvenanceStep records a single processing step applied to an image.
+type ProvenanceStep struct {
+	Tool         string            `json:"tool"`
+	Version      string            `json:"version"`
+	Options      map[string]string `json:"options"`
+	Input        string            `json:"input"`
+	InputSha256  string            `json:"inputSha256,omitempty"`
+	Output       string            `json:"output,omitempty"`
+	OutputSha256 string            `json:"outputSha256,omitempty"`
+	Timestamp    time.Time         `json:"timestamp"`
+	Host         string            `json:"host"`
+}
+
+// toolVersion returns the version set at build time, or the module version from the build info.
+func toolVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// HashBytes returns the hex encoded SHA-256 of data.
+func HashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// HashFile returns the hex encoded SHA-256 of a files contents, streaming it from disk.
+func HashFile(thisFile string) (string, error) {
+	file, err := os.Open(thisFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashData hashes data if there is any, otherwise the file at thisFile.
+func hashData(thisFile string, data []byte) (string, error) {
+	if len(data) != 0 {
+		return HashBytes(data), nil
+	}
+	return HashFile(thisFile)
+}
+
+// NewProvenanceStep creates a provenance step for the running tool, with the options taken from the parsed flags.
+func NewProvenanceStep(input, output string) ProvenanceStep {
+	step := ProvenanceStep{
+		Tool:      filepath.Base(os.Args[0]),
+		Version:   toolVersion(),
+		Options:   map[string]string{},
+		Input:     input,
+		Output:    output,
+		Timestamp: time.Now().UTC(),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		step.Options[f.Name] = f.Value.String()
+	})
+	step.Host, _ = os.Hostname()
+	return step
+}
+
+// RecordProvenance appends a provenance step for turning input into output to an image.
+// inputData and outputData are hashed if given, otherwise the files at input and output are.
+// an empty output records a step that doesnt produce a new file (ie a filter).
+func RecordProvenance(img *Image, input string, inputData []byte, output string, outputData []byte) (err error) {
+	step := NewProvenanceStep(input, output)
+	defer func() {
+		// copy so that images split from the same source dont share a backing array
+		img.Provenance = append(append([]ProvenanceStep(nil), img.Provenance...), step)
+	}()
+
+	if step.InputSha256, err = hashData(input, inputData); err != nil {
+		return
+	}
+	if output != "" {
+		step.OutputSha256, err = hashData(output, outputData)
+	}
+	return
+}
+
+// WriteProvenance writes the provenance chain of an image to <path>.prov.json
+func WriteProvenance(img Image) error {
+	byt, err := json.MarshalIndent(img.Provenance, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(img.Path+ProvenanceExtension, byt, os.FileMode(OsUserRW|OsGroupRW))
+}
+
+// ReadProvenance reads the provenance chain written to <path>.prov.json, an image without one has no chain.
+func ReadProvenance(imgPath string) ([]ProvenanceStep, error) {
+	byt, err := ioutil.ReadFile(imgPath + ProvenanceExtension)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var steps []ProvenanceStep
+	if err := json.Unmarshal(byt, &steps); err != nil {
+		return nil, fmt.Errorf("%s%s: %s", imgPath, ProvenanceExtension, err)
+	}
+	return steps, nil
+}
+
+// TrackProvenance records the step turning input into output in the provenance of img when anything will see it,
+// that is when write is set or img is emitted as json or msgpack, and writes it to <output>.prov.json if write is set.
+// errors are logged rather than returned, a failure to record provenance doesnt stop an image.
+func TrackProvenance(img *Image, input string, inputData []byte, output string, outputData []byte, write bool, outfmt string) {
+	if !write && outfmt == "path" {
+		return
+	}
+	if err := RecordProvenance(img, input, inputData, output, outputData); err != nil {
+		errLog.Printf("[provenance] %s", err)
+	}
+	if write && output != "" {
+		if err := WriteProvenance(Image{Path: output, Provenance: img.Provenance}); err != nil {
+			errLog.Printf("[provenance] %s", err)
+		}
+	}
+}
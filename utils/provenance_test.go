@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provenance-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.jpg")
+	ioutil.WriteFile(input, []byte("raw"), 0644)
+
+	img := Image{Path: input}
+	assert.NoError(t, RecordProvenance(&img, input, nil, "", nil))
+	// two outputs split from the same image must not share their chain
+	first, second := img, img
+	assert.NoError(t, RecordProvenance(&first, input, nil, "first.jpg", []byte("first")))
+	assert.NoError(t, RecordProvenance(&second, input, nil, "second.jpg", []byte("second")))
+
+	assert.Len(t, img.Provenance, 1)
+	assert.Len(t, first.Provenance, 2)
+	assert.Equal(t, "first.jpg", first.Provenance[1].Output)
+	assert.Equal(t, "second.jpg", second.Provenance[1].Output)
+
+	step := first.Provenance[1]
+	assert.Equal(t, HashBytes([]byte("raw")), step.InputSha256)
+	assert.Equal(t, HashBytes([]byte("first")), step.OutputSha256)
+	assert.Equal(t, "", img.Provenance[0].OutputSha256)
+	assert.NotEmpty(t, step.Version)
+
+	first.Path = filepath.Join(dir, "first.jpg")
+	assert.NoError(t, WriteProvenance(first))
+	byt, err := ioutil.ReadFile(first.Path + ProvenanceExtension)
+	assert.NoError(t, err)
+	var chain []ProvenanceStep
+	assert.NoError(t, json.Unmarshal(byt, &chain))
+	assert.Len(t, chain, 2)
+	assert.Equal(t, input, chain[0].Input)
+
+	// nothing sees provenance output as paths without -prov
+	tracked := Image{Path: input}
+	output := filepath.Join(dir, "tracked.jpg")
+	TrackProvenance(&tracked, input, nil, output, []byte("tracked"), false, "path")
+	assert.Empty(t, tracked.Provenance)
+	TrackProvenance(&tracked, input, nil, output, []byte("tracked"), true, "path")
+	assert.Len(t, tracked.Provenance, 1)
+	assert.FileExists(t, output+ProvenanceExtension)
+}
+
+func TestProvenanceFollowsImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provenance-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// an upstream tool wrote an image with -prov
+	imgPath := filepath.Join(dir, "GC03L_2018_04_01_10_00_00_00.jpg")
+	ioutil.WriteFile(imgPath, []byte("resized"), 0644)
+	upstream := Image{Path: imgPath}
+	TrackProvenance(&upstream, "/raw/GC03L_2018_04_01_10_00_00_00.jpg", []byte("raw"), imgPath, nil, true, "path")
+
+	// the next tool reads the chain back
+	// (the error is from the image not having exif)
+	img, _ := LoadImage(imgPath)
+	if assert.Len(t, img.Provenance, 1) {
+		assert.Equal(t, "/raw/GC03L_2018_04_01_10_00_00_00.jpg", img.Provenance[0].Input)
+	}
+	// and carries it with the image without reading it as metadata
+	assert.Equal(t, []string{imgPath + ProvenanceExtension}, img.Sidecars)
+	assert.NoError(t, LoadMetadata(&img))
+	assert.Empty(t, img.Metadata)
+	dest := filepath.Join(dir, "renamed.jpg")
+	copied, err := CopySidecars(img, dest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{dest + ProvenanceExtension}, copied)
+	steps, err := ReadProvenance(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, img.Provenance[0].Input, steps[0].Input)
+
+	steps, err = ReadProvenance(filepath.Join(dir, "none.jpg"))
+	assert.NoError(t, err)
+	assert.Empty(t, steps)
+}
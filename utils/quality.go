@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"bytes"
+	// decoders for DecodeImage
+	_ "golang.org/x/image/tiff"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"math"
+)
+
+// QualitySize is the length of the long side of the downscaled image that quality scores are computed on.
+var QualitySize = 256
+
+const (
+	// clippedHigh is the luma (0-255) at or above which a pixel counts as blown out
+	clippedHigh = 250
+	// clippedLow is the luma (0-255) at or below which a pixel counts as crushed
+	clippedLow = 5
+)
+
+// QualityScores are measures of the content of an image, used to drop night, overexposed, fogged or blank frames.
+// luminance, contrast and sharpness are on the 0-255 luma scale, the clipped fractions are 0-1.
+type QualityScores struct {
+	// Luminance is the mean luma
+	Luminance float64 `json:"luminance"`
+	// Contrast is the standard deviation of the luma, near 0 for uniform (blank, fogged or covered) frames
+	Contrast float64 `json:"contrast"`
+	// ClippedHigh is the fraction of pixels blown out to white
+	ClippedHigh float64 `json:"clippedHigh"`
+	// ClippedLow is the fraction of pixels crushed to black
+	ClippedLow float64 `json:"clippedLow"`
+	// Sharpness is the variance of the laplacian of the luma, low for blurry frames
+	Sharpness float64 `json:"sharpness"`
+}
+
+// imageData returns the data of an image if it has any, otherwise reads the file at its path.
+func imageData(img Image) ([]byte, error) {
+	if len(img.Data) != 0 {
+		return img.Data, nil
+	}
+	return ioutil.ReadFile(img.Path)
+}
+
+// DecodeImage decodes the data of an image if it has any, otherwise the file at its path.
+func DecodeImage(img Image) (image.Image, error) {
+	data, err := imageData(img)
+	if err != nil {
+		return nil, err
+	}
+	m, _, err := image.Decode(bytes.NewReader(data))
+	return m, err
+}
+
+// downscaledLuma box averages the luma of an image down to at most size pixels on its long side.
+func downscaledLuma(m image.Image, size int) (luma []float64, width, height int) {
+	bounds := m.Bounds()
+	scale := 1
+	for bounds.Dx()/scale > size || bounds.Dy()/scale > size {
+		scale++
+	}
+	width, height = bounds.Dx()/scale, bounds.Dy()/scale
+	if width == 0 || height == 0 {
+		return nil, 0, 0
+	}
+	luma = make([]float64, width*height)
+	ycbcr, isYCbCr := m.(*image.YCbCr)
+	for y := 0; y < height*scale; y++ {
+		for x := 0; x < width*scale; x++ {
+			px, py := bounds.Min.X+x, bounds.Min.Y+y
+			var l float64
+			if isYCbCr {
+				// jpegs decode to YCbCr, use the Y plane directly
+				l = float64(ycbcr.Y[ycbcr.YOffset(px, py)])
+			} else {
+				r, g, b, _ := m.At(px, py).RGBA()
+				l = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			}
+			luma[(y/scale)*width+x/scale] += l
+		}
+	}
+	area := float64(scale * scale)
+	for i := range luma {
+		luma[i] /= area
+	}
+	return
+}
+
+// Score computes the quality scores of a decoded image, on a copy downscaled to QualitySize.
+func Score(m image.Image) (scores QualityScores) {
+	luma, width, height := downscaledLuma(m, QualitySize)
+	if len(luma) == 0 {
+		return
+	}
+	n := float64(len(luma))
+	var sum, sumSq float64
+	for _, l := range luma {
+		sum += l
+		sumSq += l * l
+		if l >= clippedHigh {
+			scores.ClippedHigh++
+		}
+		if l <= clippedLow {
+			scores.ClippedLow++
+		}
+	}
+	scores.Luminance = sum / n
+	scores.Contrast = math.Sqrt(math.Max(0, sumSq/n-scores.Luminance*scores.Luminance))
+	scores.ClippedHigh /= n
+	scores.ClippedLow /= n
+
+	// variance of the 4-neighbour laplacian over the interior
+	var lapSum, lapSumSq, lapN float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			lap := luma[i-width] + luma[i+width] + luma[i-1] + luma[i+1] - 4*luma[i]
+			lapSum += lap
+			lapSumSq += lap * lap
+			lapN++
+		}
+	}
+	if lapN > 0 {
+		mean := lapSum / lapN
+		scores.Sharpness = lapSumSq/lapN - mean*mean
+	}
+	return
+}
+
+// ScoreImage decodes an image and computes its quality scores.
+// the smallest jpeg preview embedded in the image that is at least QualitySize on its long side is decoded instead
+// of the whole image if there is one (ie the exif thumbnail, or the previews in a raw file), and the largest
+// preview is used for images that cant be decoded themselves.
+func ScoreImage(img Image) (QualityScores, error) {
+	data, err := imageData(img)
+	if err != nil {
+		return QualityScores{}, err
+	}
+	var reduced, largest []byte
+	reducedSize, largestSize := 0, 0
+	for _, preview := range embeddedPreviews(data) {
+		config, err := jpeg.DecodeConfig(bytes.NewReader(preview))
+		if err != nil {
+			continue
+		}
+		size := config.Width
+		if config.Height > size {
+			size = config.Height
+		}
+		if size >= QualitySize && (reduced == nil || size < reducedSize) {
+			reduced, reducedSize = preview, size
+		}
+		if size > largestSize {
+			largest, largestSize = preview, size
+		}
+	}
+	if reduced != nil {
+		if m, err := jpeg.Decode(bytes.NewReader(reduced)); err == nil {
+			return Score(m), nil
+		}
+	}
+	m, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil && largest != nil {
+		if preview, previewErr := jpeg.Decode(bytes.NewReader(largest)); previewErr == nil {
+			return Score(preview), nil
+		}
+	}
+	if err != nil {
+		return QualityScores{}, err
+	}
+	return Score(m), nil
+}
+
+// embeddedPreviews returns the jpegs embedded in the tiff ifds of image data, either a tiff based file (ie a CR2)
+// or the exif of a jpeg. they arent checked beyond starting with a jpeg marker.
+func embeddedPreviews(data []byte) (previews [][]byte) {
+	raw := data
+	if _, _, err := readTiffHeader(raw); err != nil {
+		if raw = ExtractExif(data); raw == nil {
+			return nil
+		}
+	}
+	order, offset, err := readTiffHeader(raw)
+	if err != nil {
+		return nil
+	}
+	for i := 0; i <= maxIfdDepth && offset != 0; i++ {
+		d, err := parseIfd(raw, order, offset, 0)
+		if err != nil {
+			break
+		}
+		// JPEGInterchangeFormat for thumbnails, a single strip (of an old style jpeg ifd) for raw previews
+		for _, tags := range [][2]uint16{{0x0201, 0x0202}, {0x0111, 0x0117}} {
+			start, ok := d.uint(tags[0], order)
+			length, lengthOk := d.uint(tags[1], order)
+			if !ok || !lengthOk || start+length > uint64(len(raw)) {
+				continue
+			}
+			if preview := raw[start : start+length]; bytes.HasPrefix(preview, []byte{0xFF, 0xD8}) {
+				previews = append(previews, preview)
+			}
+		}
+		offset = d.next
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func uniformImage(l uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 640, 480))
+	for i := range img.Pix {
+		img.Pix[i] = l
+	}
+	return img
+}
+
+// checkerImage is a sharp high contrast pattern, blurred by averaging over blur pixels
+func checkerImage(blur int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			var sum int
+			for dx := 0; dx < blur; dx++ {
+				if ((x+dx)/8+y/8)%2 == 0 {
+					sum += 220
+				} else {
+					sum += 30
+				}
+			}
+			v := uint8(sum / blur)
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestScore(t *testing.T) {
+	dark := Score(uniformImage(2))
+	assert.InDelta(t, 2, dark.Luminance, 0.01)
+	assert.Equal(t, 1.0, dark.ClippedLow)
+	assert.Equal(t, 0.0, dark.Contrast)
+	assert.Equal(t, 0.0, dark.Sharpness)
+
+	blown := Score(uniformImage(255))
+	assert.Equal(t, 1.0, blown.ClippedHigh)
+	assert.Equal(t, 0.0, blown.ClippedLow)
+
+	sharp := Score(checkerImage(1))
+	blurry := Score(checkerImage(32))
+	assert.InDelta(t, 125, sharp.Luminance, 1)
+	assert.True(t, sharp.Contrast > 50, "contrast %f", sharp.Contrast)
+	assert.True(t, sharp.Sharpness > 4*blurry.Sharpness, "sharp %f blurry %f", sharp.Sharpness, blurry.Sharpness)
+}
+
+func TestScoreImage(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, checkerImage(1), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	// jpegs are scored from their Y plane
+	scores, err := ScoreImage(Image{Data: buf.Bytes()})
+	assert.NoError(t, err)
+	assert.InDelta(t, Score(checkerImage(1)).Luminance, scores.Luminance, 2)
+
+	_, err = ScoreImage(Image{Data: []byte("not an image")})
+	assert.Error(t, err)
+}
+
+func TestScoreImagePreview(t *testing.T) {
+	preview := new(bytes.Buffer)
+	if err := jpeg.Encode(preview, checkerImage(1), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := jpeg.Decode(bytes.NewReader(preview.Bytes()))
+
+	// a raw file, like a CR2, with an old style jpeg ifd holding a preview in its strip
+	order := binary.LittleEndian
+	d := &ifd{}
+	d.set(ifdEntry{tag: 0x0103, typ: tiffShort, count: 1, value: uint16Bytes(order, 6)})
+	d.set(ifdEntry{tag: 0x0111, typ: tiffLong, count: 1, value: uint32Bytes(order, 0)})
+	d.set(ifdEntry{tag: 0x0117, typ: tiffLong, count: 1, value: uint32Bytes(order, uint32(preview.Len()))})
+	raw := encodeTiff(d, order)
+	d.set(ifdEntry{tag: 0x0111, typ: tiffLong, count: 1, value: uint32Bytes(order, uint32(len(raw)))})
+	raw = append(encodeTiff(d, order), preview.Bytes()...)
+
+	scores, err := ScoreImage(Image{Data: raw})
+	assert.NoError(t, err)
+	assert.Equal(t, Score(decoded), scores)
+}
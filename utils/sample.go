@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// PreferCentre chooses the image closest to the centre (or target time) of its slot
+	PreferCentre = "centre"
+	// PreferQuality chooses the image with the best quality score, see QualityScores.Overall
+	PreferQuality = "quality"
+	// PreferFirst chooses the earliest image in its slot
+	PreferFirst = "first"
+)
+
+// Overall combines the quality scores into a single score used to choose between images, higher is better.
+// it is the sharpness scaled down by the fraction of clipped pixels.
+func (q QualityScores) Overall() float64 {
+	return q.Sharpness * (1 - q.ClippedHigh - q.ClippedLow)
+}
+
+// slotFunc returns the slot an image taken at t falls into and the time in that slot images are chosen closest to.
+type slotFunc func(t time.Time) (slot, target time.Time)
+
+// Sampler thins a stream of images down to one image per time slot (or every nth image).
+// images are buffered per slot and a slot is emitted once an image arrives more than Window after it,
+// so the input only needs to be roughly in time order. images that arrive after their slot was emitted are dropped.
+type Sampler struct {
+	// Prefer is how to choose between the images in a slot (PreferCentre, PreferQuality or PreferFirst)
+	Prefer string
+	// Window is how far out of order images can arrive
+	Window time.Duration
+	// Emit is called with each chosen image, in slot order
+	Emit func(Image)
+
+	every   int
+	seen    int
+	slot    slotFunc
+	count   int
+	buffer  map[time.Time]Image
+	emitted time.Time
+	all     []Image
+}
+
+// NewEverySampler keeps the first of every n images.
+func NewEverySampler(n int, emit func(Image)) (*Sampler, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("[sample] every must be at least 1")
+	}
+	return &Sampler{every: n, Emit: emit}, nil
+}
+
+// NewPeriodSampler keeps one image per period (ie one per hour), slots start at multiples of the period since
+// the zero time, so 1h slots start on the hour.
+func NewPeriodSampler(period time.Duration, emit func(Image)) (*Sampler, error) {
+	if period <= 0 {
+		return nil, fmt.Errorf("[sample] period must be positive")
+	}
+	return &Sampler{Emit: emit, slot: func(t time.Time) (time.Time, time.Time) {
+		slot := t.Truncate(period)
+		return slot, slot.Add(period / 2)
+	}}, nil
+}
+
+// NewDailySampler keeps one image each day, the one closest to a time of day (ie 12:00) by default.
+func NewDailySampler(timeOfDay time.Duration, emit func(Image)) (*Sampler, error) {
+	if timeOfDay < 0 || timeOfDay >= 24*time.Hour {
+		return nil, fmt.Errorf("[sample] time of day must be within the day")
+	}
+	return &Sampler{Emit: emit, slot: func(t time.Time) (time.Time, time.Time) {
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		return day, day.Add(timeOfDay)
+	}}, nil
+}
+
+// NewCountSampler keeps n images evenly spaced across start to end, the images closest to the n target times
+// by default. if start or end is zero the range of the images is used instead, which buffers every image.
+func NewCountSampler(n int, start, end time.Time, emit func(Image)) (*Sampler, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("[sample] count must be at least 1")
+	}
+	s := &Sampler{count: n, Emit: emit}
+	if !start.IsZero() && !end.IsZero() {
+		if !end.After(start) {
+			return nil, fmt.Errorf("[sample] end must be after start")
+		}
+		s.slot = countSlots(n, start, end)
+	}
+	return s, nil
+}
+
+// countSlots splits start to end into n slots centred on n evenly spaced target times, the first at start
+// and the last at end.
+func countSlots(n int, start, end time.Time) slotFunc {
+	if n == 1 || !end.After(start) {
+		middle := start.Add(end.Sub(start) / 2)
+		return func(time.Time) (time.Time, time.Time) { return middle, middle }
+	}
+	step := end.Sub(start) / time.Duration(n-1)
+	return func(t time.Time) (time.Time, time.Time) {
+		i := (t.Sub(start) + step/2) / step
+		if i < 0 {
+			i = 0
+		} else if i > time.Duration(n-1) {
+			i = time.Duration(n - 1)
+		}
+		target := start.Add(i * step)
+		return target, target
+	}
+}
+
+// better returns true if a should be chosen over b for a slot with the target time.
+// ties are broken by the earliest timestamp then the path, so the choice doesnt depend on the input order.
+func (s *Sampler) better(a, b Image, target time.Time) bool {
+	distance := func(img Image) time.Duration {
+		d := img.Timestamp.Sub(target)
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+	if s.Prefer == PreferQuality {
+		var qa, qb float64
+		if a.Quality != nil {
+			qa = a.Quality.Overall()
+		}
+		if b.Quality != nil {
+			qb = b.Quality.Overall()
+		}
+		if qa != qb {
+			return qa > qb
+		}
+	}
+	if s.Prefer != PreferFirst {
+		if da, db := distance(a), distance(b); da != db {
+			return da < db
+		}
+	}
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp)
+	}
+	return a.Path < b.Path
+}
+
+// Add adds an image to the sampler, emitting any slots that are complete.
+func (s *Sampler) Add(img Image) {
+	if s.every > 0 {
+		if s.seen%s.every == 0 {
+			s.Emit(img)
+		}
+		s.seen++
+		return
+	}
+	if s.slot == nil {
+		// count of evenly spaced images without a range
+		s.all = append(s.all, img)
+		return
+	}
+
+	slot, _ := s.slot(img.Timestamp)
+	if !s.emitted.IsZero() && !slot.After(s.emitted) {
+		errLog.Printf("[sample] %s arrived after its slot %s was emitted, try a larger window", img.Path, slot.Format(time.RFC3339))
+		return
+	}
+	s.offer(img)
+	// slots before the one Window ago cant get any more images
+	cutoff, _ := s.slot(img.Timestamp.Add(-s.Window))
+	s.emitBefore(cutoff)
+}
+
+// offer buffers an image if it is better than the current choice for its slot.
+func (s *Sampler) offer(img Image) {
+	slot, target := s.slot(img.Timestamp)
+	if s.buffer == nil {
+		s.buffer = map[time.Time]Image{}
+	}
+	if current, ok := s.buffer[slot]; !ok || s.better(img, current, target) {
+		s.buffer[slot] = img
+	}
+}
+
+// emitBefore emits the buffered slots before cutoff in order, or all of them if cutoff is zero.
+func (s *Sampler) emitBefore(cutoff time.Time) {
+	var slots []time.Time
+	for slot := range s.buffer {
+		if cutoff.IsZero() || slot.Before(cutoff) {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Before(slots[j]) })
+	for _, slot := range slots {
+		s.Emit(s.buffer[slot])
+		delete(s.buffer, slot)
+		s.emitted = slot
+	}
+}
+
+// Flush emits everything still buffered, call it at the end of the input.
+func (s *Sampler) Flush() {
+	if s.count > 0 && s.slot == nil && len(s.all) > 0 {
+		// now the range of the images is known
+		start, end := s.all[0].Timestamp, s.all[0].Timestamp
+		for _, img := range s.all {
+			if img.Timestamp.Before(start) {
+				start = img.Timestamp
+			}
+			if img.Timestamp.After(end) {
+				end = img.Timestamp
+			}
+		}
+		s.slot = countSlots(s.count, start, end)
+		for _, img := range s.all {
+			s.offer(img)
+		}
+		s.all = nil
+	}
+	s.emitBefore(time.Time{})
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var sampleStart = time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)
+
+// sampleImages returns an image every interval for a duration, named by their offset from sampleStart
+func sampleImages(interval, duration time.Duration) (images []Image) {
+	for d := time.Duration(0); d < duration; d += interval {
+		images = append(images, Image{Path: fmt.Sprintf("%s", d), Timestamp: sampleStart.Add(d)})
+	}
+	return
+}
+
+func runSampler(t *testing.T, s *Sampler, err error, images []Image) (paths []string) {
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	s.Emit = func(img Image) { paths = append(paths, img.Path) }
+	for _, img := range images {
+		s.Add(img)
+	}
+	s.Flush()
+	return
+}
+
+func TestEverySampler(t *testing.T) {
+	s, err := NewEverySampler(3, nil)
+	paths := runSampler(t, s, err, sampleImages(time.Minute, 7*time.Minute))
+	assert.Equal(t, []string{"0s", "3m0s", "6m0s"}, paths)
+}
+
+func TestPeriodSampler(t *testing.T) {
+	images := sampleImages(10*time.Minute, 3*time.Hour)
+	// out of order within the window
+	images[3], images[4] = images[4], images[3]
+	for prefer, expected := range map[string][]string{
+		PreferCentre: {"30m0s", "1h30m0s", "2h30m0s"},
+		PreferFirst:  {"0s", "1h0m0s", "2h0m0s"},
+	} {
+		s, err := NewPeriodSampler(time.Hour, nil)
+		s.Prefer = prefer
+		s.Window = 20 * time.Minute
+		assert.Equal(t, expected, runSampler(t, s, err, images), prefer)
+	}
+
+	// images arriving after their slot has been emitted are dropped
+	s, err := NewPeriodSampler(time.Hour, nil)
+	late := append(sampleImages(10*time.Minute, 2*time.Hour), Image{Path: "late", Timestamp: sampleStart.Add(35 * time.Minute)})
+	assert.Equal(t, []string{"30m0s", "1h30m0s"}, runSampler(t, s, err, late))
+}
+
+func TestPeriodSamplerQuality(t *testing.T) {
+	images := sampleImages(10*time.Minute, time.Hour)
+	for i := range images {
+		images[i].Quality = &QualityScores{Sharpness: float64(i % 3)}
+	}
+	s, err := NewPeriodSampler(time.Hour, nil)
+	s.Prefer = PreferQuality
+	// 20m and 50m are equally sharp, 20m is closer to the centre
+	assert.Equal(t, []string{"20m0s"}, runSampler(t, s, err, images))
+}
+
+func TestDailySampler(t *testing.T) {
+	s, err := NewDailySampler(12*time.Hour, nil)
+	paths := runSampler(t, s, err, sampleImages(25*time.Minute, 72*time.Hour))
+	assert.Equal(t, []string{"12h5m0s", "35h50m0s", "60h0m0s"}, paths)
+
+	_, err = NewDailySampler(25*time.Hour, nil)
+	assert.Error(t, err)
+}
+
+func TestCountSampler(t *testing.T) {
+	images := sampleImages(time.Hour, 25*time.Hour)
+	// with the range from the images
+	s, err := NewCountSampler(3, time.Time{}, time.Time{}, nil)
+	assert.Equal(t, []string{"0s", "12h0m0s", "24h0m0s"}, runSampler(t, s, err, images))
+
+	// with a given range, streaming
+	s, err = NewCountSampler(5, sampleStart, sampleStart.Add(8*time.Hour), nil)
+	assert.Equal(t, []string{"0s", "2h0m0s", "4h0m0s", "6h0m0s", "8h0m0s"}, runSampler(t, s, err, images[:9]))
+
+	// the same images in a different order give the same result
+	reversed := make([]Image, len(images))
+	for i, img := range images {
+		reversed[len(images)-1-i] = img
+	}
+	s, err = NewCountSampler(3, time.Time{}, time.Time{}, nil)
+	assert.Equal(t, []string{"0s", "12h0m0s", "24h0m0s"}, runSampler(t, s, err, reversed))
+
+	s, err = NewCountSampler(1, time.Time{}, time.Time{}, nil)
+	assert.Equal(t, []string{"0s"}, runSampler(t, s, err, images[:1]))
+}
@@ -0,0 +1,338 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SidecarExtensions are the extensions of metadata files that are kept alongside images, lowest precedence first.
+// sidecars can either be named <image>.<ext> (img.jpg.json) or replace the image extension (img.xmp).
+// metadata from a later sidecar overrides an earlier one, and all sidecars override the exif embedded in the image:
+//
+//	.thm: canon thumbnail jpegs, carrying the exif for raw files
+//	.xmp: adobe/darktable xmp sidecars
+//	.json: flat json objects, ie {"DateTime": "2018:04:01 10:00:00"}
+var SidecarExtensions = []string{".thm", ".xmp", ".json"}
+
+// maximum size of an undefined exif tag value to keep as metadata, this drops MakerNote and the like.
+const maxUndefinedTagSize = 64
+
+// sidecarPrecedence returns the precedence of a sidecar path, or -1 if it isnt a sidecar.
+func sidecarPrecedence(thisFile string) int {
+	ext := strings.ToLower(filepath.Ext(thisFile))
+	for i, sidecarExt := range SidecarExtensions {
+		if ext == sidecarExt {
+			return i
+		}
+	}
+	return -1
+}
+
+// IsSidecar returns true if the path is a sidecar file rather than an image.
+func IsSidecar(thisFile string) bool {
+	return sidecarPrecedence(thisFile) >= 0
+}
+
+// FindSidecars returns the paths of all sidecars existing for an image, lowest precedence first.
+// on case insensitive filesystems the upper and lower case names are the same file, it is only returned once.
+func FindSidecars(imgPath string) (sidecars []string) {
+	noExt := strings.TrimSuffix(imgPath, filepath.Ext(imgPath))
+	var found []os.FileInfo
+	if finfo, err := os.Stat(imgPath); err == nil {
+		found = append(found, finfo)
+	}
+	for _, ext := range SidecarExtensions {
+		for _, candidate := range []string{
+			imgPath + ext, imgPath + strings.ToUpper(ext),
+			noExt + ext, noExt + strings.ToUpper(ext),
+		} {
+			if candidate == imgPath || contains(sidecars, candidate) {
+				continue
+			}
+			finfo, err := os.Stat(candidate)
+			if err != nil || finfo.IsDir() || sameFile(found, finfo) {
+				continue
+			}
+			found = append(found, finfo)
+			sidecars = append(sidecars, candidate)
+		}
+	}
+	// the provenance chain written by -prov goes with its image too
+	if finfo, err := os.Stat(imgPath + ProvenanceExtension); err == nil && !finfo.IsDir() {
+		sidecars = append(sidecars, imgPath+ProvenanceExtension)
+	}
+	return
+}
+
+// isProvenance returns true if a sidecar is the provenance chain of its image rather than metadata.
+func isProvenance(thisFile string) bool {
+	return strings.HasSuffix(strings.ToLower(thisFile), ProvenanceExtension)
+}
+
+// sameFile returns true if finfo is the same file as any of files.
+func sameFile(files []os.FileInfo, finfo os.FileInfo) bool {
+	for _, f := range files {
+		if os.SameFile(f, finfo) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
+// SidecarDest returns the path a sidecar should have when its image is moved from imgPath to dest.
+func SidecarDest(imgPath, sidecar, dest string) string {
+	if strings.HasPrefix(sidecar, imgPath) {
+		// img.jpg.json
+		return dest + strings.TrimPrefix(sidecar, imgPath)
+	}
+	// img.xmp
+	return strings.TrimSuffix(dest, filepath.Ext(dest)) + filepath.Ext(sidecar)
+}
+
+// CopySidecars copies the sidecars of an image so that they sit alongside dest, returning their new paths.
+func CopySidecars(img Image, dest string) (copied []string, err error) {
+	for _, sidecar := range img.Sidecars {
+		sidecarDest := SidecarDest(img.Path, sidecar, dest)
+		if sidecarDest == sidecar {
+			copied = append(copied, sidecar)
+			continue
+		}
+		if err = MoveFilebyCopy(sidecar, sidecarDest, false); err != nil {
+			return
+		}
+		copied = append(copied, sidecarDest)
+	}
+	return
+}
+
+// MoveSidecars moves the sidecars of an image so that they sit alongside dest, returning their new paths.
+func MoveSidecars(img Image, dest string) (moved []string, err error) {
+	for _, sidecar := range img.Sidecars {
+		sidecarDest := SidecarDest(img.Path, sidecar, dest)
+		if sidecarDest != sidecar {
+			if err = os.Rename(sidecar, sidecarDest); err != nil {
+				if err = MoveFilebyCopy(sidecar, sidecarDest, true); err != nil {
+					return
+				}
+			}
+		}
+		moved = append(moved, sidecarDest)
+	}
+	return
+}
+
+// exifWalker collects exif tags into a metadata map.
+type exifWalker map[string]string
+
+// Walk implements exif.Walker
+func (w exifWalker) Walk(name exif.FieldName, tag *tiff.Tag) error {
+	switch tag.Format() {
+	case tiff.StringVal:
+		if s, err := tag.StringVal(); err == nil {
+			w[string(name)] = s
+		}
+	case tiff.UndefVal:
+		if len(tag.Val) <= maxUndefinedTagSize {
+			w[string(name)] = strings.TrimRight(string(tag.Val), "\x00")
+		}
+	default:
+		// single rationals are quoted, ie "1/100"
+		w[string(name)] = strings.Trim(tag.String(), `"`)
+	}
+	return nil
+}
+
+// readExifMetadata reads all tags from the exif embedded in an image or thumbnail file.
+func readExifMetadata(thisFile string) (map[string]string, error) {
+	file, err := os.Open(thisFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	exifData, err := exif.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("[exif] couldn't decode exif from %s: %s", thisFile, err)
+	}
+	meta := exifWalker{}
+	exifData.Walk(meta)
+	return meta, nil
+}
+
+// parseJSONSidecar reads a flat json object, non string values are kept as their json encoding.
+func parseJSONSidecar(data []byte) (map[string]string, error) {
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	meta := map[string]string{}
+	for k, v := range values {
+		switch val := v.(type) {
+		case nil:
+		case string:
+			meta[k] = val
+		default:
+			byt, _ := json.Marshal(val)
+			meta[k] = string(byt)
+		}
+	}
+	return meta, nil
+}
+
+// parseXMP reads the properties from an xmp packet keyed by their name without namespace,
+// for list properties (rdf:Seq, rdf:Alt, rdf:Bag) the first item is used.
+func parseXMP(data []byte) (map[string]string, error) {
+	meta := map[string]string{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var stack []string
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return meta, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "Description" {
+				// simple properties are often written as attributes of rdf:Description
+				for _, attr := range t.Attr {
+					if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" || attr.Name.Local == "about" {
+						continue
+					}
+					meta[attr.Name.Local] = attr.Value
+				}
+			}
+			stack = append(stack, t.Name.Local)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text == "" || len(stack) == 0 {
+				continue
+			}
+			name := stack[len(stack)-1]
+			if name == "li" && len(stack) > 2 {
+				// <exif:ISOSpeedRatings><rdf:Seq><rdf:li>
+				name = stack[len(stack)-3]
+			}
+			if _, ok := meta[name]; !ok {
+				meta[name] = text
+			}
+		}
+	}
+	return meta, nil
+}
+
+// ReadSidecar reads the metadata from a single sidecar file.
+func ReadSidecar(sidecar string) (map[string]string, error) {
+	ext := strings.ToLower(filepath.Ext(sidecar))
+	if ext == ".thm" {
+		return readExifMetadata(sidecar)
+	}
+	byt, err := ioutil.ReadFile(sidecar)
+	if err != nil {
+		return nil, err
+	}
+	switch ext {
+	case ".json":
+		return parseJSONSidecar(byt)
+	case ".xmp":
+		return parseXMP(byt)
+	}
+	return nil, fmt.Errorf("[sidecar] unknown sidecar type %s", sidecar)
+}
+
+// readSidecars merges the metadata from sidecars into meta, in precedence order.
+func readSidecars(meta map[string]string, sidecars []string) {
+	for precedence := range SidecarExtensions {
+		for _, sidecar := range sidecars {
+			if sidecarPrecedence(sidecar) != precedence || isProvenance(sidecar) {
+				continue
+			}
+			sidecarMeta, err := ReadSidecar(sidecar)
+			if err != nil {
+				errLog.Printf("[sidecar] %s", err)
+				continue
+			}
+			for k, v := range sidecarMeta {
+				meta[k] = v
+			}
+		}
+	}
+}
+
+// LoadMetadata fills img.Metadata from the exif embedded in the image overlaid with its sidecars.
+func LoadMetadata(img *Image) error {
+	meta, err := readExifMetadata(img.Path)
+	if err != nil {
+		meta = map[string]string{}
+	}
+	if img.Sidecars == nil {
+		img.Sidecars = FindSidecars(img.Path)
+	}
+	readSidecars(meta, img.Sidecars)
+	img.Metadata = meta
+	if t, ok := MetadataTimestamp(meta); ok {
+		img.ExifTimestamp = t
+	}
+	return nil
+}
+
+// metadataTimeForms are the forms datetimes are found in across exif, xmp and json sidecars.
+var metadataTimeForms = []string{
+	dumbExifForm,
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+}
+
+// MetadataTimestamp returns the capture time from metadata, checking DateTime, DateTimeOriginal then CreateDate.
+// the time is returned as wall clock time in UTC, the same as timestamps parsed from filenames.
+func MetadataTimestamp(meta map[string]string) (time.Time, bool) {
+	for _, key := range []string{"DateTime", "DateTimeOriginal", "CreateDate"} {
+		value, ok := meta[key]
+		if !ok {
+			continue
+		}
+		for _, form := range metadataTimeForms {
+			if t, err := time.Parse(form, value); err == nil {
+				return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// sidecarTimestamp returns the capture time from the highest precedence sidecar that has one.
+func sidecarTimestamp(sidecars []string) (time.Time, error) {
+	meta := map[string]string{}
+	readSidecars(meta, sidecars)
+	if t, ok := MetadataTimestamp(meta); ok {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("[sidecar] no datetime in sidecars")
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    tiff:Model="Canon EOS 600D"
+    exif:DateTimeOriginal="2018-04-01T10:03:00+10:00">
+   <exif:ISOSpeedRatings>
+    <rdf:Seq>
+     <rdf:li>400</rdf:li>
+    </rdf:Seq>
+   </exif:ISOSpeedRatings>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+func TestParseXMP(t *testing.T) {
+	meta, err := parseXMP([]byte(testXMP))
+	assert.NoError(t, err)
+	assert.Equal(t, "Canon EOS 600D", meta["Model"])
+	assert.Equal(t, "400", meta["ISOSpeedRatings"])
+	assert.Equal(t, "2018-04-01T10:03:00+10:00", meta["DateTimeOriginal"])
+	_, hasAbout := meta["about"]
+	assert.False(t, hasAbout)
+
+	datetime, ok := MetadataTimestamp(meta)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2018, 4, 1, 10, 3, 0, 0, time.UTC), datetime)
+}
+
+func TestSidecars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgPath := filepath.Join(dir, "GC03L_2018_04_01_10_03_00.jpg")
+	ioutil.WriteFile(imgPath, []byte("not really a jpeg"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "GC03L_2018_04_01_10_03_00.xmp"), []byte(testXMP), 0644)
+	ioutil.WriteFile(imgPath+".json", []byte(`{"DateTime": "2018:04:01 10:05:00", "ISO": 100}`), 0644)
+
+	sidecars := FindSidecars(imgPath)
+	assert.Equal(t, []string{filepath.Join(dir, "GC03L_2018_04_01_10_03_00.xmp"), imgPath + ".json"}, sidecars)
+	assert.True(t, IsSidecar(sidecars[0]))
+	assert.False(t, IsSidecar(imgPath))
+
+	// on a case insensitive filesystem .JSON is the same file as .json, a hard link is the same to os.SameFile
+	if err := os.Link(imgPath+".json", imgPath+".JSON"); err == nil {
+		assert.Equal(t, sidecars, FindSidecars(imgPath))
+		os.Remove(imgPath + ".JSON")
+	}
+
+	// json takes precedence over xmp
+	datetime, err := GetTimeFromExif(imgPath)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2018, 4, 1, 10, 5, 0, 0, time.UTC), datetime)
+
+	img := Image{Path: imgPath, Sidecars: sidecars}
+	assert.NoError(t, LoadMetadata(&img))
+	assert.Equal(t, "Canon EOS 600D", img.Metadata["Model"])
+	assert.Equal(t, "100", img.Metadata["ISO"])
+
+	dest := filepath.Join(dir, "renamed_2018_04_01_10_00_00_00.jpg")
+	copied, err := CopySidecars(img, dest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "renamed_2018_04_01_10_00_00_00.xmp"), dest + ".json"}, copied)
+	for _, sidecar := range copied {
+		assert.FileExists(t, sidecar)
+	}
+
+	moved, err := MoveSidecars(Image{Path: dest, Sidecars: copied}, filepath.Join(dir, "moved.jpg"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "moved.xmp"), filepath.Join(dir, "moved.jpg.json")}, moved)
+	for i, sidecar := range moved {
+		assert.FileExists(t, sidecar)
+		_, err := os.Stat(copied[i])
+		assert.True(t, os.IsNotExist(err))
+	}
+}
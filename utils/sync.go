@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// SyncSet is the image from each stream for one slot, streams without an image within the tolerance are Missing.
+type SyncSet struct {
+	Slot     time.Time        `json:"slot"`
+	Images   map[string]Image `json:"images"`
+	Missing  []string         `json:"missing,omitempty"`
+	Complete bool             `json:"complete"`
+}
+
+// EmitSet outputs a set, as its image paths (one per line, in stream order) for the path output format.
+func EmitSet(set SyncSet, outfmt string) error {
+	switch outfmt {
+	case "path":
+		var streams []string
+		for stream := range set.Images {
+			streams = append(streams, stream)
+		}
+		sort.Strings(streams)
+		for _, stream := range streams {
+			if _, err := fmt.Fprintln(os.Stdout, set.Images[stream].Path); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "msgpack":
+		return msgpackEncoder.Encode(set)
+	}
+	return jsonEncoder.Encode(set)
+}
+
+// Synchroniser aligns several streams (ie the cameras in a chamber) to common slots and groups them into sets.
+// each stream is thinned to one image per slot by its own Sampler, and a set is emitted once every stream has
+// moved past its slot, so a stream that stops holds the sets back until Flush.
+// if Streams is empty the streams arent known until the end, so nothing is emitted before Flush.
+type Synchroniser struct {
+	Alignment Alignment
+	// Streams are the streams every set should have
+	Streams []string
+	// Prefer and Window are passed to each streams Sampler
+	Prefer string
+	Window time.Duration
+	// DropIncomplete drops sets missing a stream instead of emitting them
+	DropIncomplete bool
+	// Emit is called with each set in slot order
+	Emit func(SyncSet)
+
+	samplers map[string]*Sampler
+	reached  map[string]time.Time
+	sets     map[time.Time]*SyncSet
+}
+
+// Add adds an image from a stream.
+func (s *Synchroniser) Add(stream string, img Image) {
+	if s.samplers == nil {
+		s.samplers = map[string]*Sampler{}
+		s.reached = map[string]time.Time{}
+		s.sets = map[time.Time]*SyncSet{}
+	}
+	sampler, ok := s.samplers[stream]
+	if !ok {
+		if len(s.Streams) > 0 && !s.expected(stream) {
+			errLog.Printf("[sync] %s is from %s, which isnt one of the streams", img.Path, stream)
+			return
+		}
+		sampler = NewAlignedSampler(s.Alignment, func(chosen Image) { s.offer(stream, chosen) })
+		sampler.Prefer = s.Prefer
+		sampler.Window = s.Window
+		s.samplers[stream] = sampler
+	}
+	sampler.Add(img)
+	if len(s.Streams) > 0 {
+		s.emitBefore(s.cutoff())
+	}
+}
+
+func (s *Synchroniser) expected(stream string) bool {
+	for _, expected := range s.Streams {
+		if expected == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// offer puts the image chosen for a slot by a streams sampler into its set.
+func (s *Synchroniser) offer(stream string, img Image) {
+	slot, _ := s.Alignment.Slot(img.Timestamp)
+	set, ok := s.sets[slot]
+	if !ok {
+		set = &SyncSet{Slot: slot, Images: map[string]Image{}}
+		s.sets[slot] = set
+	}
+	set.Images[stream] = img
+	s.reached[stream] = slot
+}
+
+// cutoff returns the earliest slot a stream has reached, every set before it is finished.
+func (s *Synchroniser) cutoff() time.Time {
+	var cutoff time.Time
+	for _, stream := range s.Streams {
+		reached, ok := s.reached[stream]
+		if !ok {
+			return time.Time{}
+		}
+		if cutoff.IsZero() || reached.Before(cutoff) {
+			cutoff = reached
+		}
+	}
+	return cutoff
+}
+
+// emitBefore emits the sets up to and including cutoff in order.
+func (s *Synchroniser) emitBefore(cutoff time.Time) {
+	if cutoff.IsZero() {
+		return
+	}
+	s.emit(func(slot time.Time) bool { return !slot.After(cutoff) })
+}
+
+// emit emits the ready sets in order, filling in the streams they are missing.
+func (s *Synchroniser) emit(ready func(time.Time) bool) {
+	streams := s.Streams
+	if len(streams) == 0 {
+		for stream := range s.samplers {
+			streams = append(streams, stream)
+		}
+	}
+	streams = append([]string(nil), streams...)
+	sort.Strings(streams)
+
+	var slots []time.Time
+	for slot := range s.sets {
+		if ready(slot) {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Before(slots[j]) })
+	for _, slot := range slots {
+		set := s.sets[slot]
+		delete(s.sets, slot)
+		for _, stream := range streams {
+			if _, ok := set.Images[stream]; !ok {
+				set.Missing = append(set.Missing, stream)
+			}
+		}
+		set.Complete = len(set.Missing) == 0
+		if !set.Complete && s.DropIncomplete {
+			continue
+		}
+		s.Emit(*set)
+	}
+}
+
+// Flush emits every set still buffered, call it at the end of the input.
+func (s *Synchroniser) Flush() {
+	for _, sampler := range s.samplers {
+		sampler.Flush()
+	}
+	s.emit(func(time.Time) bool { return true })
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSynchroniser(t *testing.T) {
+	a, _ := NewAlignment(5*time.Minute, AlignNearest, time.Minute)
+	var sets []SyncSet
+	s := &Synchroniser{
+		Alignment: a,
+		Streams:   []string{"GC03L", "GC03R", "GC03-Picam"},
+		Emit:      func(set SyncSet) { sets = append(sets, set) },
+	}
+	add := func(stream, timestamp string) {
+		s.Add(stream, Image{Path: stream + "@" + timestamp, Timestamp: wallClock("2018-04-01T" + timestamp)})
+	}
+	add("GC03L", "10:00:02")
+	add("GC03R", "10:00:05")
+	add("GC03-Picam", "09:59:40")
+	add("GC03L", "10:05:01")
+	add("GC03R", "10:04:58")
+	// nothing is finished until every stream has moved past a slot
+	assert.Empty(t, sets)
+	add("GC03-Picam", "10:10:00")
+	assert.Len(t, sets, 1)
+	add("GC03L", "10:10:03")
+	add("GC03R", "10:10:01")
+	add("GC03-Picam", "10:15:00")
+	// from a stream that wasnt asked for
+	add("GC04L", "10:15:00")
+	s.Flush()
+
+	assert.Len(t, sets, 4)
+	assert.Equal(t, wallClock("2018-04-01T10:00:00"), sets[0].Slot)
+	assert.True(t, sets[0].Complete)
+	assert.Equal(t, "GC03-Picam@09:59:40", sets[0].Images["GC03-Picam"].Path)
+	assert.Equal(t, []string{"GC03-Picam"}, sets[1].Missing)
+	assert.False(t, sets[1].Complete)
+	assert.True(t, sets[2].Complete)
+	assert.Equal(t, []string{"GC03L", "GC03R"}, sets[3].Missing)
+
+	// dropping incomplete sets, with the streams found from the input
+	sets = nil
+	s = &Synchroniser{Alignment: a, DropIncomplete: true, Emit: func(set SyncSet) { sets = append(sets, set) }}
+	add("GC03L", "10:00:02")
+	add("GC03R", "10:00:05")
+	add("GC03L", "10:05:00")
+	assert.Empty(t, sets)
+	s.Flush()
+	assert.Len(t, sets, 1)
+	assert.Equal(t, wallClock("2018-04-01T10:00:00"), sets[0].Slot)
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// absoluteTimeForms are the forms absolute times can be given in, other than RFC3339.
+// they are wall clock times, like the timestamps parsed from filenames.
+var absoluteTimeForms = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	TsForm,
+}
+
+// dayUnits matches the day and week units ParseDuration adds to time.ParseDuration
+var dayUnits = regexp.MustCompile(`([0-9]+(?:\.[0-9]+)?)([dw])`)
+
+// ParseDuration parses a duration like time.ParseDuration, with the extra units d (24h) and w (7d), ie -1d12h or 2w.
+func ParseDuration(value string) (time.Duration, error) {
+	expanded := dayUnits.ReplaceAllStringFunc(value, func(match string) string {
+		parts := dayUnits.FindStringSubmatch(match)
+		n, _ := strconv.ParseFloat(parts[1], 64)
+		hours := n * 24
+		if parts[2] == "w" {
+			hours *= 7
+		}
+		return strconv.FormatFloat(hours, 'f', -1, 64) + "h"
+	})
+	d, err := time.ParseDuration(expanded)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse duration %q", value)
+	}
+	return d, nil
+}
+
+// WallClockNow returns the current local wall clock time as UTC, the same as timestamps parsed from filenames.
+func WallClockNow() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC)
+}
+
+// ParseAbsoluteTime parses RFC3339 or one of the wall clock forms YYYY-MM-DDTHH:MM[:SS], YYYY-MM-DD HH:MM[:SS],
+// YYYY-MM-DD or YYYY_MM_DD_hh_mm_ss.
+func ParseAbsoluteTime(value string) (time.Time, error) {
+	for _, form := range append([]string{time.RFC3339Nano}, absoluteTimeForms...) {
+		if t, err := time.Parse(form, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("couldn't parse time %q", value)
+}
+
+// timeAnchors return the start of a calendar period relative to now.
+var timeAnchors = map[string]func(now time.Time) time.Time{
+	"now":       func(now time.Time) time.Time { return now },
+	"today":     startOfDay,
+	"yesterday": func(now time.Time) time.Time { return startOfDay(now).AddDate(0, 0, -1) },
+	"tomorrow":  func(now time.Time) time.Time { return startOfDay(now).AddDate(0, 0, 1) },
+	"this-week": startOfWeek,
+	"last-week": func(now time.Time) time.Time { return startOfWeek(now).AddDate(0, 0, -7) },
+	"next-week": func(now time.Time) time.Time { return startOfWeek(now).AddDate(0, 0, 7) },
+	"this-month": func(now time.Time) time.Time {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	},
+	"last-month": func(now time.Time) time.Time {
+		return time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, now.Location())
+	},
+	"next-month": func(now time.Time) time.Time {
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+	},
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// startOfWeek returns midnight on the monday of the week of t
+func startOfWeek(t time.Time) time.Time {
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	return startOfDay(t).AddDate(0, 0, -daysSinceMonday)
+}
+
+// ParseTimeExpression parses an absolute time (see ParseAbsoluteTime) or a time relative to now:
+//
+//	a duration relative to now: -24h, +30m, -7d, -2w
+//	an anchor: now, today, yesterday, tomorrow, this-week, last-week, next-week, this-month, last-month, next-month
+//	  the day anchors are midnight, weeks start on monday and months on the 1st
+//	an anchor with an offset: today+6h, yesterday-30m, last-week+2d
+//
+// anything else is an error.
+func ParseTimeExpression(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("empty time")
+	}
+	if t, err := ParseAbsoluteTime(value); err == nil {
+		return t, nil
+	}
+
+	base, offset := now, value
+	if value[0] != '+' && value[0] != '-' {
+		// the longest anchor the value starts with, followed by nothing or an offset
+		lower, name := strings.ToLower(value), ""
+		for anchor := range timeAnchors {
+			rest := strings.TrimPrefix(lower, anchor)
+			if len(anchor) > len(name) && strings.HasPrefix(lower, anchor) && (rest == "" || rest[0] == '+' || rest[0] == '-') {
+				name = anchor
+			}
+		}
+		if name == "" {
+			return time.Time{}, fmt.Errorf("couldn't parse time %q, use RFC3339, YYYY-MM-DD[THH:MM[:SS]], a duration like -24h or an anchor like today", value)
+		}
+		base, offset = timeAnchors[name](now), value[len(name):]
+	}
+	if offset == "" {
+		return base, nil
+	}
+	d, err := ParseDuration(offset)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("couldn't parse time %q: %s", value, err)
+	}
+	return base.Add(d), nil
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseTimeExpression(t *testing.T) {
+	// a wednesday
+	now := time.Date(2018, 4, 4, 15, 30, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Time{
+		"2018-04-01T10:00:00+10:00": time.Date(2018, 4, 1, 10, 0, 0, 0, time.FixedZone("", 10*3600)),
+		"2018-04-01T10:00":          time.Date(2018, 4, 1, 10, 0, 0, 0, time.UTC),
+		"2018-04-01 10:00:30":       time.Date(2018, 4, 1, 10, 0, 30, 0, time.UTC),
+		"2018-04-01":                time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC),
+		"2018_04_01_10_03_00":       time.Date(2018, 4, 1, 10, 3, 0, 0, time.UTC),
+		"now":                       now,
+		"-24h":                      now.Add(-24 * time.Hour),
+		"+30m":                      now.Add(30 * time.Minute),
+		"-1d12h":                    now.Add(-36 * time.Hour),
+		"-2w":                       now.AddDate(0, 0, -14),
+		"today":                     time.Date(2018, 4, 4, 0, 0, 0, 0, time.UTC),
+		"Yesterday":                 time.Date(2018, 4, 3, 0, 0, 0, 0, time.UTC),
+		"tomorrow":                  time.Date(2018, 4, 5, 0, 0, 0, 0, time.UTC),
+		"today+6h":                  time.Date(2018, 4, 4, 6, 0, 0, 0, time.UTC),
+		"yesterday-30m":             time.Date(2018, 4, 2, 23, 30, 0, 0, time.UTC),
+		"this-week":                 time.Date(2018, 4, 2, 0, 0, 0, 0, time.UTC),
+		"last-week":                 time.Date(2018, 3, 26, 0, 0, 0, 0, time.UTC),
+		"last-week+2d":              time.Date(2018, 3, 28, 0, 0, 0, 0, time.UTC),
+		"last-month":                time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC),
+		"this-month":                time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		actual, err := ParseTimeExpression(value, now)
+		if assert.NoError(t, err, value) {
+			assert.True(t, expected.Equal(actual), "%s: expected %s got %s", value, expected, actual)
+		}
+	}
+
+	// sunday is the end of the week
+	sunday := time.Date(2018, 4, 8, 12, 0, 0, 0, time.UTC)
+	thisWeek, _ := ParseTimeExpression("this-week", sunday)
+	assert.Equal(t, time.Date(2018, 4, 2, 0, 0, 0, 0, time.UTC), thisWeek)
+
+	for _, bad := range []string{"", "01/04/2018", "11 June 1996", "yesterdays", "today+", "today+6", "-24", "last-fortnight", "2018-13-01"} {
+		_, err := ParseTimeExpression(bad, now)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// RangeHalfOpen includes the start and excludes the end, [start,end), so back to back ranges dont overlap or leave gaps
+	RangeHalfOpen = "half-open"
+	// RangeClosed includes both ends, [start,end]
+	RangeClosed = "closed"
+	// RangeOpen excludes both ends, (start,end)
+	RangeOpen = "open"
+	// RangeOpenClosed excludes the start and includes the end, (start,end]
+	RangeOpenClosed = "open-closed"
+)
+
+// TimeRange selects timestamps between a start and an end, which ends are included depends on the Mode.
+//
+// timestamps are wall clock time at the camera labelled as UTC, so they are compared with the wall clock time
+// of the start and end in Location. start and end in UTC are taken to already be wall clock times,
+// those with another offset (ie RFC3339 with +10:00) are converted to the wall clock in Location, which is correct
+// either side of daylight saving changes.
+type TimeRange struct {
+	Start, End time.Time
+	Mode       string
+	// Location is the time zone of the camera, nil is UTC
+	Location *time.Location
+}
+
+// NewTimeRange creates a range in the time zone of the camera (nil is UTC), checking the mode
+// and that the end isnt before the start.
+func NewTimeRange(start, end time.Time, mode string, loc *time.Location) (TimeRange, error) {
+	switch mode {
+	case "":
+		mode = RangeHalfOpen
+	case RangeHalfOpen, RangeClosed, RangeOpen, RangeOpenClosed:
+	default:
+		return TimeRange{}, fmt.Errorf("unknown range mode %q (choices: %s,%s,%s,%s)", mode, RangeHalfOpen, RangeClosed, RangeOpen, RangeOpenClosed)
+	}
+	r := TimeRange{Start: start, End: end, Mode: mode, Location: loc}
+	if r.wallClock(end).Before(r.wallClock(start)) {
+		return TimeRange{}, fmt.Errorf("end %s is before start %s", end.Format(time.RFC3339), start.Format(time.RFC3339))
+	}
+	return r, nil
+}
+
+// wallClock returns the wall clock time of t in the range location, labelled as UTC like timestamps.
+func (r TimeRange) wallClock(t time.Time) time.Time {
+	if t.Location() == time.UTC {
+		return t
+	}
+	loc := r.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	w := t.In(loc)
+	return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), w.Nanosecond(), time.UTC)
+}
+
+// Contains returns true if the timestamp t is in the range.
+func (r TimeRange) Contains(t time.Time) bool {
+	start, end := r.wallClock(r.Start), r.wallClock(r.End)
+	t = r.wallClock(t)
+	afterStart, beforeEnd := t.After(start), t.Before(end)
+	switch r.Mode {
+	case RangeClosed:
+		return (afterStart || t.Equal(start)) && (beforeEnd || t.Equal(end))
+	case RangeOpen:
+		return afterStart && beforeEnd
+	case RangeOpenClosed:
+		return afterStart && (beforeEnd || t.Equal(end))
+	}
+	return (afterStart || t.Equal(start)) && beforeEnd
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func wallClock(s string) time.Time {
+	t, err := time.Parse("2006-01-02T15:04:05", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestTimeRangeModes(t *testing.T) {
+	start, end := wallClock("2018-04-01T10:00:00"), wallClock("2018-04-01T11:00:00")
+	cases := map[string][4]bool{
+		// before start, at start, at end, after end
+		RangeHalfOpen:   {false, true, false, false},
+		RangeClosed:     {false, true, true, false},
+		RangeOpen:       {false, false, false, false},
+		RangeOpenClosed: {false, false, true, false},
+	}
+	for mode, expected := range cases {
+		r, err := NewTimeRange(start, end, mode, nil)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, expected[0], r.Contains(start.Add(-time.Nanosecond)), "%s before start", mode)
+		assert.Equal(t, expected[1], r.Contains(start), "%s at start", mode)
+		assert.Equal(t, expected[2], r.Contains(end), "%s at end", mode)
+		assert.Equal(t, expected[3], r.Contains(end.Add(time.Nanosecond)), "%s after end", mode)
+		assert.True(t, r.Contains(start.Add(30*time.Minute)), "%s middle", mode)
+	}
+
+	r, err := NewTimeRange(start, end, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, RangeHalfOpen, r.Mode)
+
+	// an empty range only contains its instant when closed
+	r, _ = NewTimeRange(start, start, RangeClosed, nil)
+	assert.True(t, r.Contains(start))
+	r, _ = NewTimeRange(start, start, RangeHalfOpen, nil)
+	assert.False(t, r.Contains(start))
+
+	_, err = NewTimeRange(start, end, "[)", nil)
+	assert.Error(t, err)
+	_, err = NewTimeRange(end, start, RangeHalfOpen, nil)
+	assert.Error(t, err)
+}
+
+func TestTimeRangeBackToBack(t *testing.T) {
+	// consecutive hourly runs, every image must be selected by exactly one of them
+	var ranges []TimeRange
+	for h := 0; h < 3; h++ {
+		start := wallClock("2018-04-01T10:00:00").Add(time.Duration(h) * time.Hour)
+		r, err := NewTimeRange(start, start.Add(time.Hour), RangeHalfOpen, nil)
+		assert.NoError(t, err)
+		ranges = append(ranges, r)
+	}
+	for ts := wallClock("2018-04-01T10:00:00"); ts.Before(wallClock("2018-04-01T13:00:00")); ts = ts.Add(5 * time.Minute) {
+		n := 0
+		for _, r := range ranges {
+			if r.Contains(ts) {
+				n++
+			}
+		}
+		assert.Equal(t, 1, n, ts.String())
+	}
+}
+
+func TestTimeRangeDaylightSaving(t *testing.T) {
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// wall clock bounds select whole wall clock days, the end of daylight saving on 2018-04-01 has 25 hours
+	// but the timestamps only ever cover 00:00 to 23:59
+	r, _ := NewTimeRange(wallClock("2018-04-01T00:00:00"), wallClock("2018-04-02T00:00:00"), RangeHalfOpen, sydney)
+	assert.True(t, r.Contains(wallClock("2018-04-01T00:00:00")))
+	assert.True(t, r.Contains(wallClock("2018-04-01T02:30:00")))
+	assert.True(t, r.Contains(wallClock("2018-04-01T23:59:59")))
+	assert.False(t, r.Contains(wallClock("2018-04-02T00:00:00")))
+
+	// 03:00 daylight time is 02:00 standard time, so a bound given with an offset is compared on the camera wall clock
+	r, _ = NewTimeRange(time.Date(2018, 4, 1, 2, 30, 0, 0, time.FixedZone("AEST", 10*3600)),
+		wallClock("2018-04-01T04:00:00"), RangeHalfOpen, sydney)
+	assert.False(t, r.Contains(wallClock("2018-04-01T02:29:59")))
+	assert.True(t, r.Contains(wallClock("2018-04-01T02:30:00")))
+
+	// the start of daylight saving on 2018-10-07 skips 02:00 to 03:00, an hour long range in real time
+	// covers two hours of wall clock
+	r, _ = NewTimeRange(time.Date(2018, 10, 7, 1, 30, 0, 0, sydney), time.Date(2018, 10, 7, 1, 30, 0, 0, sydney).Add(time.Hour),
+		RangeHalfOpen, sydney)
+	assert.Equal(t, wallClock("2018-10-07T03:30:00"), r.wallClock(r.End))
+	assert.True(t, r.Contains(wallClock("2018-10-07T01:45:00")))
+	assert.True(t, r.Contains(wallClock("2018-10-07T03:15:00")))
+	assert.False(t, r.Contains(wallClock("2018-10-07T03:30:00")))
+
+	// without a location offsets are compared as instants, as before
+	r, _ = NewTimeRange(time.Date(2018, 4, 1, 10, 0, 0, 0, time.FixedZone("", 10*3600)), wallClock("2018-04-01T12:00:00"),
+		RangeHalfOpen, nil)
+	assert.False(t, r.Contains(wallClock("2018-03-31T23:59:59")))
+	assert.True(t, r.Contains(wallClock("2018-04-01T00:00:00")))
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReasonExtension is appended to the path of a quarantined image for the file explaining why it was quarantined.
+const ReasonExtension = ".reason.txt"
+
+const (
+	tagStripOffsets    = 0x0111
+	tagStripByteCounts = 0x0117
+	tagTileOffsets     = 0x0144
+	tagTileByteCounts  = 0x0145
+	// maximum number of ifds to follow in a tiff, guards against loops
+	maxIfdChain = 1024
+)
+
+var (
+	jpegSOI = []byte{0xFF, 0xD8}
+	jpegEOI = []byte{0xFF, 0xD9}
+	pngIEND = []byte("IEND\xAE\x42\x60\x82")
+)
+
+// validateJpeg checks a jpeg ends with an EOI marker, which truncated uploads dont.
+func validateJpeg(data []byte) error {
+	// some cameras pad the end of the file
+	trimmed := bytes.TrimRight(data, "\x00")
+	if !bytes.HasSuffix(trimmed, jpegEOI) {
+		return fmt.Errorf("truncated jpeg: no EOI marker")
+	}
+	return nil
+}
+
+// validatePng checks a png ends with an IEND chunk.
+func validatePng(data []byte) error {
+	if !bytes.HasSuffix(data, pngIEND) {
+		return fmt.Errorf("truncated png: no IEND chunk")
+	}
+	return nil
+}
+
+// ifdUints reads the values of a SHORT or LONG ifd entry.
+func ifdUints(raw []byte, order binary.ByteOrder, entry []byte) ([]uint64, error) {
+	typ, count := order.Uint16(entry[2:]), uint64(order.Uint32(entry[4:]))
+	var size uint64
+	switch typ {
+	case tiffShort:
+		size = 2
+	case tiffLong:
+		size = 4
+	default:
+		return nil, fmt.Errorf("unexpected type %d", typ)
+	}
+	value := entry[8:12]
+	if size*count > 4 {
+		offset := uint64(order.Uint32(entry[8:]))
+		if offset+size*count > uint64(len(raw)) {
+			return nil, fmt.Errorf("values out of range")
+		}
+		value = raw[offset : offset+size*count]
+	}
+	values := make([]uint64, count)
+	for i := range values {
+		if size == 2 {
+			values[i] = uint64(order.Uint16(value[uint64(i)*2:]))
+		} else {
+			values[i] = uint64(order.Uint32(value[uint64(i)*4:]))
+		}
+	}
+	return values, nil
+}
+
+// validateTiff walks every ifd of a tiff checking the entries and the strips or tiles they point to are inside the file.
+func validateTiff(data []byte) error {
+	order, offset, err := readTiffHeader(data)
+	if err != nil {
+		return err
+	}
+	visited := map[uint32]bool{}
+	for n := 0; offset != 0; n++ {
+		if n > maxIfdChain || visited[offset] {
+			return fmt.Errorf("broken tiff: ifd chain loops")
+		}
+		visited[offset] = true
+		if uint64(offset)+2 > uint64(len(data)) {
+			return fmt.Errorf("broken tiff: ifd offset %d out of range", offset)
+		}
+		count := uint64(order.Uint16(data[offset:]))
+		end := uint64(offset) + 2 + count*12 + 4
+		if end > uint64(len(data)) {
+			return fmt.Errorf("truncated tiff: ifd at %d overruns data", offset)
+		}
+
+		segments := map[uint16][]uint64{}
+		for i := uint64(0); i < count; i++ {
+			entry := data[uint64(offset)+2+i*12 : uint64(offset)+2+(i+1)*12]
+			tag, typ := order.Uint16(entry), order.Uint16(entry[2:])
+			typeSize, ok := tiffTypeSizes[typ]
+			if !ok {
+				return fmt.Errorf("broken tiff: tag 0x%04X has unknown type %d", tag, typ)
+			}
+			length := uint64(typeSize) * uint64(order.Uint32(entry[4:]))
+			if length > 4 && uint64(order.Uint32(entry[8:]))+length > uint64(len(data)) {
+				return fmt.Errorf("truncated tiff: tag 0x%04X value out of range", tag)
+			}
+			switch tag {
+			case tagStripOffsets, tagStripByteCounts, tagTileOffsets, tagTileByteCounts:
+				if segments[tag], err = ifdUints(data, order, entry); err != nil {
+					return fmt.Errorf("broken tiff: tag 0x%04X %s", tag, err)
+				}
+			}
+		}
+
+		for _, pair := range [][2]uint16{{tagStripOffsets, tagStripByteCounts}, {tagTileOffsets, tagTileByteCounts}} {
+			offsets, counts := segments[pair[0]], segments[pair[1]]
+			if len(offsets) != len(counts) {
+				return fmt.Errorf("broken tiff: %d offsets for %d byte counts", len(offsets), len(counts))
+			}
+			for i := range offsets {
+				if offsets[i]+counts[i] > uint64(len(data)) {
+					return fmt.Errorf("truncated tiff: image data out of range")
+				}
+			}
+		}
+		offset = order.Uint32(data[end-4:])
+	}
+	return nil
+}
+
+// ValidateData checks the structure of jpeg, png and tiff data and that it fully decodes.
+// returns the decoded image so it doesnt need to be decoded again, or nil if there is no decoder for the data (cr2,
+// unknown formats and unsupported variants like tiff compressions), which isnt counted as invalid.
+func ValidateData(data []byte) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty file")
+	}
+	var err error
+	switch DetectFormat(data) {
+	case FormatJPEG:
+		err = validateJpeg(data)
+	case FormatPNG:
+		err = validatePng(data)
+	case FormatTIFF:
+		err = validateTiff(data)
+	case FormatCR2:
+		// the raw data cant be decoded, only its structure checked
+		return nil, validateTiff(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, _, err := image.Decode(bytes.NewReader(data))
+	switch err.(type) {
+	case nil:
+		return m, nil
+	case jpeg.UnsupportedError, png.UnsupportedError, tiff.UnsupportedError:
+		return nil, nil
+	}
+	if err == image.ErrFormat {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("couldn't decode: %s", err)
+}
+
+// ValidateImage checks an image from its data if it has any, otherwise from the file at its path.
+func ValidateImage(img Image) (image.Image, error) {
+	data, err := imageData(img)
+	if err != nil {
+		return nil, err
+	}
+	return ValidateData(data)
+}
+
+// Quarantine moves an image and its sidecars into dir, writing the reason next to it in <name>.reason.txt
+// the path relative to base is kept so images with the same name dont collide, images outside base go directly
+// in dir. an image is never quarantined over an existing file.
+// returns the path the image was moved to.
+func Quarantine(img Image, dir, base string, reason error) (string, error) {
+	dest := filepath.Join(dir, filepath.Base(img.Path))
+	if base != "" {
+		// LoadImage gives absolute paths, so base is made absolute to match
+		absBase, _ := filepath.Abs(base)
+		absPath, _ := filepath.Abs(img.Path)
+		if rel, err := filepath.Rel(absBase, absPath); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			dest = filepath.Join(dir, rel)
+		}
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return "", fmt.Errorf("%s already quarantined at %s", img.Path, dest)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.FileMode(OsAllRWX)); err != nil {
+		return "", err
+	}
+	if len(img.Data) != 0 {
+		// the image only exists in the pipeline
+		if err := ioutil.WriteFile(dest, img.Data, os.FileMode(OsUserRW|OsGroupRW)); err != nil {
+			return "", err
+		}
+	} else if err := MoveFilebyCopy(img.Path, dest, true); err != nil {
+		return "", err
+	}
+	for _, sidecar := range img.Sidecars {
+		if err := MoveFilebyCopy(sidecar, SidecarDest(img.Path, sidecar, dest), len(img.Data) == 0); err != nil {
+			errLog.Printf("[quarantine] %s", err)
+		}
+	}
+
+	text := fmt.Sprintf("path: %s\nreason: %s\ntime: %s\n", img.Path, reason, time.Now().UTC().Format(time.RFC3339))
+	return dest, ioutil.WriteFile(dest+ReasonExtension, []byte(text), os.FileMode(OsUserRW|OsGroupRW))
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateData(t *testing.T) {
+	for _, format := range []string{"jpeg", "png", "tiff"} {
+		data := encodeTestImage(t, format)
+		m, err := ValidateData(data)
+		assert.NoError(t, err, format)
+		assert.NotNil(t, m, format)
+
+		_, err = ValidateData(data[:len(data)*2/3])
+		assert.Error(t, err, format)
+	}
+
+	// padding after the EOI marker is fine
+	padded := append(encodeTestImage(t, "jpeg"), 0, 0, 0, 0)
+	_, err := ValidateData(padded)
+	assert.NoError(t, err)
+
+	// tiff strips pointing past the end of the file
+	tiffData := encodeTestImage(t, "tiff")
+	err = validateTiff(tiffData[:len(tiffData)-10])
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tiff")
+	}
+
+	_, err = ValidateData(nil)
+	assert.Error(t, err)
+
+	// data there is no decoder for isnt invalid
+	m, err := ValidateData([]byte("not an image"))
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	// neither is a tiff compression the decoder doesnt support
+	order, offset, err := readTiffHeader(tiffData)
+	if !assert.NoError(t, err) {
+		return
+	}
+	unsupported := append([]byte{}, tiffData...)
+	for i := uint32(0); i < uint32(order.Uint16(unsupported[offset:])); i++ {
+		entry := unsupported[offset+2+i*12:]
+		if order.Uint16(entry) == 0x0103 {
+			order.PutUint16(entry[8:], 7)
+		}
+	}
+	m, err = ValidateData(unsupported)
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+}
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quarantine-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := encodeTestImage(t, "jpeg")
+	imgPath := filepath.Join(dir, "GC03L_2018_04_01_10_03_00.jpg")
+	ioutil.WriteFile(imgPath, data[:len(data)/2], 0644)
+	ioutil.WriteFile(imgPath+".json", []byte(`{}`), 0644)
+	img := Image{Path: imgPath, Sidecars: []string{imgPath + ".json"}}
+
+	_, reason := ValidateImage(img)
+	if !assert.Error(t, reason) {
+		return
+	}
+	quarantineDir := filepath.Join(dir, "quarantine")
+	dest, err := Quarantine(img, quarantineDir, "", reason)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(quarantineDir, filepath.Base(imgPath)), dest)
+	assert.FileExists(t, dest)
+	assert.FileExists(t, dest+".json")
+	FileNotExists(t, imgPath)
+	FileNotExists(t, imgPath+".json")
+
+	text, err := ioutil.ReadFile(dest + ReasonExtension)
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(text), reason.Error()), string(text))
+
+	// an image with the same name is never quarantined over the first
+	ioutil.WriteFile(imgPath, data[:len(data)/2], 0644)
+	_, err = Quarantine(img, quarantineDir, "", reason)
+	assert.Error(t, err)
+	assert.FileExists(t, imgPath)
+
+	// the path relative to base is kept
+	subPath := filepath.Join(dir, "sub", filepath.Base(imgPath))
+	os.MkdirAll(filepath.Dir(subPath), 0755)
+	ioutil.WriteFile(subPath, data[:len(data)/2], 0644)
+	dest, err = Quarantine(Image{Path: subPath}, quarantineDir, dir, reason)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(quarantineDir, "sub", filepath.Base(imgPath)), dest)
+	assert.FileExists(t, dest)
+
+	// a relative base, as -source usually is, against the absolute paths of loaded images
+	dayPath := filepath.Join(dir, "day2", filepath.Base(imgPath))
+	os.MkdirAll(filepath.Dir(dayPath), 0755)
+	ioutil.WriteFile(dayPath, data[:len(data)/2], 0644)
+	cwd, _ := os.Getwd()
+	os.Chdir(filepath.Dir(dir))
+	dest, err = Quarantine(Image{Path: dayPath}, quarantineDir, filepath.Base(dir), reason)
+	os.Chdir(cwd)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(quarantineDir, "day2", filepath.Base(imgPath)), dest)
+
+	// images only in the pipeline are written out, images outside base go directly in the quarantine
+	dest, err = Quarantine(Image{Path: "/nonexistent/b.jpg", Data: []byte("xx")}, quarantineDir, dir, errors.New("bad"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(quarantineDir, "b.jpg"), dest)
+	assert.FileExists(t, dest)
+}